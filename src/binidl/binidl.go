@@ -49,7 +49,7 @@ func unmarshalField(b io.Writer, fname, tname string, es *EmitState) {
 
 	ti, ok := typedb[tconv]
 	if !ok {
-		fmt.Fprintf(b, "%s.Unmarshal(wire)\n", fname)
+		fmt.Fprintf(b, "if err := %s.Unmarshal(wire); err != nil {\nreturn err\n}\n", fname)
 		return
 	}
 
@@ -336,7 +336,11 @@ func walkOne(b io.Writer, f *ast.Field, pred string, funcname string, fn func(io
 			fn(b, pred, t.Name, es)
 		}
 	case *ast.SelectorExpr:
-		fmt.Fprintf(b, "%s.%s(wire)\n", pred, funcname)
+		if funcname == "Unmarshal" {
+			fmt.Fprintf(b, "if err := %s.Unmarshal(wire); err != nil {\nreturn err\n}\n", pred)
+		} else {
+			fmt.Fprintf(b, "%s.%s(wire)\n", pred, funcname)
+		}
 	case *ast.ArrayType:
 		s := f.Type.(*ast.ArrayType)
 		i := es.getIndexStr()
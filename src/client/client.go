@@ -10,11 +10,15 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/masterproto"
+	"pineapple/src/payload"
 	"pineapple/src/poisson"
+	"pineapple/src/shard"
 	"pineapple/src/state"
 	"pineapple/src/zipfian"
 
@@ -26,6 +30,9 @@ var leaderPort *int = flag.Int("lport", 7070, "Leader port.")
 var serverAddr *string = flag.String("saddr", "", "Server address.")
 var serverPort *int = flag.Int("sport", 7070, "Server port.")
 var serverID *int = flag.Int("serverID", 0, "Server's ID")
+var masterAddr *string = flag.String("maddr", "", "Master address. If set, each command is sent to the group holding its key in the shard map of the master: to its replica -serverID, or to its leader for RMWs. -saddr and -laddr are then ignored.")
+var masterPort *int = flag.Int("mport", 7087, "Master port.")
+var masterList *string = flag.String("masters", "", "Comma-separated addr:port of replicated masters, used as -maddr is.")
 var procs *int = flag.Int("p", 2, "GOMAXPROCS.")
 var conflicts *int = flag.Int("c", 0, "Percentage of conflicts. If -1, uses Zipfian distribution.")
 var forceLeader = flag.Int("l", -1, "Force client to talk to a certain replica.")
@@ -37,6 +44,10 @@ var zKeys = flag.Uint64("z", 1e9, "Number of unique keys in zipfian distribution
 var poissonAvg = flag.Int("poisson", -1, "The average number of microseconds between requests. -1 disables Poisson.")
 var percentWrites = flag.Float64("writes", 1, "A float between 0 and 1 that corresponds to the percentage of requests that should be writes. The remainder will be reads.")
 var percentRMWs = flag.Float64("rmws", 0, "A float between 0 and 1 that corresponds to the percentage of writes that should be RMWs. The remainder will be regular writes.")
+var valueSize = flag.Int("vsize", 8, "Mean size in bytes of the values written by PUTs.")
+var valueDist = flag.String("vdist", payload.FIXED, "Distribution of the value sizes: fixed, uniform (between 1 and twice -vsize) or exponential.")
+var rmwFn = flag.String("rmwfn", "add", "Modify function applied by RMWs: add, cas, max or min.")
+var rmwArg = flag.String("rmwarg", "", "Integer value that cas RMWs expect to find, they swap in 1 if the key holds it. Defaults to expecting an absent key.")
 var tailAtScale *int = flag.Int("tailAtScale", -1, "Simulate storage request fan-out by performing <tailAtScale> requests and aggregating statistics.") // USE clientnew;  tas not supported with this client
 
 var blindWrites = flag.Bool("blindwrites", false, "True if writes don't need to execute before clients receive responses.")
@@ -66,6 +77,10 @@ type outstandingRequestInfo struct {
 // An outstandingRequestInfo per client thread
 var orInfos []*outstandingRequestInfo
 
+// Modify function selected by -rmwfn, and its argument given by -rmwarg
+var modifyFn state.ModifyId
+var modifyArg state.Value
+
 func main() {
 	flag.Parse()
 
@@ -75,6 +90,19 @@ func main() {
 		log.Fatalf("Conflicts percentage must be between 0 and 100.\n")
 	}
 
+	if fn, present := state.LookupModify(*rmwFn); present {
+		modifyFn = fn
+	} else {
+		log.Fatalf("Unknown RMW modify function %s.\n", *rmwFn)
+	}
+	if *rmwArg != "" {
+		arg, err := strconv.ParseInt(*rmwArg, 10, 64)
+		if err != nil {
+			log.Fatalf("Bad RMW argument %s.\n", *rmwArg)
+		}
+		modifyArg = state.IntValue(arg)
+	}
+
 	orInfos = make([]*outstandingRequestInfo, *T)
 
 	readings := make(chan *response, 100000)
@@ -82,7 +110,18 @@ func main() {
 	//startTime := rand.New(rand.NewSource(time.Now().UnixNano()))
 	experimentStart := time.Now()
 
+	var shards *shard.Map
+	var groups []masterproto.Group
+	if *masterAddr != "" || *masterList != "" {
+		shards, groups = getShardMap(masterproto.Masters(*masterList, *masterAddr, *masterPort))
+	}
+
 	for i := 0; i < *T; i++ {
+		if shards != nil {
+			orInfos[i] = connectShards(shards, groups, readings)
+			continue
+		}
+
 		log.Println("Connected to node: ", *serverAddr)
 
 		server, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *serverAddr, *serverPort))
@@ -108,11 +147,11 @@ func main() {
 			lReader := bufio.NewReader(leader)
 			lWriter := bufio.NewWriter(leader)
 
-			go simulatedClientWriter(writer, lWriter /* leader writer*/, orInfo, *serverID)
+			go simulatedClientWriter([]*bufio.Writer{writer}, []*bufio.Writer{lWriter} /* leader writer*/, &shard.Map{}, orInfo)
 			go simulatedClientReader(lReader, orInfo, readings, *serverID)
 			go simulatedClientReader(reader, orInfo, readings, *serverID)
 		} else {
-			go simulatedClientWriter(writer, nil /* leader writer*/, orInfo, *serverID)
+			go simulatedClientWriter([]*bufio.Writer{writer}, []*bufio.Writer{writer} /* leader writer*/, &shard.Map{}, orInfo)
 			go simulatedClientReader(reader, orInfo, readings, *serverID)
 		}
 
@@ -125,15 +164,76 @@ func main() {
 	}
 }
 
-func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orInfo *outstandingRequestInfo, serverID int) {
+// Fetch the shard map from the master, once every group registered
+func getShardMap(masters []string) (*shard.Map, []masterproto.Group) {
+	var reply masterproto.GetShardMapReply
+
+	for done := false; !done; {
+		err := masterproto.Call(masters, "Master.GetShardMap", new(masterproto.GetShardMapArgs), &reply)
+		if err == nil && reply.Ready {
+			done = true
+			break
+		}
+		time.Sleep(1e9)
+	}
+
+	shards, err := shard.New(reply.Splits)
+	if err != nil {
+		log.Fatalln("Bad shard map:", err)
+	}
+	return shards, reply.Groups
+}
+
+// Connect a simulated client to replica serverID of every group, and to the leaders for RMWs
+func connectShards(shards *shard.Map, groups []masterproto.Group, readings chan *response) *outstandingRequestInfo {
+	orInfo := &outstandingRequestInfo{
+		sync.Mutex{},
+		semaphore.NewWeighted(*outstandingReqs),
+		make(map[int32]time.Time, *outstandingReqs),
+		make(map[int32]state.Operation, *outstandingReqs)}
+
+	dial := func(addr string) *bufio.Writer {
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatalf("Error connecting to replica %s\n", addr)
+		}
+		log.Println("Connected to node: ", addr)
+		go simulatedClientReader(bufio.NewReader(server), orInfo, readings, *serverID)
+		return bufio.NewWriter(server)
+	}
+
+	writers := make([]*bufio.Writer, len(groups))
+	leaderWriters := make([]*bufio.Writer, len(groups))
+	for s, g := range groups {
+		replica := *serverID % len(g.Replicas)
+		for g.Replicas[replica] == "" {
+			// removed from the group
+			replica = (replica + 1) % len(g.Replicas)
+		}
+		writers[s] = dial(g.Replicas[replica])
+		leaderWriters[s] = writers[s]
+		if replica != g.Leader && *percentRMWs != 0 {
+			leaderWriters[s] = dial(g.Replicas[g.Leader])
+		}
+	}
+	go simulatedClientWriter(writers, leaderWriters, shards, orInfo)
+	return orInfo
+}
+
+// Send commands to the writer of the shard of their keys, RMWs to the leader writer
+func simulatedClientWriter(writers []*bufio.Writer, leaderWriters []*bufio.Writer, shards *shard.Map, orInfo *outstandingRequestInfo) {
 	args := genericsmrproto.Propose{
 		CommandId: 0,
-		Command:   state.Command{Op: state.PUT, K: 0, V: 1},
+		Command:   state.Command{Op: state.PUT, K: "", V: state.IntValue(1), Fn: modifyFn, Arg: modifyArg},
 		Timestamp: 0,
 	} // @audit autodetermine proposal type
 
 	conflictRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	zipf := zipfian.NewZipfianGenerator(*zKeys, *theta)
+	values, err := payload.NewGenerator(*valueDist, *valueSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	poissonGenerator := poisson.NewPoisson(*poissonAvg)
 	opRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -146,13 +246,13 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 		if *conflicts >= 0 {
 			r := conflictRand.Intn(100)
 			if r < *conflicts {
-				args.Command.K = 42
+				args.Command.K = state.IntKey(42)
 			} else {
 				//args.Command.K = state.Key(*startRange + 43 + int(id % 888))
-				args.Command.K = state.Key(int32(*startRange) + 43 + id)
+				args.Command.K = state.IntKey(int64(*startRange) + 43 + int64(id))
 			}
 		} else {
-			args.Command.K = state.Key(zipf.NextNumber())
+			args.Command.K = state.IntKey(int64(zipf.NextNumber()))
 		}
 
 		// Determine operation type
@@ -170,6 +270,12 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 		} else {
 			args.Command.Op = state.GET // read operation
 		}
+		// PUTs write values of the configured sizes, RMWs add 1
+		if args.Command.Op == state.PUT {
+			args.Command.V = values.Next()
+		} else {
+			args.Command.V = state.IntValue(1)
+		}
 
 		if *poissonAvg == -1 { // Poisson disabled
 			orInfo.sema.Acquire(context.Background(), 1)
@@ -188,16 +294,15 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 			}
 		}
 
-		before := time.Now()
-		if args.Command.Op == state.RMW && serverID != 0 { // send RMWs to leader
-			otherWriter.WriteByte(genericsmrproto.PROPOSE)
-			args.Marshal(otherWriter)
-			otherWriter.Flush()
-		} else {
-			writer.WriteByte(genericsmrproto.PROPOSE)
-			args.Marshal(writer)
-			writer.Flush()
+		s := shards.Lookup(args.Command.K)
+		writer := writers[s]
+		if args.Command.Op == state.RMW { // send RMWs to leader
+			writer = leaderWriters[s]
 		}
+		before := time.Now()
+		writer.WriteByte(genericsmrproto.PROPOSE)
+		args.Marshal(writer)
+		writer.Flush()
 
 		orInfo.Lock()
 		orInfo.operation[id] = args.Command.Op
@@ -210,17 +315,25 @@ func simulatedClientReader(reader *bufio.Reader, orInfo *outstandingRequestInfo,
 	var reply genericsmrproto.ProposeReplyTS
 
 	for {
-		if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 {
-			if err != nil {
-				log.Println("Error during unmarshaling:", err)
-			} else if reply.OK == 0 {
-				log.Println("reply.OK is 0")
-			}
-			log.Println(reply.OK)
+		if err := reply.Unmarshal(reader); err != nil {
+			log.Println("Error during unmarshaling:", err)
 			log.Println(reply.CommandId)
 			break
 		}
 
+		if reply.OK == 0 || reply.OK == genericsmrproto.UNKNOWN { // the replica gave up on the request after retrying it
+			if reply.OK == 0 {
+				log.Println("Request failed:", reply.CommandId)
+			} else {
+				log.Println("Request outcome unknown, not retried:", reply.CommandId)
+			}
+			orInfo.sema.Release(1)
+			orInfo.Lock()
+			delete(orInfo.startTimes, reply.CommandId)
+			orInfo.Unlock()
+			continue
+		}
+
 		after := time.Now()
 		orInfo.sema.Release(1)
 
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/payload"
 	"pineapple/src/poisson"
 	"pineapple/src/state"
 	"pineapple/src/zipfian"
@@ -34,6 +35,8 @@ var zKeys = flag.Uint64("z", 1e9, "Number of unique keys in zipfian distribution
 var poissonAvg = flag.Int("poisson", -1, "The average number of microseconds between requests. -1 disables Poisson.")
 var percentWrites = flag.Float64("writes", 1, "A float between 0 and 1 that corresponds to the percentage of requests that should be writes. The remainder will be reads.")
 var percentRMWs = flag.Float64("rmws", 0, "A float between 0 and 1 that corresponds to the percentage of writes that should be RMWs. The remainder will be regular writes.")
+var valueSize = flag.Int("vsize", 8, "Mean size in bytes of the values written by PUTs.")
+var valueDist = flag.String("vdist", payload.FIXED, "Distribution of the value sizes: fixed, uniform (between 1 and twice -vsize) or exponential.")
 var blindWrites = flag.Bool("blindwrites", false, "True if writes don't need to execute before clients receive responses.")
 var singleClusterTest = flag.Bool("singleClusterTest", true, "True if clients run on a VM in a single cluster")
 var rampDown *int = flag.Int("rampDown", 5, "Length of the cool-down period after statistics are measured (in seconds).")
@@ -122,12 +125,16 @@ func main() {
 func simulatedClientWriter(writer *bufio.Writer, lWriter *bufio.Writer, orInfo *outstandingRequestInfo, serverID int) {
 	args := genericsmrproto.Propose{
 		CommandId: 0,
-		Command:   state.Command{Op: state.PUT, K: 0, V: 1},
+		Command:   state.Command{Op: state.PUT, K: "", V: state.IntValue(1)},
 		Timestamp: 0,
 	}
 
 	conflictRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	zipf := zipfian.NewZipfianGenerator(*zKeys, *theta)
+	values, err := payload.NewGenerator(*valueDist, *valueSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	poissonGenerator := poisson.NewPoisson(*poissonAvg)
 	opRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -139,13 +146,13 @@ func simulatedClientWriter(writer *bufio.Writer, lWriter *bufio.Writer, orInfo *
 		if *conflicts >= 0 {
 			r := conflictRand.Intn(100)
 			if r < *conflicts {
-				args.Command.K = 42
+				args.Command.K = state.IntKey(42)
 			} else {
 				//args.Command.K = state.Key(*startRange + 43 + int(id % 888))
-				args.Command.K = state.Key(int32(*startRange) + 43 + id)
+				args.Command.K = state.IntKey(int64(*startRange) + 43 + int64(id))
 			}
 		} else {
-			args.Command.K = state.Key(zipf.NextNumber())
+			args.Command.K = state.IntKey(int64(zipf.NextNumber()))
 		}
 
 		// Determine operation type
@@ -161,6 +168,12 @@ func simulatedClientWriter(writer *bufio.Writer, lWriter *bufio.Writer, orInfo *
 		} else {
 			args.Command.Op = state.GET // read operation
 		}
+		// PUTs write values of the configured sizes, RMWs add 1
+		if args.Command.Op == state.PUT {
+			args.Command.V = values.Next()
+		} else {
+			args.Command.V = state.IntValue(1)
+		}
 
 		// somehow if leader has a read, the throughput is terrible...
 		//if serverID == 0 {
@@ -201,7 +214,7 @@ func simulatedClientReader(reader *bufio.Reader, orInfo *outstandingRequestInfo,
 
 	for {
 		time.Sleep(1 * time.Millisecond)
-		if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 {
+		if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 || reply.OK == genericsmrproto.UNKNOWN {
 			log.Println(reply.OK)
 			log.Println(reply.CommandId)
 			log.Println("Error when reading:", err)
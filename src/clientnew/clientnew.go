@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/payload"
 	"pineapple/src/poisson"
 	"pineapple/src/state"
 	"pineapple/src/zipfian"
@@ -37,6 +38,8 @@ var zKeys = flag.Uint64("z", 1e9, "Number of unique keys in zipfian distribution
 var poissonAvg = flag.Int("poisson", -1, "The average number of microseconds between requests. -1 disables Poisson.")
 var percentWrites = flag.Float64("writes", 1, "A float between 0 and 1 that corresponds to the percentage of requests that should be writes. The remainder will be reads.")
 var percentRMWs = flag.Float64("rmws", 0, "A float between 0 and 1 that corresponds to the percentage of writes that should be RMWs. The remainder will be regular writes.")
+var valueSize = flag.Int("vsize", 8, "Mean size in bytes of the values written by PUTs.")
+var valueDist = flag.String("vdist", payload.FIXED, "Distribution of the value sizes: fixed, uniform (between 1 and twice -vsize) or exponential.")
 var tailAtScale *int = flag.Int("tailAtScale", -1, "Simulate storage request fan-out by performing <tailAtScale> requests and aggregating statistics.")
 var blindWrites = flag.Bool("blindwrites", false, "True if writes don't need to execute before clients receive responses.")
 var singleClusterTest = flag.Bool("singleClusterTest", true, "True if clients run on a VM in a single cluster")
@@ -147,12 +150,16 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 	otherReader *bufio.Reader, orInfo *outstandingRequestInfo, readings chan *response, serverID int) {
 	args := genericsmrproto.Propose{
 		CommandId: 0,
-		Command:   state.Command{Op: state.PUT, K: 0, V: 1},
+		Command:   state.Command{Op: state.PUT, K: "", V: state.IntValue(1)},
 		Timestamp: 0,
 	} // @audit autodetermine proposal type
 
 	conflictRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	zipf := zipfian.NewZipfianGenerator(*zKeys, *theta)
+	values, err := payload.NewGenerator(*valueDist, *valueSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	poissonGenerator := poisson.NewPoisson(*poissonAvg)
 	opRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -173,13 +180,13 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 			if *conflicts >= 0 {
 				r := conflictRand.Intn(100)
 				if r < *conflicts {
-					args.Command.K = 42
+					args.Command.K = state.IntKey(42)
 				} else {
 					//args.Command.K = state.Key(*startRange + 43 + int(id % 888))
-					args.Command.K = state.Key(int32(*startRange) + 43 + id)
+					args.Command.K = state.IntKey(int64(*startRange) + 43 + int64(id))
 				}
 			} else {
-				args.Command.K = state.Key(zipf.NextNumber())
+				args.Command.K = state.IntKey(int64(zipf.NextNumber()))
 			}
 
 			// Determine operation type
@@ -197,6 +204,12 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 			} else {
 				args.Command.Op = state.GET // read operation
 			}
+			// PUTs write values of the configured sizes, RMWs add 1
+			if args.Command.Op == state.PUT {
+				args.Command.V = values.Next()
+			} else {
+				args.Command.V = state.IntValue(1)
+			}
 
 			if *poissonAvg == -1 { // Poisson disabled
 				orInfo.sema.Acquire(context.Background(), 1)
@@ -250,11 +263,13 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 				} else {
 					err = reply.Unmarshal(reader)
 				}
-				if err != nil || reply.OK == 0 {
+				if err != nil || reply.OK == 0 || reply.OK == genericsmrproto.UNKNOWN {
 					if err != nil {
 						log.Println("Error during unmarshaling:", err)
 					} else if reply.OK == 0 {
 						log.Println("reply.OK is 0")
+					} else {
+						log.Println("reply.OK is UNKNOWN")
 					}
 					log.Println(reply.OK)
 					log.Println(reply.CommandId)
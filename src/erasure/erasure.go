@@ -0,0 +1,185 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Systematic k-of-n Reed-Solomon code over GF(2^8).
+// A value is split into k data fragments, followed by n-k parity fragments. Any k fragments rebuild it
+type Code struct {
+	N      int
+	K      int
+	matrix [][]byte // n x k encoding matrix, its first k rows are the identity
+}
+
+var ErrTooFewFragments = errors.New("erasure: too few fragments to decode")
+
+// GF(2^8) arithmetic with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func NewCode(n, k int) (*Code, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, fmt.Errorf("erasure: cannot build a %d-of-%d code", k, n)
+	}
+	// Vandermonde matrix on distinct points, any k of its rows are independent
+	vandermonde := make([][]byte, n)
+	for i := range vandermonde {
+		vandermonde[i] = make([]byte, k)
+		x := byte(1)
+		for j := range vandermonde[i] {
+			vandermonde[i][j] = x
+			x = gfMul(x, byte(i))
+		}
+	}
+	// multiplying by the inverse of its top rows keeps that property and makes the code systematic
+	top, err := invert(vandermonde[:k])
+	if err != nil {
+		return nil, err
+	}
+	return &Code{n, k, multiply(vandermonde, top)}, nil
+}
+
+// Length of each fragment of a value of the given size
+func (c *Code) FragmentSize(size int) int {
+	return (size + c.K - 1) / c.K
+}
+
+// Splits a value into n fragments
+func (c *Code) Encode(value []byte) [][]byte {
+	size := c.FragmentSize(len(value))
+	padded := make([]byte, size*c.K)
+	copy(padded, value)
+
+	fragments := make([][]byte, c.N)
+	for i := range fragments {
+		if i < c.K {
+			fragments[i] = padded[i*size : (i+1)*size]
+			continue
+		}
+		fragments[i] = make([]byte, size)
+		for j := 0; j < c.K; j++ {
+			coef := c.matrix[i][j]
+			for b := 0; b < size; b++ {
+				fragments[i][b] ^= gfMul(coef, padded[j*size+b])
+			}
+		}
+	}
+	return fragments
+}
+
+// Rebuilds a value of the given size from at least k fragments, indexed by their position
+func (c *Code) Decode(fragments map[int][]byte, size int) ([]byte, error) {
+	fsize := c.FragmentSize(size)
+	rows := make([][]byte, 0, c.K)
+	shards := make([][]byte, 0, c.K)
+	for i, fragment := range fragments {
+		if len(rows) == c.K {
+			break
+		}
+		if i < 0 || i >= c.N || len(fragment) != fsize {
+			continue
+		}
+		rows = append(rows, c.matrix[i])
+		shards = append(shards, fragment)
+	}
+	if len(rows) < c.K {
+		return nil, ErrTooFewFragments
+	}
+
+	decode, err := invert(rows)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, fsize*c.K)
+	for i := 0; i < c.K; i++ {
+		for j := 0; j < c.K; j++ {
+			coef := decode[i][j]
+			for b := 0; b < fsize; b++ {
+				value[i*fsize+b] ^= gfMul(coef, shards[j][b])
+			}
+		}
+	}
+	return value[:size], nil
+}
+
+func multiply(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for i := range a {
+		out[i] = make([]byte, len(b[0]))
+		for j := range b[0] {
+			var sum byte
+			for k := range b {
+				sum ^= gfMul(a[i][k], b[k][j])
+			}
+			out[i][j] = sum
+		}
+	}
+	return out
+}
+
+// Gauss-Jordan elimination of a square matrix
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for i := 0; i < n; i++ {
+			if i == col || work[i][col] == 0 {
+				continue
+			}
+			factor := work[i][col]
+			for j := range work[i] {
+				work[i][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+	out := make([][]byte, n)
+	for i := range work {
+		out[i] = work[i][n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,157 @@
+package erasure
+
+import (
+	"bytes"
+	"testing"
+)
+
+var codes = []struct{ n, k int }{
+	{1, 1},
+	{3, 1},
+	{3, 2},
+	{4, 4},
+	{5, 2},
+	{5, 3},
+	{7, 4},
+}
+
+// Values of sizes that are empty, shorter than k, and multiples of k or not
+func testValues() [][]byte {
+	values := [][]byte{{}, {42}}
+	for _, size := range []int{2, 3, 12, 100, 1001} {
+		value := make([]byte, size)
+		for i := range value {
+			value[i] = byte(i*7 + 3)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// Sets of k positions among n, in lexicographic order
+func subsets(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{{}}
+	}
+	var all [][]int
+	for first := 0; first <= n-k; first++ {
+		for _, rest := range subsets(n-first-1, k-1) {
+			subset := []int{first}
+			for _, i := range rest {
+				subset = append(subset, first+1+i)
+			}
+			all = append(all, subset)
+		}
+	}
+	return all
+}
+
+func newTestCode(t *testing.T, n, k int) *Code {
+	code, err := NewCode(n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestNewCode(t *testing.T) {
+	for _, c := range []struct{ n, k int }{{3, 0}, {2, 3}, {256, 2}} {
+		if _, err := NewCode(c.n, c.k); err == nil {
+			t.Errorf("built a %d-of-%d code", c.k, c.n)
+		}
+	}
+}
+
+// The first k fragments hold the value, padded with zeros
+func TestEncodeSystematic(t *testing.T) {
+	for _, c := range codes {
+		code := newTestCode(t, c.n, c.k)
+		for _, value := range testValues() {
+			fragments := code.Encode(value)
+			if len(fragments) != c.n {
+				t.Fatalf("%d-of-%d: %d fragments", c.k, c.n, len(fragments))
+			}
+			size := code.FragmentSize(len(value))
+			padded := make([]byte, size*c.k)
+			copy(padded, value)
+			for i, fragment := range fragments {
+				if len(fragment) != size {
+					t.Fatalf("%d-of-%d, %d bytes: fragment %d has %d bytes, not %d",
+						c.k, c.n, len(value), i, len(fragment), size)
+				}
+				if i < c.k && !bytes.Equal(fragment, padded[i*size:(i+1)*size]) {
+					t.Fatalf("%d-of-%d, %d bytes: data fragment %d is %v", c.k, c.n, len(value), i, fragment)
+				}
+			}
+		}
+	}
+}
+
+// Any k fragments rebuild the value, parity fragments alone included
+func TestDecodeEverySubset(t *testing.T) {
+	for _, c := range codes {
+		code := newTestCode(t, c.n, c.k)
+		for _, value := range testValues() {
+			fragments := code.Encode(value)
+			for _, subset := range subsets(c.n, c.k) {
+				some := make(map[int][]byte, c.k)
+				for _, i := range subset {
+					some[i] = fragments[i]
+				}
+				decoded, err := code.Decode(some, len(value))
+				if err != nil {
+					t.Fatalf("%d-of-%d, %d bytes, fragments %v: %v", c.k, c.n, len(value), subset, err)
+				}
+				if !bytes.Equal(decoded, value) {
+					t.Fatalf("%d-of-%d, %d bytes, fragments %v: decoded %v", c.k, c.n, len(value), subset, decoded)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeParityOnly(t *testing.T) {
+	code := newTestCode(t, 5, 2)
+	value := []byte("parity fragments only")
+	fragments := code.Encode(value)
+	decoded, err := code.Decode(map[int][]byte{3: fragments[3], 4: fragments[4]}, len(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, value) {
+		t.Fatalf("decoded %q", decoded)
+	}
+}
+
+// Fragments of the wrong length or position are skipped, the value is rebuilt if k others remain
+func TestDecodeSkipsBadFragments(t *testing.T) {
+	code := newTestCode(t, 5, 3)
+	value := []byte("some value of 25 bytes...")
+	fragments := code.Encode(value)
+
+	tests := []struct {
+		name      string
+		fragments map[int][]byte
+		ok        bool
+	}{
+		{"short", map[int][]byte{0: fragments[0][1:], 1: fragments[1], 2: fragments[2]}, false},
+		{"long", map[int][]byte{0: fragments[0], 1: append(fragments[1][:len(fragments[1]):len(fragments[1])], 0),
+			4: fragments[4]}, false},
+		{"out of range", map[int][]byte{0: fragments[0], 1: fragments[1], 5: fragments[4]}, false},
+		{"too few", map[int][]byte{2: fragments[2], 3: fragments[3]}, false},
+		{"short among enough", map[int][]byte{0: fragments[0][1:], 1: fragments[1], 2: fragments[2],
+			3: fragments[3]}, true},
+	}
+	for _, test := range tests {
+		decoded, err := code.Decode(test.fragments, len(value))
+		if !test.ok {
+			if err != ErrTooFewFragments {
+				t.Errorf("%s: decoded %q, error %v", test.name, decoded, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(decoded, value) {
+			t.Errorf("%s: decoded %q, error %v", test.name, decoded, err)
+		}
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"pineapple/src/rdtsc"
@@ -18,6 +21,12 @@ import (
 )
 
 const CHAN_BUFFER_SIZE = 200000
+const HEARTBEAT_INTERVAL = 100 * time.Millisecond // between beacons sent to every peer
+const HEARTBEAT_TIMEOUT = 500 * time.Millisecond  // silence after which a peer is considered dead
+const RECONNECT_BACKOFF = 100 * time.Millisecond  // first wait before redialing a lost peer
+const MAX_RECONNECT_BACKOFF = 5 * time.Second
+const MAX_REPLICAS = 32 // replicas a group can grow to, the state kept for each peer is allocated up front
+const MASTER_SHARD = -1 // shard of the replicas holding the state of replicated masters
 
 type RPCPair struct {
 	Obj  fastrpc.Serializable
@@ -29,6 +38,11 @@ type Propose struct {
 	Reply *bufio.Writer
 }
 
+type Scan struct {
+	*genericsmrproto.Scan
+	Reply *bufio.Writer
+}
+
 type Beacon struct {
 	Rid       int32
 	Timestamp uint64
@@ -37,23 +51,27 @@ type Beacon struct {
 type Replica struct {
 	N            int        // total number of replicas
 	Id           int32      // the ID of the current replica
+	Shard        int        // shard held by the replica group
 	PeerAddrList []string   // array with the IP:port address of every replica
 	Peers        []net.Conn // cache of connections to all other replicas
 	PeerReaders  []*bufio.Reader
 	PeerWriters  []*bufio.Writer
-	Alive        []bool // connection status
+	Alive        []atomic.Bool // connection status, updated by the goroutines serving the connections
+	Removed      []bool        // replicas removed from the group, which are no longer connected to
 	Listener     net.Listener
 
 	State *state.State
 
 	ProposeChan chan *Propose // channel for client proposals
+	ScanChan    chan *Scan    // channel for client range scans
 	BeaconChan  chan *Beacon  // channel for beacons from peer replicas
 
 	Shutdown bool
 
-	Exec   bool // execute commands?
-	Dreply bool // reply to client after command has been executed?
-	Beacon bool // send beacons to detect how fast are the other replicas?
+	Thrifty bool // send only as many messages as strictly required?
+	Exec    bool // execute commands?
+	Dreply  bool // reply to client after command has been executed?
+	Beacon  bool // send beacons to detect how fast are the other replicas?
 
 	Durable     bool     // log to a stable store?
 	StableStore *os.File // file support for the persistent log
@@ -63,50 +81,94 @@ type Replica struct {
 	rpcTable map[uint8]*RPCPair
 	rpcCode  uint8
 
-	Ewma []float64
+	Ewma []atomic.Uint64 // round trip time of the beacons of each peer, as math.Float64bits, see PeerRtt
 
 	OnClientConnect chan bool
+
+	clientMutex *sync.Mutex // serializes replies to clients
+
+	peerMutexes []*sync.Mutex // serialize writes to, and replacement of, each peer connection
+	lastHeard   []int64       // when each peer last sent a message (UnixNano)
+
+	// N, Removed and PreferredPeerOrder are only changed by the goroutine running the protocol, which reads
+	// them without locking. The goroutines serving the connections read N and Removed under peersMutex
+	peersMutex *sync.RWMutex
 }
 
-func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica {
+func NewReplica(id int, shard int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, recovering bool) *Replica {
+	// slices indexed by peer have an entry for every replica that can be added later, so that they never
+	// change while the goroutines serving the connections use them
+	n := len(peerAddrList)
+	capacity := MAX_REPLICAS
+	if n > capacity {
+		capacity = n
+	}
+	addrs := make([]string, capacity)
+	copy(addrs, peerAddrList)
 	r := &Replica{
-		len(peerAddrList),
+		n,
 		int32(id),
-		peerAddrList,
-		make([]net.Conn, len(peerAddrList)),
-		make([]*bufio.Reader, len(peerAddrList)),
-		make([]*bufio.Writer, len(peerAddrList)),
-		make([]bool, len(peerAddrList)),
+		shard,
+		addrs,
+		make([]net.Conn, capacity),
+		make([]*bufio.Reader, capacity),
+		make([]*bufio.Writer, capacity),
+		make([]atomic.Bool, capacity),
+		make([]bool, capacity),
 		nil,
 		state.InitState(),
 		make(chan *Propose, CHAN_BUFFER_SIZE),
+		make(chan *Scan, CHAN_BUFFER_SIZE),
 		make(chan *Beacon, CHAN_BUFFER_SIZE),
 		false,
+		thrifty,
 		exec,
 		dreply,
 		false,
-		false,
+		durable,
 		nil,
-		make([]int32, len(peerAddrList)),
+		make([]int32, n),
 		make(map[uint8]*RPCPair),
-		genericsmrproto.GENERIC_SMR_BEACON_REPLY + 1,
-		make([]float64, len(peerAddrList)),
-		make(chan bool, 500000)}
+		genericsmrproto.GENERIC_SMR_PEER_CONNECT + 1,
+		make([]atomic.Uint64, capacity),
+		make(chan bool, 500000),
+		new(sync.Mutex),
+		make([]*sync.Mutex, capacity),
+		make([]int64, capacity),
+		new(sync.RWMutex)}
 
 	var err error
 
-	if r.StableStore, err = os.Create(fmt.Sprintf("stable-store-replica%d", r.Id)); err != nil {
+	// keep the log of the previous run when recovering from it
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if recovering {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	if r.StableStore, err = os.OpenFile(r.FileName("stable-store"), flags, 0644); err != nil {
 		log.Fatal(err)
 	}
 
 	for i := 0; i < r.N; i++ {
 		r.PreferredPeerOrder[i] = int32((int(r.Id) + 1 + i) % r.N)
-		r.Ewma[i] = 0.0
+	}
+	for i := range r.peerMutexes {
+		r.peerMutexes[i] = new(sync.Mutex)
 	}
 
 	return r
 }
 
+// Name of a file of the replica in the current dir. Those of shard 0 keep the names of unsharded runs
+func (r *Replica) FileName(kind string) string {
+	if r.Shard == 0 {
+		return fmt.Sprintf("%s-replica%d", kind, r.Id)
+	}
+	if r.Shard == MASTER_SHARD {
+		return fmt.Sprintf("%s-master%d", kind, r.Id)
+	}
+	return fmt.Sprintf("%s-shard%d-replica%d", kind, r.Shard, r.Id)
+}
+
 /* Client API */
 
 func (r *Replica) Ping(args *genericsmrproto.PingArgs, reply *genericsmrproto.PingReply) error {
@@ -117,17 +179,26 @@ func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *gene
 	return nil
 }
 
+func (r *Replica) StepDown(args *genericsmrproto.StepDownArgs, reply *genericsmrproto.StepDownReply) error {
+	return nil
+}
+
+func (r *Replica) Checkpoint(args *genericsmrproto.CheckpointArgs, reply *genericsmrproto.CheckpointReply) error {
+	return nil
+}
+
 /* ============= */
 
 func (r *Replica) ConnectToPeers() {
-	var b [4]byte
-	bs := b[:4]
 	done := make(chan bool)
 
 	go r.waitForPeerConnections(done)
 
 	//connect to peers
 	for i := 0; i < int(r.Id); i++ {
+		if r.Removed[i] {
+			continue
+		}
 		for done := false; !done; {
 			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
 				r.Peers[i] = conn
@@ -136,35 +207,39 @@ func (r *Replica) ConnectToPeers() {
 				time.Sleep(1e9)
 			}
 		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
+		if err := r.sendPeerId(r.Peers[i]); err != nil {
 			fmt.Println("Write id error:", err)
 			continue
 		}
-		r.Alive[i] = true
+		r.Alive[i].Store(true)
 		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
 		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
 	}
 	<-done
 	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
 
+	now := time.Now().UnixNano()
 	for rid, reader := range r.PeerReaders {
-		if int32(rid) == r.Id {
+		if int32(rid) == r.Id || reader == nil {
 			continue
 		}
-		go r.replicaListener(rid, reader)
+		atomic.StoreInt64(&r.lastHeard[rid], now)
+		go r.replicaListener(rid, r.Peers[rid], reader)
 	}
+
+	go r.heartbeat()
 }
 
 func (r *Replica) ConnectToPeersNoListeners() {
-	var b [4]byte
-	bs := b[:4]
 	done := make(chan bool)
 
 	go r.waitForPeerConnections(done)
 
 	//connect to peers
 	for i := 0; i < int(r.Id); i++ {
+		if r.Removed[i] {
+			continue
+		}
 		for done := false; !done; {
 			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
 				r.Peers[i] = conn
@@ -173,12 +248,11 @@ func (r *Replica) ConnectToPeersNoListeners() {
 				time.Sleep(1e9)
 			}
 		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
+		if err := r.sendPeerId(r.Peers[i]); err != nil {
 			fmt.Println("Write id error:", err)
 			continue
 		}
-		r.Alive[i] = true
+		r.Alive[i].Store(true)
 		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
 		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
 	}
@@ -186,13 +260,67 @@ func (r *Replica) ConnectToPeersNoListeners() {
 	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
 }
 
+// Grows the group with replicas added by a reconfiguration, they connect to this replica as they start
+func (r *Replica) AddPeers(addrs []string) error {
+	n := r.N + len(addrs)
+	if n > len(r.Peers) {
+		return fmt.Errorf("a group has at most %d replicas", len(r.Peers))
+	}
+	// the addresses are written before the peers are counted in N, and never change afterwards
+	copy(r.PeerAddrList[r.N:], addrs)
+
+	// the new peers go after the others, this replica last
+	order := make([]int32, 0, n)
+	for _, q := range r.PreferredPeerOrder {
+		if q != r.Id {
+			order = append(order, q)
+		}
+	}
+	for q := int32(r.N); q < int32(n); q++ {
+		order = append(order, q)
+	}
+	r.PreferredPeerOrder = append(order, r.Id)
+	r.peersMutex.Lock()
+	r.N = n
+	r.peersMutex.Unlock()
+	return nil
+}
+
+// Stops talking to a replica removed from the group
+func (r *Replica) RemovePeer(rid int32) {
+	r.peersMutex.Lock()
+	r.Removed[rid] = true
+	r.peersMutex.Unlock()
+
+	r.peerMutexes[rid].Lock()
+	defer r.peerMutexes[rid].Unlock()
+
+	if r.Peers[rid] != nil {
+		r.Peers[rid].Close()
+	}
+	r.Peers[rid] = nil
+	r.PeerReaders[rid] = nil
+	r.PeerWriters[rid] = nil
+	r.Alive[rid].Store(false)
+}
+
+// Whether a replica is a peer still in the group, for the goroutines serving the connections
+func (r *Replica) isPeer(rid int32) bool {
+	r.peersMutex.RLock()
+	defer r.peersMutex.RUnlock()
+	return rid >= 0 && rid < int32(r.N) && rid != r.Id && !r.Removed[rid]
+}
+
 /* Peer (replica) connections dispatcher */
 func (r *Replica) waitForPeerConnections(done chan bool) {
-	var b [4]byte
-	bs := b[:4]
+	var b [5]byte
+	bs := b[:5]
 
 	r.Listener, _ = net.Listen("tcp", r.PeerAddrList[r.Id])
 	for i := r.Id + 1; i < int32(r.N); i++ {
+		if r.Removed[i] {
+			continue
+		}
 		conn, err := r.Listener.Accept()
 		if err != nil {
 			fmt.Println("Accept error:", err)
@@ -202,16 +330,118 @@ func (r *Replica) waitForPeerConnections(done chan bool) {
 			fmt.Println("Connection establish error:", err)
 			continue
 		}
-		id := int32(binary.LittleEndian.Uint32(bs))
+		if bs[0] != genericsmrproto.GENERIC_SMR_PEER_CONNECT {
+			fmt.Println("Connection establish error: not a peer replica")
+			continue
+		}
+		id := int32(binary.LittleEndian.Uint32(bs[1:]))
 		r.Peers[id] = conn
 		r.PeerReaders[id] = bufio.NewReader(conn)
 		r.PeerWriters[id] = bufio.NewWriter(conn)
-		r.Alive[id] = true
+		r.Alive[id].Store(true)
 	}
 
 	done <- true
 }
 
+// Identifies this replica to a peer it dialed
+func (r *Replica) sendPeerId(conn net.Conn) error {
+	var b [5]byte
+	bs := b[:5]
+	bs[0] = genericsmrproto.GENERIC_SMR_PEER_CONNECT
+	binary.LittleEndian.PutUint32(bs[1:], uint32(r.Id))
+	_, err := conn.Write(bs)
+	return err
+}
+
+// Replaces the connection to a peer, closing the previous one if it is still open.
+// Connections from removed replicas are closed
+func (r *Replica) installPeer(rid int32, conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) bool {
+	if rid < 0 || int(rid) >= len(r.peerMutexes) {
+		conn.Close()
+		return false
+	}
+	r.peerMutexes[rid].Lock()
+	defer r.peerMutexes[rid].Unlock()
+
+	// checked under the lock of the connection, which a removal takes after marking the peer removed
+	if !r.isPeer(rid) {
+		conn.Close()
+		return false
+	}
+
+	if r.Peers[rid] != nil {
+		r.Peers[rid].Close()
+	}
+	r.Peers[rid] = conn
+	r.PeerReaders[rid] = reader
+	r.PeerWriters[rid] = writer
+	atomic.StoreInt64(&r.lastHeard[rid], time.Now().UnixNano())
+	r.Alive[rid].Store(true)
+	log.Printf("Replica %d connected to peer %d\n", r.Id, rid)
+	return true
+}
+
+// Called when the connection to a peer fails. The replica with the higher id redials,
+// the other one waits for the peer to connect again
+func (r *Replica) peerDown(rid int32, conn net.Conn) {
+	r.peerMutexes[rid].Lock()
+	if r.Peers[rid] != conn { // already replaced by a new connection
+		r.peerMutexes[rid].Unlock()
+		return
+	}
+	conn.Close()
+	r.Peers[rid] = nil
+	r.PeerReaders[rid] = nil
+	r.PeerWriters[rid] = nil
+	r.Alive[rid].Store(false)
+	r.peerMutexes[rid].Unlock()
+
+	log.Printf("Replica %d lost connection to peer %d\n", r.Id, rid)
+	if rid < r.Id && r.isPeer(rid) {
+		go r.reconnect(rid)
+	}
+}
+
+// Redials a lost peer, backing off exponentially while it stays unreachable
+func (r *Replica) reconnect(rid int32) {
+	backoff := RECONNECT_BACKOFF
+	for !r.Shutdown && r.isPeer(rid) {
+		if conn, err := net.Dial("tcp", r.PeerAddrList[rid]); err == nil {
+			if err = r.sendPeerId(conn); err == nil {
+				reader := bufio.NewReader(conn)
+				if r.installPeer(rid, conn, reader, bufio.NewWriter(conn)) {
+					go r.replicaListener(int(rid), conn, reader)
+				}
+				return
+			}
+			conn.Close()
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MAX_RECONNECT_BACKOFF {
+			backoff = MAX_RECONNECT_BACKOFF
+		}
+	}
+}
+
+// Sends a beacon to every connected peer and marks dead the peers that stopped sending anything
+func (r *Replica) heartbeat() {
+	for !r.Shutdown {
+		time.Sleep(HEARTBEAT_INTERVAL)
+		now := time.Now().UnixNano()
+		for q := int32(0); q < int32(len(r.Peers)); q++ {
+			if !r.isPeer(q) {
+				continue
+			}
+			r.SendBeacon(q)
+			if r.Alive[q].Load() && now-atomic.LoadInt64(&r.lastHeard[q]) > int64(HEARTBEAT_TIMEOUT) {
+				r.Alive[q].Store(false)
+				log.Printf("Replica %d suspects peer %d\n", r.Id, q)
+			}
+		}
+	}
+}
+
 /* Client connections dispatcher */
 func (r *Replica) WaitForClientConnections() {
 	for !r.Shutdown {
@@ -226,7 +456,7 @@ func (r *Replica) WaitForClientConnections() {
 	}
 }
 
-func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
+func (r *Replica) replicaListener(rid int, conn net.Conn, reader *bufio.Reader) {
 	var msgType uint8
 	var err error = nil
 	var gbeacon genericsmrproto.Beacon
@@ -237,6 +467,11 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 		if msgType, err = reader.ReadByte(); err != nil {
 			break
 		}
+		// any message shows the peer is alive
+		atomic.StoreInt64(&r.lastHeard[rid], time.Now().UnixNano())
+		if !r.Alive[rid].Load() {
+			r.Alive[rid].Store(true)
+		}
 
 		switch uint8(msgType) {
 
@@ -244,6 +479,9 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 			if err = gbeacon.Unmarshal(reader); err != nil {
 				break
 			}
+			if !r.Beacon { // only a heartbeat
+				break
+			}
 			beacon := &Beacon{int32(rid), gbeacon.Timestamp}
 			r.BeaconChan <- beacon
 			break
@@ -252,9 +490,11 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 			if err = gbeaconReply.Unmarshal(reader); err != nil {
 				break
 			}
-			//TODO: UPDATE STUFF
-			r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(rdtsc.Cputicks()-gbeaconReply.Timestamp)
-			log.Println("Ewma: ", r.Ewma)
+			rtt := float64(rdtsc.Cputicks() - gbeaconReply.Timestamp)
+			if ewma := r.PeerRtt(int32(rid)); ewma != 0.0 { // not the first sample
+				rtt = 0.99*ewma + 0.01*rtt
+			}
+			r.Ewma[rid].Store(math.Float64bits(rtt))
 			break
 
 		default:
@@ -269,6 +509,10 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 			}
 		}
 	}
+
+	if !r.Shutdown {
+		r.peerDown(int32(rid), conn)
+	}
 }
 
 // Puts commands / proposal received from client into the channels.
@@ -294,6 +538,14 @@ func (r *Replica) clientListener(conn net.Conn) {
 			r.ProposeChan <- &Propose{prop, writer}
 			break
 
+		case genericsmrproto.SCAN:
+			scan := new(genericsmrproto.Scan)
+			if err = scan.Unmarshal(reader); err != nil {
+				break
+			}
+			r.ScanChan <- &Scan{scan, writer}
+			break
+
 		case genericsmrproto.READ:
 			read := new(genericsmrproto.Read)
 			if err = read.Unmarshal(reader); err != nil {
@@ -309,6 +561,19 @@ func (r *Replica) clientListener(conn net.Conn) {
 			}
 			//r.ProposeAndReadChan <- pr
 			break
+
+		case genericsmrproto.GENERIC_SMR_PEER_CONNECT:
+			// a peer replica reconnecting, or starting again after a failure
+			var b [4]byte
+			bs := b[:4]
+			if _, err = io.ReadFull(reader, bs); err != nil {
+				break
+			}
+			rid := int32(binary.LittleEndian.Uint32(bs))
+			if r.installPeer(rid, conn, reader, writer) {
+				r.replicaListener(int(rid), conn, reader)
+			}
+			return
 		}
 	}
 	if err != nil && err != io.EOF {
@@ -323,15 +588,31 @@ func (r *Replica) RegisterRPC(msgObj fastrpc.Serializable, notify chan fastrpc.S
 	return code
 }
 
+// Messages to a peer with no open connection are dropped
 func (r *Replica) SendMsg(peerId int32, code uint8, msg fastrpc.Serializable) {
+	r.peerMutexes[peerId].Lock()
+	defer r.peerMutexes[peerId].Unlock()
+
 	w := r.PeerWriters[peerId]
+	if w == nil {
+		return
+	}
 	w.WriteByte(code)
 	msg.Marshal(w)
-	w.Flush()
+	if err := w.Flush(); err != nil {
+		// the listener of the connection fails as well and handles the loss
+		r.Peers[peerId].Close()
+	}
 }
 
 func (r *Replica) SendMsgNoFlush(peerId int32, code uint8, msg fastrpc.Serializable) {
+	r.peerMutexes[peerId].Lock()
+	defer r.peerMutexes[peerId].Unlock()
+
 	w := r.PeerWriters[peerId]
+	if w == nil {
+		return
+	}
 	w.WriteByte(code)
 	msg.Marshal(w)
 }
@@ -345,29 +626,55 @@ func (r *Replica) ReplyPropose(reply *genericsmrproto.ProposeReply, w *bufio.Wri
 }
 
 func (r *Replica) ReplyProposeTS(reply *genericsmrproto.ProposeReplyTS, w *bufio.Writer) {
-	//r.clientMutex.Lock()
-	//defer r.clientMutex.Unlock()
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
 	//w.WriteByte(genericsmrproto.PROPOSE_REPLY)
 	reply.Marshal(w)
 	w.Flush()
 }
 
+func (r *Replica) ReplyScan(reply *genericsmrproto.ScanReply, w *bufio.Writer) {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	reply.Marshal(w)
+	w.Flush()
+}
+
 func (r *Replica) SendBeacon(peerId int32) {
+	r.peerMutexes[peerId].Lock()
+	defer r.peerMutexes[peerId].Unlock()
+
 	w := r.PeerWriters[peerId]
+	if w == nil {
+		return
+	}
 	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON)
 	beacon := &genericsmrproto.Beacon{rdtsc.Cputicks()}
 	beacon.Marshal(w)
-	w.Flush()
+	if err := w.Flush(); err != nil {
+		r.Peers[peerId].Close()
+	}
 }
 
 func (r *Replica) ReplyBeacon(beacon *Beacon) {
+	r.peerMutexes[beacon.Rid].Lock()
+	defer r.peerMutexes[beacon.Rid].Unlock()
+
 	w := r.PeerWriters[beacon.Rid]
+	if w == nil {
+		return
+	}
 	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON_REPLY)
 	rb := &genericsmrproto.BeaconReply{beacon.Timestamp}
 	rb.Marshal(w)
 	w.Flush()
 }
 
+// Average round trip time of the beacons of a peer, in ticks, 0 if it never answered one
+func (r *Replica) PeerRtt(q int32) float64 {
+	return math.Float64frombits(r.Ewma[q].Load())
+}
+
 // updates the preferred order in which to communicate with peers according to a preferred quorum
 func (r *Replica) UpdatePreferredPeerOrder(quorum []int32) {
 	aux := make([]int32, r.N)
@@ -13,6 +13,8 @@ const (
 	PROPOSE_AND_READ_REPLY
 	GENERIC_SMR_BEACON
 	GENERIC_SMR_BEACON_REPLY
+	GENERIC_SMR_PEER_CONNECT // first byte of a connection opened by a peer replica, followed by its id
+	SCAN                     // range scan, answered by a stream of ScanReply messages
 )
 
 type Propose struct {
@@ -28,8 +30,45 @@ type ProposeReply struct {
 
 type ProposeReplyTS struct {
 	OK        uint8
+	Found     uint8 // FALSE if a GET found no value, the key was never written or was deleted
 	CommandId int32
 	Value     state.Value
+	OldValue  state.Value // value read by an RMW before it was modified
+	TagTS     int64       // tag of the value read or written
+	TagID     int32
+	Timestamp int64
+}
+
+// ProposeReplyTS.OK of a command the replica gave up on although it may still take effect, such as an RMW
+// that a later leader can commit. Clients do not retry such a command, it could be applied twice
+const UNKNOWN uint8 = 2
+
+// Scan of the keys from Start (included) to End (excluded, no bound if empty).
+// Replies are not tagged with their type, so a client waits for the last ScanReply before sending
+// other commands on the same connection
+type Scan struct {
+	CommandId int32
+	Start     state.Key
+	End       state.Key
+	Limit     int32 // most entries returned
+	Quorum    uint8 // compare the tags of each key across a read quorum, rather than read one replica
+	Timestamp int64
+}
+
+type ScanEntry struct {
+	Key   state.Key
+	Value state.Value
+	TagTS int64
+	TagID int32
+}
+
+// Part of the entries found by a scan, in key order
+type ScanReply struct {
+	OK        uint8
+	CommandId int32
+	Last      uint8 // last reply of the scan
+	More      uint8 // set on the last reply if there may be entries after those returned, scan again from there
+	Entries   []ScanEntry
 	Timestamp int64
 }
 
@@ -72,8 +111,25 @@ type PingArgs struct {
 type PingReply struct {
 }
 
+// Makes a replica the RMW leader of its group. Leader epochs are assigned by the master, increasing with each
+// failover, and replicas refuse the Paxos messages of leaders from older epochs
 type BeTheLeaderArgs struct {
+	LeaderEpoch int32
 }
 
 type BeTheLeaderReply struct {
 }
+
+// Tells a replica that another one leads from the epoch on, a leader of an older epoch steps down
+type StepDownArgs struct {
+	LeaderEpoch int32
+}
+
+type StepDownReply struct {
+}
+
+type CheckpointArgs struct {
+}
+
+type CheckpointReply struct {
+}
@@ -1,10 +1,17 @@
 package genericsmrproto
 
 import (
+	"bufio"
+	"encoding/binary"
 	"io"
 	"sync"
 )
 
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
 func (t *Propose) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -70,7 +77,9 @@ func (t *Propose) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Command.Unmarshal(wire)
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
 	bs = b[:8]
 	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
@@ -192,7 +201,7 @@ func (t *PingArgs) Unmarshal(wire io.Reader) error {
 }
 
 func (t *BeTheLeaderArgs) BinarySize() (nbytes int, sizeKnown bool) {
-	return 0, true
+	return 4, true
 }
 
 type BeTheLeaderArgsCache struct {
@@ -225,9 +234,25 @@ func (p *BeTheLeaderArgsCache) Put(t *BeTheLeaderArgs) {
 	p.mu.Unlock()
 }
 func (t *BeTheLeaderArgs) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.LeaderEpoch
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
 }
 
 func (t *BeTheLeaderArgs) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderEpoch = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	return nil
 }
 
@@ -286,8 +311,12 @@ func (t *ProposeAndRead) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Command.Unmarshal(wire)
-	t.Key.Unmarshal(wire)
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -345,7 +374,9 @@ func (t *Read) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Key.Unmarshal(wire)
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -503,7 +534,9 @@ func (t *ReadReply) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Value.Unmarshal(wire)
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -563,7 +596,9 @@ func (t *ProposeAndReadReply) Unmarshal(wire io.Reader) error {
 	}
 	t.OK = uint8(bs[0])
 	t.CommandId = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
-	t.Value.Unmarshal(wire)
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -699,17 +734,368 @@ func (p *ProposeReplyTSCache) Put(t *ProposeReplyTS) {
 	p.mu.Unlock()
 }
 func (t *ProposeReplyTS) Marshal(wire io.Writer) {
-	var b [8]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:5]
+	bs = b[:6]
+	bs[0] = byte(t.OK)
+	bs[1] = byte(t.Found)
+	tmp32 := t.CommandId
+	bs[2] = byte(tmp32)
+	bs[3] = byte(tmp32 >> 8)
+	bs[4] = byte(tmp32 >> 16)
+	bs[5] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Value.Marshal(wire)
+	t.OldValue.Marshal(wire)
+	bs = b[:20]
+	tmp64 := t.TagTS
+	bs[0] = byte(tmp64)
+	bs[1] = byte(tmp64 >> 8)
+	bs[2] = byte(tmp64 >> 16)
+	bs[3] = byte(tmp64 >> 24)
+	bs[4] = byte(tmp64 >> 32)
+	bs[5] = byte(tmp64 >> 40)
+	bs[6] = byte(tmp64 >> 48)
+	bs[7] = byte(tmp64 >> 56)
+	tmp32 = t.TagID
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	tmp64 = t.Timestamp
+	bs[12] = byte(tmp64)
+	bs[13] = byte(tmp64 >> 8)
+	bs[14] = byte(tmp64 >> 16)
+	bs[15] = byte(tmp64 >> 24)
+	bs[16] = byte(tmp64 >> 32)
+	bs[17] = byte(tmp64 >> 40)
+	bs[18] = byte(tmp64 >> 48)
+	bs[19] = byte(tmp64 >> 56)
+	wire.Write(bs)
+}
+
+func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
+	var b [20]byte
+	var bs []byte
+	bs = b[:6]
+	if _, err := io.ReadAtLeast(wire, bs, 6); err != nil {
+		return err
+	}
+	t.OK = uint8(bs[0])
+	t.Found = uint8(bs[1])
+	t.CommandId = int32((uint32(bs[2]) | (uint32(bs[3]) << 8) | (uint32(bs[4]) << 16) | (uint32(bs[5]) << 24)))
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.OldValue.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.TagTS = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.TagID = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.Timestamp = int64((uint64(bs[12]) | (uint64(bs[13]) << 8) | (uint64(bs[14]) << 16) | (uint64(bs[15]) << 24) | (uint64(bs[16]) << 32) | (uint64(bs[17]) << 40) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 56)))
+	return nil
+}
+
+func (t *CheckpointArgs) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, true
+}
+
+type CheckpointArgsCache struct {
+	mu    sync.Mutex
+	cache []*CheckpointArgs
+}
+
+func NewCheckpointArgsCache() *CheckpointArgsCache {
+	c := &CheckpointArgsCache{}
+	c.cache = make([]*CheckpointArgs, 0)
+	return c
+}
+
+func (p *CheckpointArgsCache) Get() *CheckpointArgs {
+	var t *CheckpointArgs
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CheckpointArgs{}
+	}
+	return t
+}
+func (p *CheckpointArgsCache) Put(t *CheckpointArgs) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CheckpointArgs) Marshal(wire io.Writer) {
+}
+
+func (t *CheckpointArgs) Unmarshal(wire io.Reader) error {
+	return nil
+}
+
+func (t *CheckpointReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, true
+}
+
+type CheckpointReplyCache struct {
+	mu    sync.Mutex
+	cache []*CheckpointReply
+}
+
+func NewCheckpointReplyCache() *CheckpointReplyCache {
+	c := &CheckpointReplyCache{}
+	c.cache = make([]*CheckpointReply, 0)
+	return c
+}
+
+func (p *CheckpointReplyCache) Get() *CheckpointReply {
+	var t *CheckpointReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CheckpointReply{}
+	}
+	return t
+}
+func (p *CheckpointReplyCache) Put(t *CheckpointReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CheckpointReply) Marshal(wire io.Writer) {
+}
+
+func (t *CheckpointReply) Unmarshal(wire io.Reader) error {
+	return nil
+}
+
+func (t *Scan) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanCache struct {
+	mu    sync.Mutex
+	cache []*Scan
+}
+
+func NewScanCache() *ScanCache {
+	c := &ScanCache{}
+	c.cache = make([]*Scan, 0)
+	return c
+}
+
+func (p *ScanCache) Get() *Scan {
+	var t *Scan
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Scan{}
+	}
+	return t
+}
+func (p *ScanCache) Put(t *Scan) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Scan) Marshal(wire io.Writer) {
+	var b [13]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.CommandId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Start.Marshal(wire)
+	t.End.Marshal(wire)
+	bs = b[:13]
+	tmp32 = t.Limit
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	bs[4] = byte(t.Quorum)
+	tmp64 := t.Timestamp
+	bs[5] = byte(tmp64)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64 >> 16)
+	bs[8] = byte(tmp64 >> 24)
+	bs[9] = byte(tmp64 >> 32)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 48)
+	bs[12] = byte(tmp64 >> 56)
+	wire.Write(bs)
+}
+
+func (t *Scan) Unmarshal(wire io.Reader) error {
+	var b [13]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	if err := t.Start.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.End.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.Limit = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Quorum = uint8(bs[4])
+	t.Timestamp = int64((uint64(bs[5]) | (uint64(bs[6]) << 8) | (uint64(bs[7]) << 16) | (uint64(bs[8]) << 24) | (uint64(bs[9]) << 32) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 48) | (uint64(bs[12]) << 56)))
+	return nil
+}
+
+func (t *ScanEntry) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanEntryCache struct {
+	mu    sync.Mutex
+	cache []*ScanEntry
+}
+
+func NewScanEntryCache() *ScanEntryCache {
+	c := &ScanEntryCache{}
+	c.cache = make([]*ScanEntry, 0)
+	return c
+}
+
+func (p *ScanEntryCache) Get() *ScanEntry {
+	var t *ScanEntry
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanEntry{}
+	}
+	return t
+}
+func (p *ScanEntryCache) Put(t *ScanEntry) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanEntry) Marshal(wire io.Writer) {
+	var b [12]byte
+	var bs []byte
+	t.Key.Marshal(wire)
+	t.Value.Marshal(wire)
+	bs = b[:12]
+	tmp64 := t.TagTS
+	bs[0] = byte(tmp64)
+	bs[1] = byte(tmp64 >> 8)
+	bs[2] = byte(tmp64 >> 16)
+	bs[3] = byte(tmp64 >> 24)
+	bs[4] = byte(tmp64 >> 32)
+	bs[5] = byte(tmp64 >> 40)
+	bs[6] = byte(tmp64 >> 48)
+	bs[7] = byte(tmp64 >> 56)
+	tmp32 := t.TagID
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *ScanEntry) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	var bs []byte
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.TagTS = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.TagID = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	return nil
+}
+
+func (t *ScanReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanReplyCache struct {
+	mu    sync.Mutex
+	cache []*ScanReply
+}
+
+func NewScanReplyCache() *ScanReplyCache {
+	c := &ScanReplyCache{}
+	c.cache = make([]*ScanReply, 0)
+	return c
+}
+
+func (p *ScanReplyCache) Get() *ScanReply {
+	var t *ScanReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanReply{}
+	}
+	return t
+}
+func (p *ScanReplyCache) Put(t *ScanReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanReply) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:7]
 	bs[0] = byte(t.OK)
 	tmp32 := t.CommandId
 	bs[1] = byte(tmp32)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32 >> 16)
 	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(t.Last)
+	bs[6] = byte(t.More)
 	wire.Write(bs)
-	t.Value.Marshal(wire)
+	bs = b[:]
+	alen1 := int64(len(t.Entries))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Entries[i].Marshal(wire)
+	}
 	bs = b[:8]
 	tmp64 := t.Timestamp
 	bs[0] = byte(tmp64)
@@ -723,16 +1109,32 @@ func (t *ProposeReplyTS) Marshal(wire io.Writer) {
 	wire.Write(bs)
 }
 
-func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
-	var b [8]byte
+func (t *ScanReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
 	var bs []byte
-	bs = b[:5]
-	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
+	bs = b[:7]
+	if _, err := io.ReadAtLeast(wire, bs, 7); err != nil {
 		return err
 	}
 	t.OK = uint8(bs[0])
 	t.CommandId = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
-	t.Value.Unmarshal(wire)
+	t.Last = uint8(bs[5])
+	t.More = uint8(bs[6])
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]ScanEntry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Entries[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
 	bs = b[:8]
 	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
@@ -740,3 +1142,99 @@ func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
 	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
 	return nil
 }
+
+func (t *StepDownArgs) BinarySize() (nbytes int, sizeKnown bool) {
+	return 4, true
+}
+
+type StepDownArgsCache struct {
+	mu    sync.Mutex
+	cache []*StepDownArgs
+}
+
+func NewStepDownArgsCache() *StepDownArgsCache {
+	c := &StepDownArgsCache{}
+	c.cache = make([]*StepDownArgs, 0)
+	return c
+}
+
+func (p *StepDownArgsCache) Get() *StepDownArgs {
+	var t *StepDownArgs
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &StepDownArgs{}
+	}
+	return t
+}
+func (p *StepDownArgsCache) Put(t *StepDownArgs) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *StepDownArgs) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.LeaderEpoch
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *StepDownArgs) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderEpoch = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	return nil
+}
+
+func (t *StepDownReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, true
+}
+
+type StepDownReplyCache struct {
+	mu    sync.Mutex
+	cache []*StepDownReply
+}
+
+func NewStepDownReplyCache() *StepDownReplyCache {
+	c := &StepDownReplyCache{}
+	c.cache = make([]*StepDownReply, 0)
+	return c
+}
+
+func (p *StepDownReplyCache) Get() *StepDownReply {
+	var t *StepDownReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &StepDownReply{}
+	}
+	return t
+}
+func (p *StepDownReplyCache) Put(t *StepDownReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *StepDownReply) Marshal(wire io.Writer) {
+}
+
+func (t *StepDownReply) Unmarshal(wire io.Reader) error {
+	return nil
+}
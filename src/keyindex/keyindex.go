@@ -0,0 +1,106 @@
+package keyindex
+
+import (
+	"math/rand"
+
+	"pineapple/src/state"
+)
+
+const MAX_LEVEL = 24 // enough for 4^24 keys
+const P = 4          // a node reaches the next level with probability 1/P
+
+// Ordered set of keys, kept in a skip list, for range scans.
+// Keys are ordered byte-wise. Not safe for concurrent use
+type Index struct {
+	head   *node
+	level  int // levels in use
+	length int
+	random *rand.Rand
+}
+
+type node struct {
+	key  state.Key
+	next []*node // successor at each level of the node
+}
+
+func New() *Index {
+	return &Index{&node{next: make([]*node, MAX_LEVEL)}, 1, 0, rand.New(rand.NewSource(1))}
+}
+
+func (ix *Index) Len() int {
+	return ix.length
+}
+
+// Fills update with the last node before the key at each level, returns the first node not before it
+func (ix *Index) seek(key state.Key, update []*node) *node {
+	x := ix.head
+	for l := ix.level - 1; l >= 0; l-- {
+		for x.next[l] != nil && x.next[l].key < key {
+			x = x.next[l]
+		}
+		if update != nil {
+			update[l] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (ix *Index) randomLevel() int {
+	level := 1
+	for level < MAX_LEVEL && ix.random.Intn(P) == 0 {
+		level++
+	}
+	return level
+}
+
+// Adds a key, returns false if it was already there
+func (ix *Index) Insert(key state.Key) bool {
+	var update [MAX_LEVEL]*node
+	if x := ix.seek(key, update[:]); x != nil && x.key == key {
+		return false
+	}
+	level := ix.randomLevel()
+	for l := ix.level; l < level; l++ {
+		update[l] = ix.head
+	}
+	if level > ix.level {
+		ix.level = level
+	}
+	x := &node{key, make([]*node, level)}
+	for l := 0; l < level; l++ {
+		x.next[l] = update[l].next[l]
+		update[l].next[l] = x
+	}
+	ix.length++
+	return true
+}
+
+// Removes a key, returns false if it was not there
+func (ix *Index) Delete(key state.Key) bool {
+	var update [MAX_LEVEL]*node
+	x := ix.seek(key, update[:])
+	if x == nil || x.key != key {
+		return false
+	}
+	for l := 0; l < len(x.next); l++ {
+		update[l].next[l] = x.next[l]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.length--
+	return true
+}
+
+// Calls visit on the keys from start (included) to end (excluded) in order, until it returns false.
+// There is no upper bound if end is empty
+func (ix *Index) Range(start state.Key, end state.Key, visit func(state.Key) bool) {
+	for x := ix.seek(start, nil); x != nil; x = x.next[0] {
+		if end != "" && x.key >= end {
+			return
+		}
+		if !visit(x.key) {
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package keyindex
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+// Keys visited by Range, at most limit of them if limit is positive
+func scan(ix *Index, start state.Key, end state.Key, limit int) []state.Key {
+	keys := make([]state.Key, 0)
+	ix.Range(start, end, func(key state.Key) bool {
+		keys = append(keys, key)
+		return limit <= 0 || len(keys) < limit
+	})
+	return keys
+}
+
+func keysOf(strs ...string) []state.Key {
+	keys := make([]state.Key, len(strs))
+	for i, s := range strs {
+		keys[i] = state.Key(s)
+	}
+	return keys
+}
+
+func TestInsertDelete(t *testing.T) {
+	ix := New()
+	if !ix.Insert("b") || !ix.Insert("a") || ix.Insert("b") {
+		t.Fatal("inserted a key twice, or not at all")
+	}
+	if ix.Len() != 2 {
+		t.Fatalf("%d keys, not 2", ix.Len())
+	}
+	if ix.Delete("c") || !ix.Delete("a") || ix.Delete("a") {
+		t.Fatal("deleted a missing key, or not a present one")
+	}
+	if ix.Len() != 1 {
+		t.Fatalf("%d keys, not 1", ix.Len())
+	}
+	if keys := scan(ix, "", "", 0); !reflect.DeepEqual(keys, keysOf("b")) {
+		t.Fatalf("holds %v", keys)
+	}
+	ix.Delete("b")
+	if keys := scan(ix, "", "", 0); ix.Len() != 0 || len(keys) != 0 || ix.level != 1 {
+		t.Fatalf("emptied index holds %v, %d keys, %d levels", keys, ix.Len(), ix.level)
+	}
+}
+
+// Random inserts and deletes keep the keys byte-wise ordered, as a sorted set would
+func TestRandomOperations(t *testing.T) {
+	ix := New()
+	set := make(map[state.Key]bool)
+	random := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		key := state.Key(strconv.Itoa(random.Intn(2000)))
+		if random.Intn(3) == 0 {
+			if ix.Delete(key) != set[key] {
+				t.Fatalf("delete %s: present %v", key, set[key])
+			}
+			delete(set, key)
+		} else {
+			if ix.Insert(key) == set[key] {
+				t.Fatalf("insert %s: present %v", key, set[key])
+			}
+			set[key] = true
+		}
+	}
+
+	want := make([]state.Key, 0, len(set))
+	for key := range set {
+		want = append(want, key)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if ix.Len() != len(want) {
+		t.Fatalf("%d keys, not %d", ix.Len(), len(want))
+	}
+	if keys := scan(ix, "", "", 0); !reflect.DeepEqual(keys, want) {
+		t.Fatal("keys out of order or missing")
+	}
+	// every level is ordered too
+	for l := 0; l < ix.level; l++ {
+		for x := ix.head.next[l]; x != nil && x.next[l] != nil; x = x.next[l] {
+			if x.key >= x.next[l].key {
+				t.Fatalf("level %d: %s before %s", l, x.key, x.next[l].key)
+			}
+		}
+	}
+}
+
+// The start is included, the end excluded, an empty end is unbounded, and the scan stops when visit says so
+func TestRange(t *testing.T) {
+	ix := New()
+	for _, key := range keysOf("b", "d", "a", "e", "c", "aa") {
+		ix.Insert(key)
+	}
+
+	tests := []struct {
+		start, end state.Key
+		limit      int
+		want       []state.Key
+	}{
+		{"", "", 0, keysOf("a", "aa", "b", "c", "d", "e")},
+		{"b", "d", 0, keysOf("b", "c")},
+		{"a", "b", 0, keysOf("a", "aa")},
+		{"ab", "cc", 0, keysOf("b", "c")},
+		{"c", "", 0, keysOf("c", "d", "e")},
+		{"", "a", 0, keysOf()},
+		{"c", "c", 0, keysOf()},
+		{"d", "b", 0, keysOf()},
+		{"f", "", 0, keysOf()},
+		{"", "", 2, keysOf("a", "aa")},
+		{"b", "", 1, keysOf("b")},
+		{"b", "e", 5, keysOf("b", "c", "d")},
+	}
+	for _, test := range tests {
+		if keys := scan(ix, test.start, test.end, test.limit); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("[%q, %q) limit %d: %v, not %v", test.start, test.end, test.limit, keys, test.want)
+		}
+	}
+}
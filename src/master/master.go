@@ -1,69 +1,169 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"strings"
 	"sync"
 	"time"
 
+	"pineapple/src/genericsmr"
 	"pineapple/src/genericsmrproto"
 	"pineapple/src/masterproto"
+	"pineapple/src/pineapple"
+	"pineapple/src/shard"
+	"pineapple/src/state"
 )
 
 var masterAddr *string = flag.String("maddr", "10.10.1.1", "Master address. Defaults to 10.10.1.1.")
 var masterPort *int = flag.Int("mport", 7087, "Master port.  Defaults to 7087.")
-var numNodes *int = flag.Int("N", 3, "Number of replicas. Defaults to 3.")
+var numNodes *int = flag.Int("N", 3, "Number of replicas of each group. Defaults to 3.")
+var numShards *int = flag.Int("shards", 1, "Number of shards, each held by a group of N replicas. Defaults to 1.")
+var splitKeys *string = flag.String("splits", "", "Comma-separated keys splitting the key space into the shards, ordered byte-wise. Defaults to splitting evenly the keys 0 to -keys minus 1, written in decimal as by the benchmark clients.")
+var numKeys *int64 = flag.Int64("keys", 1e9, "Number of keys split evenly into the shards if -splits is not given, as -z of the zipfian clients. The keys of the clients' sequential workloads fall in a narrow range, possibly all in one shard, give -splits for them. Defaults to 1e9.")
+var masterList *string = flag.String("masters", "", "Comma-separated addr:port of the masters replicating their state, one of them acting at a time. The master listens on its own entry, instead of -maddr and -mport. Defaults to a single master.")
+var masterId *int = flag.Int("id", 0, "Index of this master in -masters.")
+
+const REPLICA_TIMEOUT = 1 * time.Second // a replica that is stuck or cut off may never answer a call
 
 type Master struct {
-	N        int
-	nodeList []string
-	addrList []string
-	portList []int
-	lock     *sync.Mutex
-	nodes    []*rpc.Client
-	leader   []bool
-	alive    []bool
+	N      int
+	shards *shard.Map
+	groups []*group
+	lock   *sync.Mutex // guards the state, released while a change is written (see commit)
+	update *sync.Mutex // serializes the changes of the state, held until they are written
+
+	// Replicated state (see replicated.go), unused with a single master
+	id      int
+	masters []string
+	replica *pineapple.Replica
+	store   *stateClient
+	current bool        // this master acts, the others refuse requests
+	term    int64       // of the current master
+	version int64       // writes of the state in the term
+	written state.Value // state last written or read, under the update lock
+}
+
+// Replicas of the group holding a shard
+type group struct {
+	groupState
+	nodes []*rpc.Client
+	lock  *sync.Mutex // of the master, released while the replicas are called (see call)
+}
+
+// Part of a group replicated across the masters
+type groupState struct {
+	NodeList []string
+	AddrList []string
+	PortList []int
+	Leader   []bool
+	Alive    []bool
+
+	LeaderEpoch int32 // incremented by each failover, replicas refuse the leaders of older epochs
+	Elected     bool  // the replicas elect their leader and report it (see SetLeader), the master does not fail over
+
+	// Membership, changed one replica at a time (see reconfigure)
+	Started  bool                        // the master connected to the replicas
+	Config   masterproto.ReconfigureArgs // configuration at the latest epoch
+	Acked    []int32                     // latest epoch each replica switched to
+	Joining  int                         // replica being added, -1 if none
+	CaughtUp bool                        // it copied the state of the group
 }
 
 func main() {
 	flag.Parse()
 
-	log.Printf("Master starting on port %d\n", *masterPort)
-	log.Printf("...waiting for %d replicas\n", *numNodes)
+	shards, err := shard.Parse(*splitKeys, *numShards, *numKeys)
+	if err != nil {
+		log.Fatal("Bad shard splits: ", err)
+	}
+
+	listenAddr := fmt.Sprintf("%s:%d", *masterAddr, *masterPort)
+	var masters []string
+	if *masterList != "" {
+		masters = strings.Split(*masterList, ",")
+		if *masterId < 0 || *masterId >= len(masters) {
+			log.Fatalf("No master %d among %d\n", *masterId, len(masters))
+		}
+		listenAddr = masters[*masterId]
+	}
+
+	log.Printf("Master starting on %s\n", listenAddr)
+	log.Printf("...waiting for %d replicas in each of %d groups\n", *numNodes, shards.Shards())
 
 	master := &Master{*numNodes,
-		make([]string, 0, *numNodes),
-		make([]string, 0, *numNodes),
-		make([]int, 0, *numNodes),
+		shards,
+		make([]*group, shards.Shards()),
+		new(sync.Mutex),
 		new(sync.Mutex),
-		make([]*rpc.Client, *numNodes),
-		make([]bool, *numNodes),
-		make([]bool, *numNodes)}
 
-	log.Printf("creating master connected to %d nodes\n", master.N)
+		*masterId,
+		masters,
+		nil,
+		nil,
+		masters == nil,
+		0,
+		0,
+		nil}
+	for s := range master.groups {
+		master.groups[s] = &group{groupState{make([]string, 0, *numNodes),
+			make([]string, 0, *numNodes),
+			make([]int, 0, *numNodes),
+			make([]bool, *numNodes),
+			make([]bool, *numNodes),
+
+			0,
+			false,
+
+			false,
+			masterproto.ReconfigureArgs{},
+			make([]int32, *numNodes),
+			-1,
+			false},
+			make([]*rpc.Client, *numNodes),
+			master.lock}
+		start, end := shards.Range(s)
+		log.Printf("shard %d holds keys [%q, %q)\n", s, start, end)
+	}
+
+	log.Printf("creating master connected to %d nodes\n", master.N*len(master.groups))
 
 	rpc.Register(master)
 	log.Printf("registered master \n")
 	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *masterAddr, *masterPort))
+	l, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatal("Master listen error:", err)
 	}
 
+	if masters != nil {
+		master.startReplica()
+	}
+
 	log.Printf("running master \n")
 	go master.run()
 
 	http.Serve(l, nil)
 }
 
+func (master *Master) ready() bool {
+	for _, g := range master.groups {
+		if len(g.NodeList) < master.N {
+			return false
+		}
+	}
+	return true
+}
+
 func (master *Master) run() {
 	for true {
 		master.lock.Lock()
-		if len(master.nodeList) == master.N {
+		if master.current && master.ready() {
 			master.lock.Unlock()
 			break
 		}
@@ -73,61 +173,393 @@ func (master *Master) run() {
 	time.Sleep(2000000000)
 
 	// connect to SMR servers
-	for i := 0; i < master.N; i++ {
-		var err error
-		addr := fmt.Sprintf("%s:%d", master.addrList[i], master.portList[i]+1000)
-		master.nodes[i], err = rpc.DialHTTP("tcp", addr)
-		if err != nil {
-			log.Fatalf("Error connecting to replica %d\n", i)
+	master.update.Lock()
+	master.lock.Lock()
+	for s, g := range master.groups {
+		if g.Started {
+			// by a previous master, connected to on the next ping
+			continue
+		}
+		for i := 0; i < master.N; i++ {
+			var err error
+			addr := fmt.Sprintf("%s:%d", g.AddrList[i], g.PortList[i]+1000)
+			g.nodes[i], err = rpc.DialHTTP("tcp", addr)
+			if err != nil {
+				log.Fatalf("Error connecting to replica %d of shard %d\n", i, s)
+			}
+			g.Leader[i] = false
 		}
-		master.leader[i] = false
+		g.Leader[0] = true
+		g.Started = true
 	}
-	master.leader[0] = true
+	master.commit()
+	master.lock.Unlock()
+	master.update.Unlock()
 
+	// the replicas are called with the lock released, so that the state is still read during a pass
 	for true {
 		time.Sleep(3000 * 1000 * 1000)
-		new_leader := false
-		for i, node := range master.nodes {
-			err := node.Call("Replica.Ping", new(genericsmrproto.PingArgs), new(genericsmrproto.PingReply))
-			if err != nil {
-				log.Printf("Replica %d has failed to reply\n", i)
-				master.alive[i] = false
-				if master.leader[i] {
-					// need to choose a new leader
-					new_leader = true
-					master.leader[i] = false
-				}
-			} else {
-				master.alive[i] = true
+		master.update.Lock()
+		master.lock.Lock()
+		if master.current {
+			for s, g := range master.groups {
+				g.checkLeader(s)
+				g.reconfigure(s)
 			}
+			master.commit()
 		}
-		if !new_leader {
+		master.lock.Unlock()
+		master.update.Unlock()
+	}
+}
+
+// Ping the replicas of the group, and choose a new leader if the current one failed or left the group.
+// Called with both locks held, the changes are made once the replicas answered
+func (g *group) checkLeader(s int) {
+	alive := make([]bool, len(g.nodes))
+	for i := range g.nodes {
+		if !g.inGroup(i) {
+			continue
+		}
+		err := g.call(i, "Replica.Ping", new(genericsmrproto.PingArgs), new(genericsmrproto.PingReply))
+		if err != nil {
+			log.Printf("Replica %d of shard %d has failed to reply\n", i, s)
+			if g.nodes[i] != nil {
+				// dialed again at the next ping, the connection may be stuck
+				g.nodes[i].Close()
+				g.nodes[i] = nil
+			}
 			continue
 		}
-		for i, new_master := range master.nodes {
-			if master.alive[i] {
-				err := new_master.Call("Replica.BeTheLeader", new(genericsmrproto.BeTheLeaderArgs), new(genericsmrproto.BeTheLeaderReply))
+		alive[i] = true
+		if !g.Alive[i] && !g.Leader[i] && !g.Elected {
+			// back after the master lost it, it may still lead in an older epoch
+			g.stepDown(i, s)
+		}
+	}
+
+	new_leader := false
+	for i, l := range g.Leader {
+		if l && !(alive[i] && g.canLead(i)) {
+			new_leader = true
+		}
+	}
+	leader := -1
+	epoch := g.LeaderEpoch
+	if new_leader && !g.Elected {
+		epoch++
+		for i := range g.nodes {
+			if alive[i] && g.canLead(i) {
+				err := g.call(i, "Replica.BeTheLeader",
+					&genericsmrproto.BeTheLeaderArgs{LeaderEpoch: epoch}, new(genericsmrproto.BeTheLeaderReply))
 				if err == nil {
-					master.leader[i] = true
-					log.Printf("Replica %d is the new leader.", i)
+					leader = i
+					log.Printf("Replica %d of shard %d is the new leader, in epoch %d.", i, s, epoch)
 					break
 				}
 			}
 		}
 	}
+
+	copy(g.Alive, alive)
+	if new_leader {
+		for i := range g.Leader {
+			g.Leader[i] = i == leader
+		}
+	}
+	g.LeaderEpoch = epoch
+	if !new_leader || g.Elected {
+		return
+	}
+	// the previous leader may only have been unreachable from the master, and still act
+	for i := range g.nodes {
+		if i != leader && g.Alive[i] {
+			g.stepDown(i, s)
+		}
+	}
+}
+
+// Tell a replica the current leader epoch, it steps down if it led in an older one
+func (g *group) stepDown(i int, s int) {
+	err := g.call(i, "Replica.StepDown", &genericsmrproto.StepDownArgs{LeaderEpoch: g.LeaderEpoch},
+		new(genericsmrproto.StepDownReply))
+	if err != nil {
+		log.Printf("Replica %d of shard %d has failed to step down: %v\n", i, s, err)
+	}
+}
+
+// Call a method of replica i of the group, connecting to it first if needed. Called with both locks held:
+// the lock is released during the call, so that the state is still read, while the update lock keeps it
+// from changing
+func (g *group) call(i int, method string, args interface{}, reply interface{}) error {
+	g.lock.Unlock()
+	defer g.lock.Lock()
+	if g.nodes[i] == nil {
+		// added by a reconfiguration, or connected to by a previous master
+		node, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", g.AddrList[i], g.PortList[i]+1000))
+		if err != nil {
+			return err
+		}
+		g.nodes[i] = node
+	}
+	return callReplica(g.nodes[i], method, args, reply)
+}
+
+func callReplica(node *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := node.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(REPLICA_TIMEOUT):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+// Is the replica a member, or an old member while switching configurations
+func (g *group) inGroup(i int) bool {
+	return g.Config.Members[i] || (g.Config.Old != nil && g.Config.Old[i])
+}
+
+// Only replicas that stay members and hold the state of the group lead it
+func (g *group) canLead(i int) bool {
+	return g.Config.Members[i] && (g.Config.Old == nil || g.Config.Old[i])
+}
+
+// Addresses of the replicas, by id, empty for those that are not members
+func (g *group) replicaList() []string {
+	list := make([]string, len(g.NodeList))
+	for i, ap := range g.NodeList {
+		if g.Config.Members[i] {
+			list[i] = ap
+		}
+	}
+	return list
+}
+
+// Start switching the group to a configuration, in which quorums are formed among both the current members
+// and the members given. The added replica, if any, joins the group. The configuration is sent to the replicas
+// once it is committed (see pushJoint)
+func (g *group) startReconfiguration(s int, members []bool, joining int) {
+	old := g.Config.Members
+	g.Config = masterproto.ReconfigureArgs{
+		Epoch:    g.Config.Epoch + 1,
+		NodeList: append([]string(nil), g.NodeList...),
+		Members:  members,
+		Old:      append([]bool(nil), old...)}
+	g.Config.Old = append(g.Config.Old, make([]bool, len(members)-len(old))...)
+	g.Joining = joining
+	g.CaughtUp = joining < 0
+	log.Printf("Shard %d switching to epoch %d, members %v, old members %v\n",
+		s, g.Config.Epoch, g.Config.Members, g.Config.Old)
+}
+
+// Send the joint configuration to the live old members, before the added replica connects to them
+func (g *group) pushJoint(s int) {
+	for i := range g.nodes {
+		if g.Config.Old[i] && g.Alive[i] {
+			g.push(s, i)
+		}
+	}
+}
+
+// Send the configuration to a replica
+func (g *group) push(s int, i int) {
+	var reply masterproto.ReconfigureReply
+	if err := g.call(i, "Replica.Reconfigure", &g.Config, &reply); err != nil {
+		log.Printf("Replica %d of shard %d did not switch to epoch %d: %v\n", i, s, g.Config.Epoch, err)
+		return
+	}
+	g.Acked[i] = reply.Epoch
+	if i == g.Joining && reply.Epoch == g.Config.Epoch {
+		g.CaughtUp = reply.CaughtUp
+	}
+}
+
+// Send the configuration to the replicas of the group that have not switched to it, and end the switch once
+// every live replica did and the added replica caught up. Any majorities of the members of two epochs intersect,
+// since they differ by one replica
+func (g *group) reconfigure(s int) {
+	if !g.Started {
+		return
+	}
+	for i := range g.nodes {
+		if g.inGroup(i) && g.Alive[i] && (g.Acked[i] < g.Config.Epoch || (i == g.Joining && !g.CaughtUp)) {
+			g.push(s, i)
+		}
+	}
+	if g.Config.Old == nil || !g.CaughtUp {
+		return
+	}
+	for i := range g.nodes {
+		if g.inGroup(i) && g.Alive[i] && g.Acked[i] < g.Config.Epoch {
+			return
+		}
+	}
+
+	joint := g.Config
+	g.Config = masterproto.ReconfigureArgs{
+		Epoch:    joint.Epoch + 1,
+		NodeList: joint.NodeList,
+		Members:  joint.Members,
+		Old:      nil}
+	g.Joining = -1
+	log.Printf("Shard %d switched to epoch %d, members %v\n", s, g.Config.Epoch, g.Config.Members)
+	for i := range g.nodes {
+		// the removed replica learns it left the group
+		if (joint.Members[i] || joint.Old[i]) && g.Alive[i] {
+			g.push(s, i)
+		}
+	}
+}
+
+// Add a replica to the group of a shard. Quorums include it once it copied the state of the group
+func (master *Master) AddReplica(args *masterproto.AddReplicaArgs, reply *masterproto.AddReplicaReply) error {
+	master.update.Lock()
+	defer master.update.Unlock()
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+	addrPort := fmt.Sprintf("%s:%d", args.Addr, args.Port)
+	if g.Joining >= 0 && g.NodeList[g.Joining] == addrPort {
+		// asked again
+		reply.ReplicaId = g.Joining
+		reply.Config = g.Config
+		return nil
+	}
+	if !g.Started {
+		return fmt.Errorf("the group of shard %d is not running yet", args.Shard)
+	}
+	if g.Config.Old != nil {
+		return fmt.Errorf("the group of shard %d is already being reconfigured", args.Shard)
+	}
+	for _, ap := range g.NodeList {
+		if ap == addrPort {
+			return fmt.Errorf("%s already was a replica of shard %d", addrPort, args.Shard)
+		}
+	}
+	if len(g.NodeList) == genericsmr.MAX_REPLICAS {
+		return fmt.Errorf("the group of shard %d had %d replicas", args.Shard, genericsmr.MAX_REPLICAS)
+	}
+
+	id := len(g.NodeList)
+	g.NodeList = append(g.NodeList, addrPort)
+	g.AddrList = append(g.AddrList, args.Addr)
+	g.PortList = append(g.PortList, args.Port)
+	g.nodes = append(g.nodes, nil)
+	g.Leader = append(g.Leader, false)
+	g.Alive = append(g.Alive, false)
+	g.Acked = append(g.Acked, 0)
+	members := append(append([]bool(nil), g.Config.Members...), true)
+	log.Printf("Adding %s to shard %d as replica %d\n", addrPort, args.Shard, id)
+	g.startReconfiguration(args.Shard, members, id)
+	if err := master.commit(); err != nil {
+		return err
+	}
+	g.pushJoint(args.Shard)
+
+	reply.ReplicaId = id
+	reply.Config = g.Config
+	return nil
+}
+
+// Remove a replica from the group of a shard
+func (master *Master) RemoveReplica(args *masterproto.RemoveReplicaArgs, reply *masterproto.RemoveReplicaReply) error {
+	master.update.Lock()
+	defer master.update.Unlock()
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+	if !g.Started {
+		return fmt.Errorf("the group of shard %d is not running yet", args.Shard)
+	}
+	if g.Config.Old != nil {
+		return fmt.Errorf("the group of shard %d is already being reconfigured", args.Shard)
+	}
+	if args.ReplicaId < 0 || args.ReplicaId >= len(g.NodeList) || !g.Config.Members[args.ReplicaId] {
+		return fmt.Errorf("replica %d is not a member of shard %d", args.ReplicaId, args.Shard)
+	}
+	members := append([]bool(nil), g.Config.Members...)
+	members[args.ReplicaId] = false
+	for i, member := range members {
+		if member && !g.Alive[i] {
+			// the group could lose its majority
+			return fmt.Errorf("replica %d of shard %d is down", i, args.Shard)
+		}
+	}
+	if countMembers(members) == 0 {
+		return fmt.Errorf("replica %d is the last member of shard %d", args.ReplicaId, args.Shard)
+	}
+	log.Printf("Removing replica %d from shard %d\n", args.ReplicaId, args.Shard)
+	g.startReconfiguration(args.Shard, members, -1)
+	if err := master.commit(); err != nil {
+		return err
+	}
+	g.pushJoint(args.Shard)
+
+	reply.Epoch = g.Config.Epoch
+	return nil
+}
+
+func countMembers(members []bool) int {
+	count := 0
+	for _, member := range members {
+		if member {
+			count++
+		}
+	}
+	return count
+}
+
+func (master *Master) groupOf(s int) (*group, error) {
+	if s < 0 || s >= len(master.groups) {
+		return nil, fmt.Errorf("no shard %d, there are %d", s, len(master.groups))
+	}
+	return master.groups[s], nil
 }
 
 func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterproto.RegisterReply) error {
 
+	master.update.Lock()
+	defer master.update.Unlock()
 	master.lock.Lock()
 	defer master.lock.Unlock()
 
-	nlen := len(master.nodeList)
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+
+	if args.Elect && !g.Elected {
+		g.Elected = true
+		log.Printf("The replicas of shard %d elect their leader\n", args.Shard)
+	}
+
+	nlen := len(g.NodeList)
 	index := nlen
 
 	addrPort := fmt.Sprintf("%s:%d", args.Addr, args.Port)
 
-	for i, ap := range master.nodeList {
+	for i, ap := range g.NodeList {
 		if addrPort == ap {
 			index = i
 			break
@@ -135,19 +567,29 @@ func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterprot
 	}
 
 	if index == nlen {
-		master.nodeList = master.nodeList[0 : nlen+1]
-		master.nodeList[nlen] = addrPort
-		master.addrList = master.addrList[0 : nlen+1]
-		master.addrList[nlen] = args.Addr
-		master.portList = master.portList[0 : nlen+1]
-		master.portList[nlen] = args.Port
+		if nlen >= master.N {
+			return fmt.Errorf("the group of shard %d already has %d replicas", args.Shard, master.N)
+		}
+		g.NodeList = append(g.NodeList, addrPort)
+		g.AddrList = append(g.AddrList, args.Addr)
+		g.PortList = append(g.PortList, args.Port)
 		nlen++
+		if nlen == master.N {
+			g.Config = masterproto.ReconfigureArgs{Epoch: 0, NodeList: append([]string(nil), g.NodeList...), Members: make([]bool, nlen)}
+			for i := range g.Config.Members {
+				g.Config.Members[i] = true
+			}
+		}
+		if err := master.commit(); err != nil {
+			return err
+		}
 	}
 
-	if nlen == master.N {
+	if nlen >= master.N {
 		reply.Ready = true
 		reply.ReplicaId = index
-		reply.NodeList = master.nodeList
+		reply.NodeList = g.NodeList
+		reply.Config = g.Config
 	} else {
 		reply.Ready = false
 	}
@@ -157,7 +599,18 @@ func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterprot
 
 func (master *Master) GetLeader(args *masterproto.GetLeaderArgs, reply *masterproto.GetLeaderReply) error {
 	time.Sleep(4 * 1000 * 1000)
-	for i, l := range master.leader {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+	for i, l := range g.Leader {
 		if l {
 			*reply = masterproto.GetLeaderReply{i}
 			break
@@ -166,15 +619,83 @@ func (master *Master) GetLeader(args *masterproto.GetLeaderArgs, reply *masterpr
 	return nil
 }
 
+// Called by the leader elected by the replicas of a group
+func (master *Master) SetLeader(args *masterproto.SetLeaderArgs, reply *masterproto.SetLeaderReply) error {
+	master.update.Lock()
+	defer master.update.Unlock()
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+	if !g.Elected {
+		return fmt.Errorf("the master appoints the leader of shard %d", args.Shard)
+	}
+	if args.ReplicaId < 0 || args.ReplicaId >= len(g.Leader) {
+		return fmt.Errorf("shard %d has no replica %d", args.Shard, args.ReplicaId)
+	}
+	if args.LeaderEpoch < g.LeaderEpoch {
+		// reported late, after a newer leader
+		return nil
+	}
+	g.LeaderEpoch = args.LeaderEpoch
+	for i := range g.Leader {
+		g.Leader[i] = i == args.ReplicaId
+	}
+	log.Printf("Replica %d of shard %d was elected leader, in epoch %d.", args.ReplicaId, args.Shard, args.LeaderEpoch)
+	return master.commit()
+}
+
 func (master *Master) GetReplicaList(args *masterproto.GetReplicaListArgs, reply *masterproto.GetReplicaListReply) error {
 	master.lock.Lock()
 	defer master.lock.Unlock()
 
-	if len(master.nodeList) == master.N {
-		reply.ReplicaList = master.nodeList
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	g, err := master.groupOf(args.Shard)
+	if err != nil {
+		return err
+	}
+	if len(g.NodeList) >= master.N {
+		reply.ReplicaList = g.replicaList()
 		reply.Ready = true
 	} else {
 		reply.Ready = false
 	}
 	return nil
 }
+
+func (master *Master) GetShardMap(args *masterproto.GetShardMapArgs, reply *masterproto.GetShardMapReply) error {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+
+	if !master.ready() {
+		reply.Ready = false
+		return nil
+	}
+	reply.Splits = master.shards.Splits
+	reply.Groups = make([]masterproto.Group, len(master.groups))
+	for s, g := range master.groups {
+		reply.Groups[s] = masterproto.Group{Replicas: g.replicaList()}
+		for i, l := range g.Leader {
+			if l {
+				reply.Groups[s].Leader = i
+				break
+			}
+		}
+	}
+	reply.Ready = true
+	return nil
+}
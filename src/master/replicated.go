@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/masterproto"
+	"pineapple/src/pineapple"
+	"pineapple/src/state"
+)
+
+const REPLICA_PORT_OFFSET = 100 // the replica of a master listens on the master port plus this
+const RENEW_INTERVAL = 1 * time.Second
+const MASTER_TIMEOUT = 3 * time.Second // without renewals, after which another master takes over
+const STATE_KEY state.Key = "master"
+
+// Replicated masters.
+// Every master runs a pineapple replica, in a group formed by the masters, and their state is kept under a
+// single key of the group. The current master writes it after every change, and at least every RENEW_INTERVAL,
+// with a compare-and-swap RMW from the value it wrote last: the write fails if another master wrote since,
+// and the master then stops acting. The other masters read the key, and once it has not changed for
+// MASTER_TIMEOUT, take over: each makes its replica the RMW leader and swaps in the state with a higher term,
+// only one of the swaps succeeds. A replica copies the state of the others when it starts, since the masters
+// keep nothing on disk
+
+// State of the masters, as replicated
+type masterState struct {
+	Term    int64 // incremented by each takeover
+	Current int   // master acting in the term
+	Version int64 // incremented by each write in the term, renewals included
+	Groups  []groupState
+}
+
+func (master *Master) startReplica() {
+	peers := make([]string, len(master.masters))
+	for i, addr := range master.masters {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Fatal("Bad master address: ", err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			log.Fatal("Bad master port: ", err)
+		}
+		peers[i] = fmt.Sprintf("%s:%d", host, p+REPLICA_PORT_OFFSET)
+	}
+
+	// the replica joins the group, so that it copies the state of the other masters before voting
+	master.replica = pineapple.NewReplica(&pineapple.Config{
+		Id:           master.id,
+		Shard:        genericsmr.MASTER_SHARD,
+		PeerAddrList: peers,
+		Dreply:       true,
+		Timeout:      100 * time.Millisecond,
+		MaxRetries:   5,
+		QuorumMode:   pineapple.QUORUM_COUNT,
+		CodedGC:      1,
+		Joining:      true})
+	master.store = &stateClient{addr: peers[master.id]}
+	go master.watch()
+}
+
+// Renew the term of this master while it acts, otherwise take over once the current master stops renewing it
+func (master *Master) watch() {
+	lastChange := time.Now()
+	for true {
+		time.Sleep(RENEW_INTERVAL)
+		master.update.Lock()
+		master.lock.Lock()
+		if master.current {
+			master.commit()
+		} else if changed, err := master.readState(); err != nil {
+			log.Printf("Master %d could not read the state of the masters: %v\n", master.id, err)
+		} else {
+			if changed {
+				lastChange = time.Now()
+			}
+			// master 0 starts acting, unless another master already does
+			if (master.written == nil && master.id == 0) || time.Since(lastChange) >= MASTER_TIMEOUT {
+				master.takeOver()
+			}
+		}
+		master.lock.Unlock()
+		master.update.Unlock()
+	}
+}
+
+// Act from the state read last, in a new term. Called with both locks held
+func (master *Master) takeOver() {
+	st := &masterState{}
+	if master.written != nil {
+		if err := gob.NewDecoder(bytes.NewReader(master.written)).Decode(st); err != nil {
+			log.Printf("Master %d could not decode the state of the masters: %v\n", master.id, err)
+			return
+		}
+		if len(st.Groups) != len(master.groups) {
+			log.Fatalf("The masters have %d shards, not %d\n", len(st.Groups), len(master.groups))
+		}
+		for s, g := range master.groups {
+			for _, node := range g.nodes {
+				if node != nil {
+					node.Close()
+				}
+			}
+			g.groupState = st.Groups[s]
+			g.nodes = make([]*rpc.Client, len(g.NodeList))
+		}
+	}
+
+	// the RMW leader of the group of masters commits the swap, it is queued until the leader prepared.
+	// Terms serve as its leader epochs
+	master.replica.BeTheLeader(&genericsmrproto.BeTheLeaderArgs{LeaderEpoch: int32(st.Term + 1)},
+		new(genericsmrproto.BeTheLeaderReply))
+	master.current = true
+	master.term = st.Term + 1
+	master.version = 0
+	if err := master.commit(); err != nil {
+		return
+	}
+	log.Printf("Master %d is the current master, in term %d\n", master.id, master.term)
+}
+
+// Write the state of this master, if it acts. It stops acting if another master wrote the state since.
+// Called with both locks held. The lock is released during the write, so that the state is still read
+// meanwhile, while the update lock keeps it from changing
+func (master *Master) commit() error {
+	if master.masters == nil {
+		return nil
+	}
+	if !master.current {
+		return errors.New(masterproto.NOT_CURRENT)
+	}
+	master.version++
+	st := &masterState{master.term, master.id, master.version, make([]groupState, len(master.groups))}
+	for s, g := range master.groups {
+		st.Groups[s] = g.groupState
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		log.Fatal("Could not encode the state of the masters: ", err)
+	}
+
+	term := master.term
+	master.lock.Unlock()
+	err := master.writeState(buf.Bytes())
+	master.lock.Lock()
+	if err == nil && (!master.current || master.term != term) {
+		err = errors.New(masterproto.NOT_CURRENT)
+	}
+	if err != nil {
+		log.Printf("Master %d stops acting: %v\n", master.id, err)
+		master.current = false
+	}
+	return err
+}
+
+// Read the replicated state, and whether it changed since the last read or write
+func (master *Master) readState() (bool, error) {
+	reply, err := master.store.call(state.Command{Op: state.GET, K: STATE_KEY})
+	if err != nil {
+		return false, err
+	}
+	changed := !bytes.Equal(reply.Value, master.written)
+	master.written = reply.Value
+	return changed, nil
+}
+
+// Swap the state last read or written for the value
+func (master *Master) writeState(value state.Value) error {
+	reply, err := master.store.call(state.Command{Op: state.RMW, K: STATE_KEY, V: value,
+		Fn: state.COMPARE_AND_SWAP, Arg: master.written})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reply.OldValue, master.written) {
+		master.written = reply.OldValue
+		return fmt.Errorf("another master wrote the state")
+	}
+	master.written = value
+	return nil
+}
+
+// Connection to the replica of this master, sending it one command at a time as a client does
+type stateClient struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	crtId  int32
+}
+
+func (c *stateClient) call(cmd state.Command) (*genericsmrproto.ProposeReplyTS, error) {
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+		c.writer = bufio.NewWriter(conn)
+	}
+
+	c.crtId++
+	propose := &genericsmrproto.Propose{CommandId: c.crtId, Command: cmd, Timestamp: time.Now().UnixNano()}
+	c.writer.WriteByte(genericsmrproto.PROPOSE)
+	propose.Marshal(c.writer)
+	if err := c.writer.Flush(); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(MASTER_TIMEOUT))
+	for {
+		reply := new(genericsmrproto.ProposeReplyTS)
+		if err := reply.Unmarshal(c.reader); err != nil {
+			// the deadline may have cut a reply, the next ones could not be read
+			c.close()
+			return nil, err
+		}
+		if reply.CommandId != c.crtId {
+			continue
+		}
+		if reply.OK == 0 {
+			return nil, fmt.Errorf("the replica of the master refused command %d", reply.CommandId)
+		}
+		if reply.OK == genericsmrproto.UNKNOWN {
+			// the state is read again before the next write
+			return nil, fmt.Errorf("the outcome of command %d is unknown", reply.CommandId)
+		}
+		return reply, nil
+	}
+}
+
+func (c *stateClient) close() {
+	c.conn.Close()
+	c.conn = nil
+}
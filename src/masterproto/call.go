@@ -0,0 +1,64 @@
+package masterproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// Error of the masters that do not act, when the masters are replicated
+const NOT_CURRENT = "not the current master"
+
+// A master that is stuck or cut off may never answer a call. Changes of the state wait for the master to ping
+// the replicas, so this leaves it time to
+const CALL_TIMEOUT = 10 * time.Second
+
+// Masters given by a comma-separated list of addr:port, or the single master at addr:port
+func Masters(list string, addr string, port int) []string {
+	if list == "" {
+		return []string{fmt.Sprintf("%s:%d", addr, port)}
+	}
+	return strings.Split(list, ",")
+}
+
+// Calls a method of the current master, trying the masters in turn. Each gets CALL_TIMEOUT to answer
+func Call(masters []string, method string, args interface{}, reply interface{}) error {
+	err := fmt.Errorf("no master")
+	for _, addr := range masters {
+		var mcli *rpc.Client
+		if mcli, err = dial(addr); err != nil {
+			continue
+		}
+		err = mcli.Call(method, args, reply)
+		mcli.Close()
+		if _, answered := err.(rpc.ServerError); err == nil || (answered && err.Error() != NOT_CURRENT) {
+			return err
+		}
+	}
+	return err
+}
+
+// Connects to a master as rpc.DialHTTP does, the connection fails once CALL_TIMEOUT elapsed
+func dial(addr string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, CALL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
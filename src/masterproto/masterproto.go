@@ -1,27 +1,95 @@
 package masterproto
 
+import "pineapple/src/state"
+
 type RegisterArgs struct {
-	Addr string
-	Port int
+	Addr  string
+	Port  int
+	Shard int  // shard whose replica group the server joins
+	Elect bool // the replicas of the group elect their leader, the master does not appoint it
 }
 
 type RegisterReply struct {
 	ReplicaId int
 	NodeList  []string
 	Ready     bool
+	Config    ReconfigureArgs // current configuration of the group
 }
 
 type GetLeaderArgs struct {
+	Shard int
 }
 
 type GetLeaderReply struct {
 	LeaderId int
 }
 
+// Reported by the leader the replicas of a group elected, so that the master tells the clients
+type SetLeaderArgs struct {
+	Shard       int
+	ReplicaId   int
+	LeaderEpoch int32
+}
+
+type SetLeaderReply struct {
+}
+
 type GetReplicaListArgs struct {
+	Shard int
 }
 
 type GetReplicaListReply struct {
 	ReplicaList []string
 	Ready       bool
 }
+
+type GetShardMapArgs struct {
+}
+
+// Replica group holding a shard
+type Group struct {
+	Replicas []string // addresses, by replica id in the group, empty for the replicas removed from it
+	Leader   int
+}
+
+// Key ranges of the shards (see shard.Map) and the groups holding them, by shard
+type GetShardMapReply struct {
+	Splits []state.Key
+	Groups []Group
+	Ready  bool
+}
+
+// Configuration of a replica group at an epoch, sent by the master to the replicas of the group.
+// While switching from the previous epoch, quorums must be formed among both the members and the old members
+type ReconfigureArgs struct {
+	Epoch    int32
+	NodeList []string // addresses by replica id, removed replicas included
+	Members  []bool   // replicas counted in quorums, by id
+	Old      []bool   // members of the previous epoch while switching from it, nil otherwise
+}
+
+type ReconfigureReply struct {
+	Epoch    int32 // epoch the replica switched to
+	CaughtUp bool  // the replica holds the state of the group, and counts in its quorums if it is a member
+}
+
+// Adds a replica to the group of a shard. It copies the state of the group before counting in its quorums
+type AddReplicaArgs struct {
+	Addr  string
+	Port  int
+	Shard int
+}
+
+type AddReplicaReply struct {
+	ReplicaId int
+	Config    ReconfigureArgs
+}
+
+type RemoveReplicaArgs struct {
+	Shard     int
+	ReplicaId int
+}
+
+type RemoveReplicaReply struct {
+	Epoch int32 // epoch of the configuration without the replica
+}
@@ -171,7 +171,9 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -263,7 +265,9 @@ func (t *Accept) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -422,7 +426,9 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
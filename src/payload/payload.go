@@ -0,0 +1,59 @@
+package payload
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"pineapple/src/state"
+)
+
+// Distributions of the value sizes
+const (
+	FIXED       = "fixed"       // every value has the given size
+	UNIFORM     = "uniform"     // sizes drawn uniformly between 1 and twice the given size
+	EXPONENTIAL = "exponential" // sizes drawn exponentially around the given size
+)
+
+// Generates random values whose sizes follow a distribution, for benchmarks
+type Generator struct {
+	dist   string
+	size   int // mean size in bytes
+	random *rand.Rand
+}
+
+func NewGenerator(dist string, size int) (*Generator, error) {
+	switch dist {
+	case FIXED, UNIFORM, EXPONENTIAL:
+	default:
+		return nil, fmt.Errorf("unknown value size distribution %q", dist)
+	}
+	if size < 0 || size > state.MAX_VALUE_SIZE {
+		return nil, fmt.Errorf("value size %d out of range", size)
+	}
+	return &Generator{dist, size, rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+}
+
+// The size of the next value, at most state.MAX_VALUE_SIZE, and at least 1 unless the given size is 0
+func (g *Generator) NextSize() int {
+	size := g.size
+	switch g.dist {
+	case UNIFORM:
+		size = g.random.Intn(2*g.size + 1)
+	case EXPONENTIAL:
+		size = int(g.random.ExpFloat64() * float64(g.size))
+	}
+	if size < 1 && g.size > 0 {
+		size = 1
+	}
+	if size > state.MAX_VALUE_SIZE {
+		size = state.MAX_VALUE_SIZE
+	}
+	return size
+}
+
+func (g *Generator) Next() state.Value {
+	value := make(state.Value, g.NextSize())
+	g.random.Read(value)
+	return value
+}
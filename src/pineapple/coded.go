@@ -0,0 +1,374 @@
+package pineapple
+
+import (
+	"log"
+	"sort"
+
+	"pineapple/src/erasure"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Phases of a coded ABD operation
+const (
+	CODED_QUERY    uint8 = iota // get the highest finalized tag
+	CODED_PREWRITE              // store the fragments of a write
+	CODED_FINALIZE              // mark the tag finalized, and collect fragments when reading
+)
+
+// Erasure-coded ABD, after CAS and CASGC (Cadambe et al.).
+// With a k-of-N code, quorums hold ceil((N+k)/2) replicas, so that any two of them share k replicas.
+// A read only returns a finalized tag, whose fragments were pre-written to a quorum, so k fragments of
+// it can be collected unless they were garbage collected, in which case the read starts over.
+// Replicas keep the fragments of the latest gc+1 finalized tags of a key, and of the newer pre-writes.
+// RMWs and read leases need the whole value at one replica, and are not available in coded mode.
+// Nor are the other quorum modes and sizes, which the coded quorums would ignore
+
+// Fragments stored by a replica for a key
+type codedKey struct {
+	fragments map[pineappleproto.Tag]*codedFragment
+	final     pineappleproto.Tag // highest finalized tag
+}
+
+type codedFragment struct {
+	data   []byte // empty for an empty value
+	size   int    // bytes of the coded value
+	stored bool   // false if only the finalize was received
+	final  bool
+}
+
+// Builds the k-of-N code, stops the replica if it cannot be used with the other options
+func (r *Replica) checkCoded(k int) {
+	if k == 0 {
+		return
+	}
+	code, err := erasure.NewCode(r.N, k)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if r.leaseDuration > 0 || r.keyLeaseDuration > 0 {
+		log.Fatalln("Read leases need whole values, they cannot be combined with coding")
+	}
+	if r.Durable {
+		log.Fatalln("Coded fragments are not written to the stable store")
+	}
+	if r.quorumMode != QUORUM_COUNT || r.readQuorum != 0 || r.writeQuorum != 0 || r.prepareQuorum != 0 ||
+		r.acceptQuorum != 0 {
+		// coded quorums are sized by the code, and only intersect in k replicas when counted in replicas
+		log.Fatalln("Quorum modes and sizes cannot be set with coding")
+	}
+	r.coded = code
+	log.Printf("Replica %d stores fragments of a %d-of-%d code, quorums of %d\n", r.Id, k, r.N, r.codedQuorum())
+}
+
+func (r *Replica) codedQuorum() int {
+	return (r.N + r.coded.K + 1) / 2
+}
+
+// Whether the peers in acks, together with this replica, form a coded quorum
+func (r *Replica) isCodedQuorum(acks map[int32]bool) bool {
+	count := 1
+	for q, ok := range acks {
+		if ok && q != r.Id {
+			count++
+		}
+	}
+	return count >= r.codedQuorum()
+}
+
+func (r *Replica) codedKey(key state.Key) *codedKey {
+	ck := r.fragments[key]
+	if ck == nil {
+		ck = &codedKey{fragments: make(map[pineappleproto.Tag]*codedFragment)}
+		r.fragments[key] = ck
+	}
+	return ck
+}
+
+// Whether the received tag is larger. Unlike isLargerTag, tags of the RMW leader are not treated apart,
+// as coded mode has no RMWs
+func newerTag(current pineappleproto.Tag, received pineappleproto.Tag) bool {
+	return received.Timestamp > current.Timestamp ||
+		received.Timestamp == current.Timestamp && received.ID > current.ID
+}
+
+// Coordinator: start the query phase of a coded GET or PUT
+func (r *Replica) startCoded(instance int32) {
+	inst := r.instanceSpace[instance]
+	inst.lb.codedPhase = CODED_QUERY
+	inst.payload = pineappleproto.Payload{Tag: r.codedKey(inst.cmds[0].K).final}
+	inst.lb.fragments = nil
+	r.startPhase(inst)
+	r.bcastCoded(instance, r.codedQueryRPC,
+		&pineappleproto.CodedQuery{ReplicaID: r.Id, Instance: instance, Key: inst.cmds[0].K})
+}
+
+func (r *Replica) bcastCoded(instance int32, code uint8, msg interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Coded bcast failed:", err)
+		}
+	}()
+	inst := r.instanceSpace[instance]
+	for _, q := range r.codedPeers(inst) {
+		r.sendCoded(inst, q, code, msg)
+	}
+}
+
+// Peers to send the current phase to, fastest first: all alive peers, or just enough for a quorum if thrifty
+func (r *Replica) codedPeers(inst *Instance) []int32 {
+	peers := make([]int32, 0, r.N-1)
+	acks := make(map[int32]bool, r.N)
+	for i := 0; i < r.N-1; i++ {
+		if r.Thrifty && r.isCodedQuorum(acks) {
+			break
+		}
+		q := r.PreferredPeerOrder[i]
+		if !r.Alive[q].Load() || inst.lb.replied[q] {
+			continue
+		}
+		peers = append(peers, q)
+		acks[q] = true
+	}
+	return peers
+}
+
+// Pre-writes carry the fragment of each peer
+func (r *Replica) sendCoded(inst *Instance, q int32, code uint8, msg interface{}) {
+	switch m := msg.(type) {
+	case *pineappleproto.CodedQuery:
+		r.SendMsg(q, code, m)
+	case *pineappleproto.CodedFinalize:
+		r.SendMsg(q, code, m)
+	case *pineappleproto.CodedWrite:
+		write := *m
+		write.Fragment = inst.lb.encoded[q]
+		r.SendMsg(q, code, &write)
+	}
+}
+
+// Retransmit the current phase of a coded operation to the peers that have not answered
+func (r *Replica) resendCoded(instance int32, inst *Instance) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Retransmission failed:", err)
+		}
+	}()
+	code, msg := r.codedPhaseMsg(instance, inst)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() || inst.lb.replied[q] {
+			continue
+		}
+		r.sendCoded(inst, q, code, msg)
+	}
+}
+
+func (r *Replica) codedPhaseMsg(instance int32, inst *Instance) (uint8, interface{}) {
+	key := inst.cmds[0].K
+	switch inst.lb.codedPhase {
+	case CODED_QUERY:
+		return r.codedQueryRPC, &pineappleproto.CodedQuery{ReplicaID: r.Id, Instance: instance, Key: key}
+	case CODED_PREWRITE:
+		return r.codedWriteRPC, &pineappleproto.CodedWrite{ReplicaID: r.Id, Instance: instance, Key: key,
+			Tag: inst.payload.Tag, Size: len(inst.lb.value)}
+	default:
+		read := FALSE
+		if inst.cmds[0].Op == state.GET {
+			read = TRUE
+		}
+		return r.codedFinalizeRPC, &pineappleproto.CodedFinalize{ReplicaID: r.Id, Instance: instance,
+			Read: read, Key: key, Tag: inst.payload.Tag}
+	}
+}
+
+func (r *Replica) handleCodedQuery(query *pineappleproto.CodedQuery) {
+	reply := &pineappleproto.CodedQueryReply{ReplicaID: r.Id, Instance: query.Instance, Tag: r.codedKey(query.Key).final}
+	r.SendMsg(query.ReplicaID, r.codedQueryReplyRPC, reply)
+}
+
+// Coordinator: once a quorum answered the query, pre-write a new tag or finalize the highest one
+func (r *Replica) handleCodedQueryReply(reply *pineappleproto.CodedQueryReply) {
+	inst := r.instanceSpace[reply.Instance]
+	if inst == nil || inst.lb.codedPhase != CODED_QUERY || inst.lb.replied[reply.ReplicaID] {
+		return
+	}
+	inst.lb.replied[reply.ReplicaID] = true
+	inst.lb.oks[reply.ReplicaID] = true
+	if newerTag(inst.payload.Tag, reply.Tag) {
+		inst.payload.Tag = reply.Tag
+	}
+	if !r.isCodedQuorum(inst.lb.oks) {
+		return
+	}
+
+	key := inst.cmds[0].K
+	if inst.cmds[0].Op == state.PUT {
+		inst.payload = pineappleproto.Payload{
+			Tag:   pineappleproto.Tag{Timestamp: inst.payload.Tag.Timestamp + 1, ID: int(r.Id)},
+			Value: inst.cmds[0].V}
+		inst.lb.value = inst.payload.Value
+		inst.lb.encoded = r.coded.Encode(inst.lb.value)
+		r.storeFragment(key, inst.payload.Tag, inst.lb.encoded[r.Id], len(inst.lb.value))
+		inst.lb.codedPhase = CODED_PREWRITE
+	} else {
+		if inst.payload.Tag == (pineappleproto.Tag{}) {
+			// no write was finalized by the quorum, so none completed
+			inst.payload.Value = state.NIL
+			r.replyClient(reply.Instance)
+			return
+		}
+		inst.lb.codedPhase = CODED_FINALIZE
+		inst.lb.fragments = make(map[int][]byte)
+		if fragment := r.finalizeFragment(key, inst.payload.Tag); fragment != nil && fragment.stored {
+			inst.lb.fragments[int(r.Id)] = fragment.data
+			inst.lb.fragmentSize = fragment.size
+		}
+	}
+	r.startPhase(inst)
+	code, msg := r.codedPhaseMsg(reply.Instance, inst)
+	r.bcastCoded(reply.Instance, code, msg)
+}
+
+func (r *Replica) handleCodedWrite(write *pineappleproto.CodedWrite) {
+	r.storeFragment(write.Key, write.Tag, write.Fragment, write.Size)
+	r.SendMsg(write.ReplicaID, r.codedWriteReplyRPC,
+		&pineappleproto.CodedWriteReply{ReplicaID: r.Id, Instance: write.Instance, Key: write.Key, Tag: write.Tag})
+}
+
+// Coordinator: once a quorum stored its fragment, finalize the tag
+func (r *Replica) handleCodedWriteReply(reply *pineappleproto.CodedWriteReply) {
+	inst := r.instanceSpace[reply.Instance]
+	if inst == nil || inst.lb.codedPhase != CODED_PREWRITE || !r.sameCodedOp(inst, reply.Key, reply.Tag) ||
+		inst.lb.replied[reply.ReplicaID] {
+		return
+	}
+	inst.lb.replied[reply.ReplicaID] = true
+	inst.lb.oks[reply.ReplicaID] = true
+	if !r.isCodedQuorum(inst.lb.oks) {
+		return
+	}
+
+	inst.lb.codedPhase = CODED_FINALIZE
+	r.finalizeFragment(inst.cmds[0].K, inst.payload.Tag)
+	r.startPhase(inst)
+	code, msg := r.codedPhaseMsg(reply.Instance, inst)
+	r.bcastCoded(reply.Instance, code, msg)
+}
+
+func (r *Replica) handleCodedFinalize(finalize *pineappleproto.CodedFinalize) {
+	reply := &pineappleproto.CodedFinalizeReply{ReplicaID: r.Id, Instance: finalize.Instance,
+		Key: finalize.Key, Tag: finalize.Tag, Has: FALSE}
+	fragment := r.finalizeFragment(finalize.Key, finalize.Tag)
+	if finalize.Read == TRUE && fragment != nil && fragment.stored {
+		reply.Has = TRUE
+		reply.Size = fragment.size
+		reply.Fragment = fragment.data
+	}
+	r.SendMsg(finalize.ReplicaID, r.codedFinalizeReplyRPC, reply)
+}
+
+// Coordinator: a write is done once a quorum finalized its tag,
+// a read once a quorum finalized it and k fragments were collected
+func (r *Replica) handleCodedFinalizeReply(reply *pineappleproto.CodedFinalizeReply) {
+	inst := r.instanceSpace[reply.Instance]
+	if inst == nil || inst.lb.codedPhase != CODED_FINALIZE || !r.sameCodedOp(inst, reply.Key, reply.Tag) ||
+		inst.lb.replied[reply.ReplicaID] {
+		return
+	}
+	inst.lb.replied[reply.ReplicaID] = true
+	inst.lb.oks[reply.ReplicaID] = true
+	if reply.Has == TRUE && inst.lb.fragments != nil {
+		inst.lb.fragments[int(reply.ReplicaID)] = reply.Fragment
+		inst.lb.fragmentSize = reply.Size
+	}
+	if !r.isCodedQuorum(inst.lb.oks) {
+		return
+	}
+
+	if inst.cmds[0].Op == state.PUT {
+		r.replyClient(reply.Instance)
+		return
+	}
+	if len(inst.lb.fragments) >= r.coded.K {
+		value, err := r.coded.Decode(inst.lb.fragments, inst.lb.fragmentSize)
+		if err == nil {
+			inst.payload.Value = value
+			r.replyClient(reply.Instance)
+			return
+		}
+		log.Println("Coded read failed:", err)
+	}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.Alive[q].Load() && !inst.lb.replied[q] {
+			return
+		}
+	}
+	// the fragments were garbage collected after a newer write, read that one
+	r.startCoded(reply.Instance)
+}
+
+// Does a reply concern the operation of the instance, or an earlier one that used the same instance.
+// Tags are only unique per key
+func (r *Replica) sameCodedOp(inst *Instance, key state.Key, tag pineappleproto.Tag) bool {
+	return key == inst.cmds[0].K && tag == inst.payload.Tag
+}
+
+// Store a pre-written fragment, unless the tag is older than those kept
+func (r *Replica) storeFragment(key state.Key, tag pineappleproto.Tag, data []byte, size int) {
+	ck := r.codedKey(key)
+	fragment := ck.fragments[tag]
+	if fragment == nil {
+		if newerTag(tag, r.oldestKept(ck)) {
+			return
+		}
+		fragment = &codedFragment{}
+		ck.fragments[tag] = fragment
+	}
+	fragment.data = data
+	fragment.size = size
+	fragment.stored = true
+}
+
+// Mark a tag finalized, then garbage collect the fragments older than the gc+1 latest finalized tags.
+// Returns the fragment stored for the tag, nil if it was garbage collected
+func (r *Replica) finalizeFragment(key state.Key, tag pineappleproto.Tag) *codedFragment {
+	ck := r.codedKey(key)
+	if newerTag(ck.final, tag) {
+		ck.final = tag
+	}
+	fragment := ck.fragments[tag]
+	if fragment == nil {
+		if newerTag(tag, r.oldestKept(ck)) {
+			return nil
+		}
+		fragment = &codedFragment{}
+		ck.fragments[tag] = fragment
+	}
+	fragment.final = true
+	r.collectFragments(ck)
+	return fragment
+}
+
+// Oldest tag whose fragment is kept: the (gc+1)-th latest finalized one
+func (r *Replica) oldestKept(ck *codedKey) pineappleproto.Tag {
+	final := make([]pineappleproto.Tag, 0, len(ck.fragments))
+	for tag, fragment := range ck.fragments {
+		if fragment.final {
+			final = append(final, tag)
+		}
+	}
+	if len(final) <= r.codedGC {
+		return pineappleproto.Tag{}
+	}
+	sort.Slice(final, func(i, j int) bool { return newerTag(final[j], final[i]) })
+	return final[r.codedGC]
+}
+
+func (r *Replica) collectFragments(ck *codedKey) {
+	oldest := r.oldestKept(ck)
+	for tag := range ck.fragments {
+		if newerTag(tag, oldest) {
+			delete(ck.fragments, tag)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package pineapple
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"pineapple/src/masterproto"
+	"pineapple/src/pineappleproto"
+)
+
+const LEADER_HEARTBEAT = 100 * time.Millisecond // between heartbeats of the elected leader
+const ELECTION_TIMEOUT = 1 * time.Second        // silence of the leader after which a replica stands, plus up to as much at random
+const PUBLISH_RETRIES = 10                      // attempts to tell the masters about the elected leader
+
+// Leader election among the replicas.
+// With -elect, the replicas of a group choose the RMW leader themselves, and the master only learns it for the
+// clients. The leader sends heartbeats to its peers. A member that hears none for a randomized election
+// timeout stands for election in the next leader epoch: it runs phase 1, and the peers promising its ballot
+// vote for it. A replica votes for a single candidate in each epoch, so at most one wins it, and a candidate
+// refused by a quorum gives up until the next timeout. The leader epochs fence the previous leaders off
+
+func (r *Replica) resetElection() {
+	r.electionAt = time.Now().Add(ELECTION_TIMEOUT + time.Duration(rand.Int63n(int64(ELECTION_TIMEOUT))))
+}
+
+// Only replicas that stay members and hold the state of the group stand for election
+func (r *Replica) canLead() bool {
+	return r.members[r.Id] && (r.oldMembers == nil || r.oldMembers[r.Id]) && !r.catchingUp
+}
+
+// Whether this replica already voted for another candidate in the current leader epoch
+func (r *Replica) votedForOther(candidate int32) bool {
+	return r.elect && r.votedFor != -1 && r.votedFor != candidate
+}
+
+func (r *Replica) vote(candidate int32) {
+	r.votedFor = candidate
+	if r.elect && candidate != r.Id {
+		r.resetElection()
+	}
+}
+
+// Called on every clock tick: send heartbeats while leading, otherwise stand once the leader fell silent
+func (r *Replica) checkElection() {
+	if !r.elect {
+		return
+	}
+	now := time.Now()
+	if r.IsLeader && r.takeover == nil {
+		if !r.canLead() {
+			log.Printf("Replica %d stepping down, it is leaving the group\n", r.Id)
+			r.stepDown()
+		} else if now.After(r.nextHeartbeat) {
+			r.sendHeartbeats()
+			r.nextHeartbeat = now.Add(LEADER_HEARTBEAT)
+		}
+		return
+	}
+	if now.Before(r.electionAt) {
+		return
+	}
+	if r.takeover != nil {
+		// phase 1 did not reach a quorum in time
+		log.Printf("Replica %d giving up the election in leader epoch %d\n", r.Id, r.leaderEpoch)
+		r.stepDown()
+		return
+	}
+	if !r.canLead() {
+		r.resetElection()
+		return
+	}
+
+	r.learnLeaderEpoch(r.leaderEpoch + 1)
+	log.Printf("Replica %d standing for election in leader epoch %d\n", r.Id, r.leaderEpoch)
+	r.resetElection()
+	r.startTakeover(r.retryBallot)
+}
+
+func (r *Replica) sendHeartbeats() {
+	heartbeat := &pineappleproto.Heartbeat{LeaderId: r.Id, LeaderEpoch: r.leaderEpoch}
+	for _, q := range r.groupPeers() {
+		if r.Alive[q].Load() {
+			r.SendMsg(q, r.heartbeatRPC, heartbeat)
+		}
+	}
+}
+
+func (r *Replica) handleHeartbeat(heartbeat *pineappleproto.Heartbeat) {
+	if r.fenced(heartbeat.LeaderEpoch) {
+		return
+	}
+	if r.takeover != nil && heartbeat.LeaderId != r.Id {
+		// another candidate won the epoch
+		r.stepDown()
+	}
+	r.votedFor = heartbeat.LeaderId
+	r.resetElection()
+}
+
+// Tell the masters which replica leads the group, so that they direct the clients to it
+func (r *Replica) publishLeader(leaderEpoch int32) {
+	args := &masterproto.SetLeaderArgs{Shard: r.Shard, ReplicaId: int(r.Id), LeaderEpoch: leaderEpoch}
+	for i := 0; i < PUBLISH_RETRIES; i++ {
+		err := masterproto.Call(r.masters, "Master.SetLeader", args, new(masterproto.SetLeaderReply))
+		if err == nil {
+			return
+		}
+		log.Printf("Replica %d could not report itself as the leader to the masters: %v\n", r.Id, err)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,146 @@
+package pineapple
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+const KEY_LEASE_SWEEP = 1000 * 1000 * 1000          // forget expired key leases every second
+const READ_STATS_INTERVAL = 10 * 1000 * 1000 * 1000 // report the local read hit rate every 10 seconds
+const HOT_KEYS = 5                                  // keys with the most reads listed in the report
+
+// Read leases on keys.
+// A replica answering the get phase of a read grants the coordinator a lease on the key. Once a read
+// quorum granted it, the coordinator answers GETs on the key locally, as long as its value still has the
+// tag the read returned. Grantors report the lease in their replies like the leader lease, so writes to
+// the key wait for the holder to acknowledge them, or for the lease to expire if the holder is down.
+// A write acknowledged by the holder changes its value, ending local reads until the next read.
+
+// Lease on a key held by this replica
+type keyLease struct {
+	until time.Time          // when to stop reading locally
+	tag   pineappleproto.Tag // tag of the value confirmed by the read that got the lease
+}
+
+// GETs received for a key since the last report
+type readCount struct {
+	reads int
+	local int // answered from a lease
+}
+
+// Grant a peer reading a key a lease on it, returns its duration in nanoseconds
+func (r *Replica) grantKeyLease(holder int32, key state.Key) int {
+	if r.keyLeaseDuration == 0 {
+		return 0
+	}
+	holders := r.keyLeases[key]
+	if holders == nil {
+		holders = make(map[int32]time.Time)
+		r.keyLeases[key] = holders
+	}
+	holders[holder] = time.Now().Add(r.keyLeaseDuration)
+	return int(r.keyLeaseDuration)
+}
+
+// Count the key lease granted by a peer answering the get phase of a read coordinated by this replica
+func (r *Replica) learnKeyLease(inst *Instance, getReply *pineappleproto.GetReply) {
+	if getReply.KeyLease <= 0 || getReply.OK == FALSE {
+		return
+	}
+	lease := time.Duration(getReply.KeyLease)
+	if inst.lb.keyGrants == nil {
+		inst.lb.keyGrants = make(map[int32]bool)
+		inst.lb.keyLease = lease
+	}
+	inst.lb.keyGrants[getReply.ReplicaID] = true
+	if lease < inst.lb.keyLease {
+		inst.lb.keyLease = lease
+	}
+}
+
+// A read coordinated by this replica completed with this tag. If a read quorum granted a lease on the key,
+// hold it from the start of the read, which every grantor received after it was sent
+func (r *Replica) acquireKeyLease(inst *Instance, key state.Key, tag pineappleproto.Tag) {
+	if r.keyLeaseDuration == 0 || inst.lb.keyGrants == nil || !r.isQuorum(READ_QUORUM, inst.lb.keyGrants) {
+		return
+	}
+	until := inst.lb.started.Add(inst.lb.keyLease - LEASE_GUARD)
+	if until.After(r.heldKeyLeases[key].until) {
+		r.heldKeyLeases[key] = keyLease{until, tag}
+	}
+}
+
+// Can a GET on the key be answered locally with the value having this tag
+func (r *Replica) holdsKeyLease(key state.Key, tag pineappleproto.Tag) bool {
+	lease, held := r.heldKeyLeases[key]
+	return held && lease.tag == tag && time.Now().Before(lease.until)
+}
+
+// Forget the key leases that expired, granted or held
+func (r *Replica) sweepKeyLeases() {
+	now := time.Now()
+	r.nextKeyLeaseSweep = now.Add(KEY_LEASE_SWEEP)
+	for key, holders := range r.keyLeases {
+		for q, until := range holders {
+			if !now.Before(until) {
+				delete(holders, q)
+			}
+		}
+		if len(holders) == 0 {
+			delete(r.keyLeases, key)
+		}
+	}
+	for key, lease := range r.heldKeyLeases {
+		if !now.Before(lease.until) {
+			delete(r.heldKeyLeases, key)
+		}
+	}
+}
+
+func (r *Replica) countRead(key state.Key, local bool) {
+	if r.leaseDuration == 0 && r.keyLeaseDuration == 0 {
+		return
+	}
+	stats := r.readStats[key]
+	if stats == nil {
+		stats = &readCount{}
+		r.readStats[key] = stats
+	}
+	stats.reads++
+	if local {
+		stats.local++
+	}
+}
+
+// Log the share of GETs answered locally since the last report, overall and for the most read keys
+func (r *Replica) reportReadStats() {
+	r.nextReadStats = time.Now().Add(READ_STATS_INTERVAL)
+	if len(r.readStats) == 0 {
+		return
+	}
+	keys := make([]state.Key, 0, len(r.readStats))
+	reads, local := 0, 0
+	for key, stats := range r.readStats {
+		keys = append(keys, key)
+		reads += stats.reads
+		local += stats.local
+	}
+	sort.Slice(keys, func(i, j int) bool { return r.readStats[keys[i]].reads > r.readStats[keys[j]].reads })
+	if len(keys) > HOT_KEYS {
+		keys = keys[:HOT_KEYS]
+	}
+	hot := make([]string, len(keys))
+	for i, key := range keys {
+		stats := r.readStats[key]
+		hot[i] = fmt.Sprintf("%s: %d/%d", key, stats.local, stats.reads)
+	}
+	log.Printf("Replica %d answered %d/%d reads locally (%.1f%%), hot keys %s\n",
+		r.Id, local, reads, 100*float64(local)/float64(reads), strings.Join(hot, ", "))
+	r.readStats = make(map[state.Key]*readCount)
+}
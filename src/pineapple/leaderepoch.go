@@ -0,0 +1,46 @@
+package pineapple
+
+import "log"
+
+// Leader epochs.
+// The master numbers the leaders it appoints, increasing the epoch with each failover, and tells the other
+// replicas of the group to step down. Leaders carry their epoch in Prepare, RMWGet and RMWSet, and acceptors
+// refuse the messages of leaders from older epochs, replying with the epoch they know. A deposed leader that
+// the master could not reach learns the new epoch from those replies, or from the new leader, and steps down,
+// so two replicas do not keep leading at once. Ballots still order the leaders of a same epoch
+
+// Adopt a newer leader epoch, stepping down if this replica led in an older one. Returns whether it was newer
+func (r *Replica) learnLeaderEpoch(leaderEpoch int32) bool {
+	if leaderEpoch <= r.leaderEpoch {
+		return false
+	}
+	r.leaderEpoch = leaderEpoch
+	r.votedFor = -1
+	if r.IsLeader || r.takeover != nil {
+		log.Printf("Replica %d stepping down, leader epoch %d started\n", r.Id, leaderEpoch)
+		r.stepDown()
+	}
+	return true
+}
+
+// Whether a message comes from a leader of an older epoch than the latest known
+func (r *Replica) fenced(leaderEpoch int32) bool {
+	r.learnLeaderEpoch(leaderEpoch)
+	return leaderEpoch < r.leaderEpoch
+}
+
+// Become the leader in the epoch, unless the master already appointed another leader since
+func (r *Replica) handleBeTheLeader(leaderEpoch int32) {
+	if leaderEpoch < r.leaderEpoch {
+		log.Printf("Replica %d ignoring leader epoch %d, epoch %d started\n", r.Id, leaderEpoch, r.leaderEpoch)
+		return
+	}
+	// a replica already leading keeps its ballot, the acceptors learn the epoch from its next messages
+	if leaderEpoch > r.leaderEpoch {
+		r.leaderEpoch = leaderEpoch
+		r.votedFor = -1
+	}
+	if !r.IsLeader && r.takeover == nil && !r.catchingUp && !r.removed() {
+		r.startTakeover(r.defaultBallot)
+	}
+}
@@ -0,0 +1,284 @@
+package pineapple
+
+import (
+	"log"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+const LEASE_GUARD = 10 * 1000 * 1000 // the leader stops using its lease this early, to allow for clock drift (10 ms)
+
+// Read leases.
+// The RMW leader asks for a lease every quarter of its duration. Once a read quorum granted it, the leader
+// answers GETs locally for keys whose value it confirmed during the lease. A replica that granted the lease
+// reports it in its replies, and the coordinators of writes wait for the leaseholder to acknowledge them,
+// so no write completes without the leaseholder seeing it. Read quorums intersect every write quorum.
+
+// Is this replica the leader, holding a lease
+func (r *Replica) holdsLease() bool {
+	return r.leaseDuration > 0 && r.IsLeader && time.Now().Before(r.leaseUntil)
+}
+
+// Called on every clock tick: ask for the lease again before it expires
+func (r *Replica) renewLease() {
+	now := time.Now()
+	if r.leaseDuration == 0 || !r.IsLeader || r.takeover != nil ||
+		now.Before(r.leaseSentAt.Add(r.leaseDuration/4)) {
+		return
+	}
+	if r.leaseHolder != r.Id && now.Before(r.leaseHolderUntil) {
+		// this replica granted the lease to the previous leader
+		return
+	}
+
+	r.leaseSeq++
+	r.leaseSentAt = now
+	r.leaseGrants = map[int32]bool{}
+	r.leaseHolder = r.Id
+	r.leaseHolderUntil = now.Add(r.leaseDuration)
+	r.bcastLeaseRequest()
+	r.checkLeaseGrants()
+}
+
+func (r *Replica) bcastLeaseRequest() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Lease bcast failed:", err)
+		}
+	}()
+	args := &pineappleproto.LeaseRequest{LeaderId: r.Id, Seq: r.leaseSeq, Duration: int64(r.leaseDuration)}
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() {
+			continue
+		}
+		r.SendMsg(q, r.leaseRequestRPC, args)
+	}
+}
+
+// Grant the lease, unless it was granted to another leader and has not expired
+func (r *Replica) handleLeaseRequest(request *pineappleproto.LeaseRequest) {
+	now := time.Now()
+	ok := TRUE
+	if r.leaseHolder != request.LeaderId && now.Before(r.leaseHolderUntil) {
+		ok = FALSE
+	} else {
+		r.leaseHolder = request.LeaderId
+		r.leaseHolderUntil = now.Add(time.Duration(request.Duration))
+	}
+	r.SendMsg(request.LeaderId, r.leaseGrantRPC, &pineappleproto.LeaseGrant{ReplicaID: r.Id, Seq: request.Seq, OK: ok})
+}
+
+func (r *Replica) handleLeaseGrant(grant *pineappleproto.LeaseGrant) {
+	if !r.IsLeader || grant.Seq != r.leaseSeq || grant.OK == FALSE {
+		return
+	}
+	r.leaseGrants[grant.ReplicaID] = true
+	r.checkLeaseGrants()
+}
+
+// The lease lasts from the request, which every grantor received after it was sent
+func (r *Replica) checkLeaseGrants() {
+	if !r.isQuorum(READ_QUORUM, r.leaseGrants) {
+		return
+	}
+	if !r.holdsLease() {
+		// values confirmed before a gap in the lease may have been overwritten since
+		r.leaseEpoch++
+		r.confirmed = map[state.Key]pineappleproto.Tag{}
+		log.Printf("Replica %d holds the read lease\n", r.Id)
+	}
+	r.leaseUntil = r.leaseSentAt.Add(r.leaseDuration - LEASE_GUARD)
+}
+
+// Stop reading locally and let the replicas grant the lease to the next leader
+func (r *Replica) releaseLease() {
+	if r.leaseDuration == 0 {
+		return
+	}
+	r.leaseUntil = time.Time{}
+	r.leaseSentAt = time.Time{}
+	if r.leaseHolder == r.Id {
+		r.leaseHolderUntil = time.Time{}
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Lease release bcast failed:", err)
+		}
+	}()
+	args := &pineappleproto.LeaseRelease{LeaderId: r.Id}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() {
+			continue
+		}
+		r.SendMsg(q, r.leaseReleaseRPC, args)
+	}
+}
+
+func (r *Replica) handleLeaseRelease(release *pineappleproto.LeaseRelease) {
+	if r.leaseHolder == release.LeaderId {
+		r.leaseHolderUntil = time.Time{}
+	}
+}
+
+// The leases granted by this replica that cover a key, as reported in its replies
+func (r *Replica) grantedLeases(key state.Key) []pineappleproto.LeaseInfo {
+	var leases []pineappleproto.LeaseInfo
+	now := time.Now()
+	if now.Before(r.leaseHolderUntil) {
+		leases = append(leases, pineappleproto.LeaseInfo{Holder: r.leaseHolder, Left: int(r.leaseHolderUntil.Sub(now))})
+	}
+	for holder, until := range r.keyLeases[key] {
+		if now.Before(until) {
+			leases = append(leases, pineappleproto.LeaseInfo{Holder: holder, Left: int(until.Sub(now))})
+		}
+	}
+	return leases
+}
+
+// The leases granted by this replica that cover any key in a range (see keyindex.Index.Range), one per holder
+func (r *Replica) grantedLeasesIn(start state.Key, end state.Key) []pineappleproto.LeaseInfo {
+	return r.grantedLeasesOn(func(key state.Key) bool { return key >= start && (end == "" || key < end) })
+}
+
+// The leases granted by this replica that cover any of the keys accepted, one per holder
+func (r *Replica) grantedLeasesOn(covers func(key state.Key) bool) []pineappleproto.LeaseInfo {
+	now := time.Now()
+	left := make(map[int32]time.Duration)
+	if now.Before(r.leaseHolderUntil) {
+		left[r.leaseHolder] = r.leaseHolderUntil.Sub(now)
+	}
+	for key, holders := range r.keyLeases {
+		if !covers(key) {
+			continue
+		}
+		for holder, until := range holders {
+			if d := until.Sub(now); d > left[holder] {
+				left[holder] = d
+			}
+		}
+	}
+	leases := make([]pineappleproto.LeaseInfo, 0, len(left))
+	for holder, d := range left {
+		leases = append(leases, pineappleproto.LeaseInfo{Holder: holder, Left: int(d)})
+	}
+	return leases
+}
+
+// Remember the leases reported by a peer answering a phase of an instance coordinated by this replica
+func (r *Replica) learnLeases(inst *Instance, leases []pineappleproto.LeaseInfo) {
+	inst.lb.leaseHolders = r.addLeases(inst.lb.leaseHolders, leases)
+}
+
+// Add the leases reported by a peer to the holders known, by expiry. Returns the holders, allocated if nil
+func (r *Replica) addLeases(holders map[int32]time.Time, leases []pineappleproto.LeaseInfo) map[int32]time.Time {
+	now := time.Now()
+	for _, lease := range leases {
+		if lease.Left <= 0 || lease.Holder == r.Id {
+			continue
+		}
+		until := now.Add(time.Duration(lease.Left))
+		if holders == nil {
+			holders = make(map[int32]time.Time)
+		}
+		if until.After(holders[lease.Holder]) {
+			holders[lease.Holder] = until
+		}
+	}
+	return holders
+}
+
+// Peers that must acknowledge a phase of an instance coordinated by this replica: the holders of the
+// leases on the key granted by this replica or reported by peers
+func (r *Replica) leaseHoldersFor(inst *Instance, key state.Key) []int32 {
+	var holders []int32
+	for _, lease := range r.grantedLeases(key) {
+		if lease.Holder != r.Id {
+			holders = append(holders, lease.Holder)
+		}
+	}
+	if inst != nil && inst.lb != nil {
+		now := time.Now()
+		for q, until := range inst.lb.leaseHolders {
+			if now.Before(until) {
+				holders = append(holders, q)
+			}
+		}
+	}
+	return holders
+}
+
+// Have the leaseholders reported for the instance acknowledged it, or their leases expired
+func (r *Replica) leaseHoldersAcked(inst *Instance, acks map[int32]bool) bool {
+	return holdersAcked(inst.lb.leaseHolders, acks)
+}
+
+func holdersAcked(holders map[int32]time.Time, acks map[int32]bool) bool {
+	now := time.Now()
+	for q, until := range holders {
+		if !acks[q] && now.Before(until) {
+			return false
+		}
+	}
+	return true
+}
+
+// The holders whose leases have not expired
+func liveHolders(holders map[int32]time.Time) []int32 {
+	live := make([]int32, 0, len(holders))
+	now := time.Now()
+	for q, until := range holders {
+		if now.Before(until) {
+			live = append(live, q)
+		}
+	}
+	return live
+}
+
+// The epoch of the lease held while an instance coordinated by this replica started, -1 if none
+func (r *Replica) instanceLeaseEpoch() int32 {
+	if !r.holdsLease() {
+		return -1
+	}
+	return r.leaseEpoch
+}
+
+// An operation coordinated by the leader completed with this tag. If the lease was held since it
+// started, every later write was acknowledged by the leader, so the tag stays the latest one for the
+// key as long as the local value has it
+func (r *Replica) confirm(inst *Instance, key state.Key, tag pineappleproto.Tag) {
+	if inst.leaseEpoch >= 0 && inst.leaseEpoch == r.leaseEpoch && r.holdsLease() {
+		r.confirmed[key] = tag
+	}
+}
+
+// Answer a GET from the local value, if it is confirmed under the leader lease or a lease on the key
+func (r *Replica) localRead(propose *genericsmr.Propose) bool {
+	key := propose.Command.K
+	data, present := r.data[key]
+	if !present {
+		return false
+	}
+	tag, confirmed := r.confirmed[key]
+	if !(confirmed && data.Tag == tag && r.holdsLease()) && !r.holdsKeyLease(key, data.Tag) {
+		return false
+	}
+
+	if r.Dreply {
+		propreply := &genericsmrproto.ProposeReplyTS{
+			OK:        TRUE,
+			Found:     found(data),
+			CommandId: propose.CommandId,
+			Value:     data.Value,
+			TagTS:     int64(data.Tag.Timestamp),
+			TagID:     int32(data.Tag.ID),
+			Timestamp: propose.Timestamp}
+		r.ReplyProposeTS(propreply, propose.Reply)
+	}
+	return true
+}
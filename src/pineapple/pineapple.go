@@ -1,20 +1,41 @@
 package pineapple
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
 	"io"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
+	"pineapple/src/erasure"
 	"pineapple/src/fastrpc"
 	"pineapple/src/genericsmr"
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/keyindex"
+	"pineapple/src/masterproto"
 	"pineapple/src/pineappleproto"
 	"pineapple/src/state"
 )
 
 const CLOCK = 1000 * 5
+const BACKOFF = 1000 * 1000           // initial wait before retrying a rejected ballot (1 ms)
+const MAX_BACKOFF = 100 * 1000 * 1000 // cap on the wait before retrying a rejected ballot (100 ms)
 const CHAN_BUFFER_SIZE = 200000
+const CHECKPOINT_INTERVAL = 100000         // log records written between automatic checkpoints
+const CATCHUP_CHUNK = 1024 * 1024          // bytes of keys and RMW instances per state transfer message, unless one is larger
+const CATCHUP_ENTRY = 32                   // bytes of an entry of a state transfer message besides keys and values, about
+const CATCHUP_TIMEOUT = 1000 * 1000 * 1000 // wait for the next chunk before asking another peer (1 s)
+const TIMEOUT_CHECK = 1000 * 1000          // interval between scans for timed out instances (1 ms)
+const RANK_INTERVAL = 1000 * 1000 * 1000   // interval between reorderings of the peers by round trip time (1 s)
+const BALLOT_ID_BITS = 5                   // low bits of a ballot holding the replica id, up to genericsmr.MAX_REPLICAS
+
+// fails to compile if the ids of the replicas do not fit in the ballots
+var _ [1<<BALLOT_ID_BITS - genericsmr.MAX_REPLICAS]struct{}
+
 const TRUE = uint8(1)
 const FALSE = uint8(0)
 
@@ -51,19 +72,150 @@ type Replica struct {
 	rmwSetRPC       uint8
 	rmwSetReplyRPC  uint8
 
+	// Paxos leader change
+	prepareChan      chan fastrpc.Serializable
+	prepareReplyChan chan fastrpc.Serializable
+	beTheLeaderChan  chan int32 // leader epochs assigned by the master
+	stepDownChan     chan int32
+	checkpointChan   chan bool
+	prepareRPC       uint8
+	prepareReplyRPC  uint8
+	leaderEpoch      int32 // latest leader epoch known, the Paxos messages of older leaders are refused
+
+	// State transfer
+	catchUpChan      chan fastrpc.Serializable
+	catchUpChunkChan chan fastrpc.Serializable
+	catchUpRPC       uint8
+	catchUpChunkRPC  uint8
+
+	// Read leases
+	leaseRequestChan chan fastrpc.Serializable
+	leaseGrantChan   chan fastrpc.Serializable
+	leaseReleaseChan chan fastrpc.Serializable
+	leaseRequestRPC  uint8
+	leaseGrantRPC    uint8
+	leaseReleaseRPC  uint8
+
+	// Erasure-coded ABD
+	codedQueryChan         chan fastrpc.Serializable
+	codedQueryReplyChan    chan fastrpc.Serializable
+	codedWriteChan         chan fastrpc.Serializable
+	codedWriteReplyChan    chan fastrpc.Serializable
+	codedFinalizeChan      chan fastrpc.Serializable
+	codedFinalizeReplyChan chan fastrpc.Serializable
+	codedQueryRPC          uint8
+	codedQueryReplyRPC     uint8
+	codedWriteRPC          uint8
+	codedWriteReplyRPC     uint8
+	codedFinalizeRPC       uint8
+	codedFinalizeReplyRPC  uint8
+
+	// Tombstone garbage collection
+	tombstoneCheckChan      chan fastrpc.Serializable
+	tombstoneCheckReplyChan chan fastrpc.Serializable
+	tombstoneCheckRPC       uint8
+	tombstoneCheckReplyRPC  uint8
+
+	// Quorum scans
+	scanQueryChan          chan fastrpc.Serializable
+	scanQueryReplyChan     chan fastrpc.Serializable
+	scanWriteBackChan      chan fastrpc.Serializable
+	scanWriteBackReplyChan chan fastrpc.Serializable
+	scanQueryRPC           uint8
+	scanQueryReplyRPC      uint8
+	scanWriteBackRPC       uint8
+	scanWriteBackReplyRPC  uint8
+
 	IsLeader bool // does this replica think it is the leader
 	Shutdown bool
-	data     map[int]pineappleproto.Payload
+	data     map[state.Key]pineappleproto.Payload
+	keys     *keyindex.Index // keys of data in order, for scans
 	// prev // value & carstamp generated by previously executed RMWs
-	instanceSpace []*Instance // the space of all instances (used and not yet used)
-	defaultBallot int32       // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
-	crtInstance   int32       // highest used instance number that this replica knows about
+	instanceSpace map[int32]*Instance // ABD instances in progress, freed once the client is replied
+	defaultBallot int32               // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
+	crtInstance   int32               // next ABD instance number
 
 	flush bool
 
-	crtRmwId    int32       // highest id of RMW started
-	rmwDoneUpTo int32       // latest RMW done
-	pendingRMWs []*Instance // ids of RMWs pending
+	crtRmwId        int32               // highest id of RMW started
+	rmwDoneUpTo     int32               // latest RMW done
+	rmwExecutedUpTo int32               // latest RMW replied to and freed
+	pendingRMWs     map[int32]*Instance // RMW instances after rmwExecutedUpTo, indexed by rmwId
+
+	takeover *TakeoverBookkeeping // phase 1 state while becoming the leader, nil otherwise
+
+	retryBallot int32     // highest ballot that rejected this leader
+	retryAt     time.Time // when to run phase 1 again after a rejection, zero if not backing off
+	backoffs    int       // consecutive rejections, used to grow the backoff
+
+	stableWriter *bufio.Writer // buffers log records until the next sync
+	recovering   bool          // was the state rebuilt from the stable store
+	unsynced     bool          // were log records written since the last sync
+	heldReplies  []func()      // replies waiting for the next sync (group commit)
+	records      int           // log records written since the last checkpoint
+
+	catchingUp  bool                   // copying the state of a read quorum, not voting in quorums until done
+	catchUpSeqs map[int32]int32        // next chunk expected from each peer asked for its state
+	catchUpDone map[int32]bool         // peers that sent all of it
+	catchUpAt   time.Time              // when to ask again the peers that did not, if no chunk arrives
+	catchUpOut  map[int32]*catchUpSend // transfers to the peers catching up, a chunk sent to each per tick
+
+	timeout          time.Duration // wait for a quorum before retransmitting a phase
+	maxRetries       int           // retransmissions of a phase before failing the client request
+	nextTimeoutCheck time.Time
+
+	nextRanking time.Time // when to reorder the peers by beacon round trip time
+
+	// quorum sizes, counting the replica coordinating the phase
+	quorumMode    string
+	topology      *Topology
+	readQuorum    int // ABD get phase and RMWGet
+	writeQuorum   int // ABD set phase
+	prepareQuorum int // RMW phase 1 (Prepare)
+	acceptQuorum  int // RMW phase 2 (RMWSet)
+
+	epoch           int32  // configuration of the group, set by the master
+	members         []bool // replicas counted in quorums, by id
+	oldMembers      []bool // members of the previous epoch while switching from it, nil otherwise
+	reconfigureChan chan *reconfiguration
+
+	leaseDuration    time.Duration                    // read leases are off if 0
+	leaseSeq         int32                            // latest lease request
+	leaseSentAt      time.Time                        // when it was sent
+	leaseGrants      map[int32]bool                   // peers that granted it
+	leaseUntil       time.Time                        // when the lease held by this leader expires
+	leaseEpoch       int32                            // lease periods without a gap
+	confirmed        map[state.Key]pineappleproto.Tag // latest tag of keys, as confirmed during the lease
+	leaseHolder      int32                            // leader this replica granted a lease to
+	leaseHolderUntil time.Time                        // when that lease expires
+
+	keyLeaseDuration  time.Duration                     // leases on keys are off if 0
+	keyLeases         map[state.Key]map[int32]time.Time // leases granted on keys, with their expiry by holder
+	heldKeyLeases     map[state.Key]keyLease            // leases on keys held by this replica
+	nextKeyLeaseSweep time.Time
+	readStats         map[state.Key]*readCount // GETs received since the last report, by key
+	nextReadStats     time.Time
+
+	coded     *erasure.Code           // values are stored as fragments of this code, replicated if nil
+	codedGC   int                     // finalized versions of a key kept besides the latest one
+	fragments map[state.Key]*codedKey // fragments stored in coded mode
+
+	tombstones         map[state.Key]tombstone // tombstones stored, checked once their grace period is over
+	collectedUpTo      int                     // highest timestamp of a collected tombstone, later writes are tagged above it
+	gcSeq              int32                   // latest tombstone check
+	gcCheck            *tombstoneCheck         // check waiting for replies, nil if none
+	nextTombstoneSweep time.Time
+
+	scans   map[int32]*scanOp // quorum scans in progress
+	crtScan int32             // next scan id
+
+	elect         bool      // the replicas elect the RMW leader, instead of the master appointing it
+	masters       []string  // told the elected leader, for the clients
+	votedFor      int32     // replica promised in the latest leader epoch, -1 if none
+	electionAt    time.Time // when to stand for election, unless a leader is heard from first
+	nextHeartbeat time.Time
+	heartbeatChan chan fastrpc.Serializable
+	heartbeatRPC  uint8
 }
 
 type Instance struct {
@@ -71,6 +223,10 @@ type Instance struct {
 	initialTag      pineappleproto.Tag
 	rmwId           int32
 	receivedRMW     pineappleproto.Payload
+	oldValue        state.Value            // value the RMW read before modifying it
+	payload         pineappleproto.Payload // value-tag pair read or written by an ABD operation
+	leaseEpoch      int32                  // lease held by the coordinator when the operation started, -1 if none
+	setAccepted     bool                   // has the RMWSet payload been accepted
 	receivedData    []*pineappleproto.GetReply
 	receivedRMWData []pineappleproto.Payload
 	ballot          int32
@@ -82,21 +238,81 @@ type LeaderBookkeeping struct {
 	clientProposals []*genericsmr.Propose
 	maxRecvBallot   int32
 	hasMaxTag       map[int32]bool
-	getOKs          int
-	setOKs          int
 	getDone         bool // has get phase been completed
 	prepareOKs      int
-	rmwGetOKs       int
-	rmwSetOKs       int
 	rmwGetDone      bool // has rmwGet phase been completed
 	nacks           int
 	completed       bool
+	replied         map[int32]bool      // peers that answered the current phase
+	oks             map[int32]bool      // peers that acknowledged the current phase
+	deadline        time.Time           // when to retransmit the current phase
+	retries         int                 // retransmissions of the current phase
+	leaseHolders    map[int32]time.Time // leases reported by peers, the holders must acknowledge the operation
+	started         time.Time           // when the operation started
+	keyGrants       map[int32]bool      // peers that granted a lease on the key read
+	keyLease        time.Duration       // shortest of those leases
+	codedPhase      uint8               // phase of a coded operation
+	value           []byte              // value written by a coded operation
+	encoded         [][]byte            // its fragments, one per replica
+	fragments       map[int][]byte      // fragments collected by a coded read, by replica
+	fragmentSize    int                 // bytes of the value they code
+}
+
+// Phase 1 bookkeeping of a replica taking over as the RMW leader
+type TakeoverBookkeeping struct {
+	ballot        int32
+	fromInstance  int32          // first RMW instance covered by the prepare
+	promised      map[int32]bool // peers that promised the ballot
+	refused       map[int32]bool // peers that promised a higher ballot
+	maxRecvBallot int32
+	accepted      map[int32]pineappleproto.AcceptedRMW // highest ballot RMW reported for each instance
+	queued        []*genericsmr.Propose                // RMW proposals received while preparing
+}
+
+// Options of a replica, set from the flags of the server
+type Config struct {
+	Id           int
+	Shard        int
+	PeerAddrList []string
+	Thrifty      bool // send each phase to the fastest quorum only
+	Exec         bool
+	Dreply       bool // reply to clients once their command is executed
+	Beacon       bool
+	Durable      bool // log to the stable store
+	Recovering   bool // rebuild the state from the stable store of a previous run
+
+	Timeout    time.Duration // wait for a quorum before retransmitting a phase
+	MaxRetries int           // retransmissions of a phase before failing the request
+
+	QuorumMode    string
+	Topology      *Topology
+	ReadQuorum    int // 0 for a majority, as the other quorum sizes
+	WriteQuorum   int
+	PrepareQuorum int
+	AcceptQuorum  int
+
+	LeaseDuration    time.Duration // read lease of the RMW leader, 0 disables it
+	KeyLeaseDuration time.Duration // read leases on keys, 0 disables them
+	CodedK           int           // k of the k-of-N code storing the values, 0 replicates them
+	CodedGC          int           // finalized versions of a key kept besides the latest one, in coded mode
+
+	Group   *masterproto.ReconfigureArgs // configuration of the group when the replica starts, if reconfigured
+	Joining bool                         // copy the state of the group before voting
+	Elect   bool                         // elect the RMW leader rather than the master appointing it
+	Masters []string                     // addresses of the masters, told the elected leaders
+}
+
+func NewReplica(c *Config) *Replica {
+	r := newReplica(c)
+	go r.Run()
+	return r
 }
 
-func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica {
+// The replica, without running it
+func newReplica(c *Config) *Replica {
 	// extends a normal replica
 	r := &Replica{
-		genericsmr.NewReplica(id, peerAddrList, exec, dreply),
+		genericsmr.NewReplica(c.Id, c.Shard, c.PeerAddrList, c.Thrifty, c.Exec, c.Dreply, c.Durable, c.Recovering),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
@@ -114,17 +330,166 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 		0,
 		0,
 
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan int32, 10),
+		make(chan int32, 10),
+		make(chan bool, 10),
+		0,
+		0,
+		0,
+
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+		0,
+
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+		0,
+		0,
+
 		false,
 		false,
-		map[int]pineappleproto.Payload{},
-		make([]*Instance, 20*1024*1024),
+		map[state.Key]pineappleproto.Payload{},
+		keyindex.New(),
+		make(map[int32]*Instance),
 		0,
 		0,
 
 		false,
 		0,
 		-1,
-		make([]*Instance, 20*1024*1024),
+		-1,
+		make(map[int32]*Instance),
+
+		nil,
+
+		-1,
+		time.Time{},
+		0,
+
+		nil,
+		c.Recovering,
+		false,
+		nil,
+		0,
+
+		c.Recovering || c.Joining,
+		make(map[int32]int32),
+		make(map[int32]bool),
+		time.Time{},
+		make(map[int32]*catchUpSend),
+
+		c.Timeout,
+		c.MaxRetries,
+		time.Time{},
+
+		time.Time{},
+
+		c.QuorumMode,
+		c.Topology,
+		c.ReadQuorum,
+		c.WriteQuorum,
+		c.PrepareQuorum,
+		c.AcceptQuorum,
+
+		0,
+		allMembers(len(c.PeerAddrList)),
+		nil,
+		make(chan *reconfiguration, 10),
+
+		c.LeaseDuration,
+		0,
+		time.Time{},
+		map[int32]bool{},
+		time.Time{},
+		0,
+		map[state.Key]pineappleproto.Tag{},
+		-1,
+		time.Time{},
+
+		c.KeyLeaseDuration,
+		make(map[state.Key]map[int32]time.Time),
+		make(map[state.Key]keyLease),
+		time.Time{},
+		make(map[state.Key]*readCount),
+		time.Time{},
+
+		nil,
+		c.CodedGC,
+		make(map[state.Key]*codedKey),
+
+		make(map[state.Key]tombstone),
+		0,
+		0,
+		nil,
+		time.Time{},
+
+		make(map[int32]*scanOp),
+		0,
+
+		c.Elect,
+		c.Masters,
+		-1,
+		time.Time{},
+		time.Time{},
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+	}
+	r.checkCoded(c.CodedK) // before the unset quorum sizes are replaced
+	r.checkQuorums()
+	if c.Group != nil && c.Group.Epoch > 0 {
+		// the group was reconfigured before the replica started
+		if err := r.checkReconfigurable(); err != nil {
+			log.Fatal(err)
+		}
+		if err := r.applyConfig(c.Group); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// thrifty replicas pick their quorums by round trip time
+	r.Beacon = c.Beacon || c.Thrifty
+
+	if !c.Recovering {
+		// a snapshot left by a previous run must not be replayed with the new log
+		os.Remove(r.snapshotFile())
+	}
+	if r.Durable {
+		r.stableWriter = bufio.NewWriter(r.StableStore)
+	}
+	if c.Recovering {
+		r.recover()
 	}
 
 	// ABD
@@ -138,8 +503,38 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 	r.rmwGetReplyRPC = r.RegisterRPC(new(pineappleproto.RMWGetReply), r.rmwGetReplyChan)
 	r.rmwSetRPC = r.RegisterRPC(new(pineappleproto.RMWSet), r.rmwSetChan)
 	r.rmwSetReplyRPC = r.RegisterRPC(new(pineappleproto.RMWSetReply), r.rmwSetReplyChan)
-
-	go r.Run()
+	r.prepareRPC = r.RegisterRPC(new(pineappleproto.Prepare), r.prepareChan)
+	r.prepareReplyRPC = r.RegisterRPC(new(pineappleproto.PrepareReply), r.prepareReplyChan)
+
+	// State transfer
+	r.catchUpRPC = r.RegisterRPC(new(pineappleproto.CatchUp), r.catchUpChan)
+	r.catchUpChunkRPC = r.RegisterRPC(new(pineappleproto.CatchUpChunk), r.catchUpChunkChan)
+
+	// Read leases
+	r.leaseRequestRPC = r.RegisterRPC(new(pineappleproto.LeaseRequest), r.leaseRequestChan)
+	r.leaseGrantRPC = r.RegisterRPC(new(pineappleproto.LeaseGrant), r.leaseGrantChan)
+	r.leaseReleaseRPC = r.RegisterRPC(new(pineappleproto.LeaseRelease), r.leaseReleaseChan)
+
+	// Erasure-coded ABD
+	r.codedQueryRPC = r.RegisterRPC(new(pineappleproto.CodedQuery), r.codedQueryChan)
+	r.codedQueryReplyRPC = r.RegisterRPC(new(pineappleproto.CodedQueryReply), r.codedQueryReplyChan)
+	r.codedWriteRPC = r.RegisterRPC(new(pineappleproto.CodedWrite), r.codedWriteChan)
+	r.codedWriteReplyRPC = r.RegisterRPC(new(pineappleproto.CodedWriteReply), r.codedWriteReplyChan)
+	r.codedFinalizeRPC = r.RegisterRPC(new(pineappleproto.CodedFinalize), r.codedFinalizeChan)
+	r.codedFinalizeReplyRPC = r.RegisterRPC(new(pineappleproto.CodedFinalizeReply), r.codedFinalizeReplyChan)
+
+	// Tombstone garbage collection
+	r.tombstoneCheckRPC = r.RegisterRPC(new(pineappleproto.TombstoneCheck), r.tombstoneCheckChan)
+	r.tombstoneCheckReplyRPC = r.RegisterRPC(new(pineappleproto.TombstoneCheckReply), r.tombstoneCheckReplyChan)
+
+	// Quorum scans
+	r.scanQueryRPC = r.RegisterRPC(new(pineappleproto.ScanQuery), r.scanQueryChan)
+	r.scanQueryReplyRPC = r.RegisterRPC(new(pineappleproto.ScanQueryReply), r.scanQueryReplyChan)
+	r.scanWriteBackRPC = r.RegisterRPC(new(pineappleproto.ScanWriteBack), r.scanWriteBackChan)
+	r.scanWriteBackReplyRPC = r.RegisterRPC(new(pineappleproto.ScanWriteBackReply), r.scanWriteBackReplyChan)
+
+	// Leader election
+	r.heartbeatRPC = r.RegisterRPC(new(pineappleproto.Heartbeat), r.heartbeatChan)
 
 	return r
 }
@@ -164,39 +559,67 @@ func (r *Replica) isLargerTag(currentTag pineappleproto.Tag, receivedTag pineapp
 	return false
 }
 
-// Reply to client during ABD
+// Store the value-tag pair of a key, indexing the key if it is new
+func (r *Replica) setData(key state.Key, payload pineappleproto.Payload) {
+	if _, present := r.data[key]; !present {
+		r.keys.Insert(key)
+	}
+	r.data[key] = payload
+}
+
+// Reply to client during ABD, once the value this replica stored for the operation is durable.
+// The instance is freed, later replies from peers are ignored
 func (r *Replica) replyClient(instance int32) {
 	inst := r.instanceSpace[instance]
+	delete(r.instanceSpace, instance)
+	r.confirm(inst, inst.cmds[0].K, inst.payload.Tag)
+	if inst.cmds[0].Op == state.GET {
+		r.acquireKeyLease(inst, inst.cmds[0].K, inst.payload.Tag)
+	}
 	if inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
 		propreply := &genericsmrproto.ProposeReplyTS{
 			OK:        TRUE,
+			Found:     found(inst.payload),
 			CommandId: inst.lb.clientProposals[0].CommandId,
-			Value:     state.NIL,
+			Value:     inst.payload.Value,
+			TagTS:     int64(inst.payload.Tag.Timestamp),
+			TagID:     int32(inst.payload.Tag.ID),
 			Timestamp: inst.lb.clientProposals[0].Timestamp}
-		r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
+		writer := inst.lb.clientProposals[0].Reply
 		inst.lb.completed = true
+		r.replyAfterSync(func() { r.ReplyProposeTS(propreply, writer) })
 	}
 }
 
+func (r *Replica) replyPrepare(replicaId int32, reply *pineappleproto.PrepareReply) {
+	reply.LeaderEpoch = r.leaderEpoch
+	r.SendMsg(replicaId, r.prepareReplyRPC, reply)
+}
+
 func (r *Replica) replyRMWGet(replicaId int32, reply *pineappleproto.RMWGetReply) {
+	reply.LeaderEpoch = r.leaderEpoch
 	r.SendMsg(replicaId, r.rmwGetReplyRPC, reply)
 }
 
-func (r *Replica) replyRMWSet(replicaId int32, reply *pineappleproto.RMWSetReply) {
+func (r *Replica) replyRMWSet(replicaId int32, key state.Key, reply *pineappleproto.RMWSetReply) {
+	reply.Leases = r.grantedLeases(key)
+	reply.LeaderEpoch = r.leaderEpoch
 	r.SendMsg(replicaId, r.rmwSetReplyRPC, reply)
 }
 
 func (r *Replica) replyGet(replicaId int32, reply *pineappleproto.GetReply) {
+	reply.Leases = r.grantedLeases(reply.Key)
 	r.SendMsg(replicaId, r.getReplyRPC, reply)
 }
 
-func (r *Replica) replySet(replicaId int32, reply *pineappleproto.SetReply) {
+func (r *Replica) replySet(replicaId int32, key state.Key, reply *pineappleproto.SetReply) {
+	reply.Leases = r.grantedLeases(key)
 	r.SendMsg(replicaId, r.setReplyRPC, reply)
 }
 
 // Get Phase (Coordinator)
 // Broadcasts query to all replicas to get value-tag pairs
-func (r *Replica) bcastGet(instance int32, write bool, key int) {
+func (r *Replica) bcastGet(instance int32, write bool, key state.Key) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Prepare broadcast failed: ", err)
@@ -212,18 +635,8 @@ func (r *Replica) bcastGet(instance int32, write bool, key int) {
 
 	args := &pineappleproto.Get{ReplicaID: r.Id, Instance: instance,
 		Write: wr, Key: key, Payload: data}
-	replicaCount := r.N - 1
-	q := r.Id
-	// Send to each connected replica
-	for sentCount := 0; sentCount < replicaCount; sentCount++ {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-
+	// Send to each connected replica, fastest first
+	for _, q := range r.phasePeers(READ_QUORUM, nil, r.leaseHoldersFor(r.instanceSpace[instance], key)) {
 		r.SendMsg(q, r.getRPC, args)
 	}
 }
@@ -239,7 +652,8 @@ func (r *Replica) handleGet(get *pineappleproto.Get) {
 	if get.Write == 0 {
 		if !doesExist || r.isLargerTag(data.Tag, get.Payload.Tag) {
 			// Replica has smaller tag, return received value
-			r.data[get.Key] = get.Payload
+			r.setData(get.Key, get.Payload)
+			r.recordSet(get.Key, get.Payload)
 			getReply = &pineappleproto.GetReply{ReplicaID: r.Id, Instance: get.Instance,
 				OK: ok, Write: get.Write, Key: get.Key, Payload: get.Payload,
 			}
@@ -248,36 +662,47 @@ func (r *Replica) handleGet(get *pineappleproto.Get) {
 				OK: ok, Write: get.Write, Key: get.Key, Payload: data,
 			}
 		}
+		getReply.KeyLease = r.grantKeyLease(get.ReplicaID, get.Key)
 	} else { // init with empty payload
 		getReply = &pineappleproto.GetReply{ReplicaID: r.Id, Instance: get.Instance, OK: ok,
 			Write: get.Write, Key: get.Key, Payload: pineappleproto.Payload{},
 		}
 	}
 
-	r.replyGet(get.ReplicaID, getReply)
+	r.replyAfterSync(func() { r.replyGet(get.ReplicaID, getReply) })
 }
 
 // Chooses the most recent vt pair after waiting for majority ACKs (or increment timestamp if write)
 func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
 	inst := r.instanceSpace[getReply.Instance]
 	key := getReply.Key
+	if inst == nil { // operation already completed
+		return
+	}
 	if inst.lb.getDone { // avoid proceeding to set phase several times
 		return
 	}
+	if inst.lb.replied[getReply.ReplicaID] { // retransmitted Get answered twice
+		return
+	}
+	inst.lb.replied[getReply.ReplicaID] = true
+	r.learnLeases(inst, getReply.Leases)
+	r.learnKeyLease(inst, getReply)
 
 	r.instanceSpace[getReply.Instance].receivedData =
 		append(r.instanceSpace[getReply.Instance].receivedData, getReply)
 
 	// update local value to largest received
 	if r.isLargerTag(r.data[key].Tag, getReply.Payload.Tag) {
-		r.data[key] = getReply.Payload
+		r.setData(key, getReply.Payload)
+		r.recordSet(key, getReply.Payload)
 	}
 
 	// Send the new vt pair to all nodes after getting majority
 	if getReply.OK == TRUE {
-		inst.lb.getOKs++
+		inst.lb.oks[getReply.ReplicaID] = true
 
-		if inst.lb.getOKs+1 > r.N>>1 {
+		if r.isQuorum(READ_QUORUM, inst.lb.oks) {
 			identicalCount := 0 // keep track of the count of identical responses
 			ownTag := r.data[key].Tag
 			firstReceivedTag := r.instanceSpace[getReply.Instance].receivedData[0].Payload.Tag
@@ -301,22 +726,40 @@ func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
 			inst.lb.getDone = true                                // getPhase completed
 
 			// Optimized read; don't proceed to set if the quorum (including this node)
-			// all has the latest timestamp
-			if (getReply.Write == 0) && (identicalCount == receivedDataCount+1) {
+			// all has the latest timestamp, and is large enough to be a write quorum
+			if (getReply.Write == 0) && (identicalCount == receivedDataCount+1) &&
+				r.isQuorum(WRITE_QUORUM, inst.lb.oks) && r.leaseHoldersAcked(inst, inst.lb.oks) {
+				inst.payload = r.data[key]
 				r.replyClient(getReply.Instance)
 				return
 			}
 
 			write := false
 			inst.status = PREPARED
+			r.startPhase(inst)
+			for q := range inst.lb.hasMaxTag {
+				// not sent the Set, already counted as acknowledged
+				inst.lb.replied[q] = true
+				inst.lb.oks[q] = true
+			}
 			inst.lb.nacks = 0
 			// If writing, choose a higher unique timestamp (by adjoining replica ID with Timestamp++)
 			if getReply.Write == 1 {
 				write = true
-				newTag := pineappleproto.Tag{Timestamp: r.data[key].Tag.Timestamp + 1, ID: int(r.Id)}
-				r.data[key] = pineappleproto.Payload{Tag: newTag, Value: r.data[key].Value}
+				if inst.cmds[0].Op == state.DELETE {
+					r.setData(key, pineappleproto.Payload{Tag: r.nextTag(key), Value: state.NIL, Deleted: TRUE})
+				} else {
+					r.setData(key, pineappleproto.Payload{Tag: r.nextTag(key), Value: inst.cmds[0].V})
+				}
+				r.recordSet(key, r.data[key])
+			}
+			inst.payload = r.data[key]
+
+			// A read is done if a write quorum (including this node) already has the largest tag
+			if !write && r.isQuorum(WRITE_QUORUM, inst.lb.hasMaxTag) && r.leaseHoldersAcked(inst, inst.lb.hasMaxTag) {
+				r.replyClient(getReply.Instance)
+				return
 			}
-			r.sync()
 			r.bcastSet(getReply.Instance, write, key, r.data[key])
 		}
 	}
@@ -324,7 +767,7 @@ func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
 
 // Set Phase (Coordinator)
 // Broadcasts to all replicas to write sent payload
-func (r *Replica) bcastSet(instance int32, write bool, key int, payload pineappleproto.Payload) {
+func (r *Replica) bcastSet(instance int32, write bool, key state.Key, payload pineappleproto.Payload) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Prepare bcast failed:", err)
@@ -339,26 +782,10 @@ func (r *Replica) bcastSet(instance int32, write bool, key int, payload pineappl
 		Key: key, Payload: payload,
 	}
 
-	replicaCount := r.N - 1
-	q := r.Id
-
-	// Send to each connected replica
-	for sentCount := 0; sentCount < replicaCount; sentCount++ {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-
-		if !write {
-			// don't message replicas that already have the largest tag
-			if r.instanceSpace[instance].lb.hasMaxTag[q] {
-				continue
-			}
-		}
-
+	// Send to each connected replica, fastest first
+	// don't message replicas that already have the largest tag, they count towards the quorum
+	inst := r.instanceSpace[instance]
+	for _, q := range r.phasePeers(WRITE_QUORUM, inst.lb.hasMaxTag, r.leaseHoldersFor(inst, key)) {
 		r.SendMsg(q, r.setRPC, args)
 	}
 }
@@ -370,26 +797,38 @@ func (r *Replica) handleSet(set *pineappleproto.Set) {
 
 	// Sets received payload if largest tag seen
 	if r.isLargerTag(r.data[set.Key].Tag, set.Payload.Tag) {
-		r.data[set.Key] = set.Payload
+		r.setData(set.Key, set.Payload)
+		r.recordSet(set.Key, set.Payload)
 	}
 
-	setReply = &pineappleproto.SetReply{Instance: set.Instance}
-	r.replySet(set.ReplicaID, setReply)
+	setReply = &pineappleproto.SetReply{ReplicaID: r.Id, Instance: set.Instance}
+	r.replyAfterSync(func() { r.replySet(set.ReplicaID, set.Key, setReply) })
 }
 
 // Response handler for Set request on nodes
 func (r *Replica) handleSetReply(setReply *pineappleproto.SetReply) {
 	inst := r.instanceSpace[setReply.Instance]
-	inst.lb.setOKs++
+	if inst == nil { // operation already completed
+		return
+	}
+	if inst.lb.replied[setReply.ReplicaID] { // retransmitted Set answered twice
+		return
+	}
+	inst.lb.replied[setReply.ReplicaID] = true
+	inst.lb.oks[setReply.ReplicaID] = true
+	r.learnLeases(inst, setReply.Leases)
 
-	// Wait for a majority of acknowledgements
-	// Either wait for a quorum or for the number of replicas messages, whichever is smaller
-	if (inst.lb.setOKs+1 > len(inst.lb.hasMaxTag) && len(inst.lb.hasMaxTag) < r.N>>1 && len(inst.lb.hasMaxTag) > 0) ||
-		inst.lb.setOKs+1 > r.N>>1 {
+	if r.setPhaseDone(inst) {
 		r.replyClient(setReply.Instance)
 	}
 }
 
+// Wait for a write quorum of acknowledgements, including those of the leaseholders.
+// Replicas that already had the largest tag were not sent the payload and count as acknowledged
+func (r *Replica) setPhaseDone(inst *Instance) bool {
+	return r.isQuorum(WRITE_QUORUM, inst.lb.oks) && r.leaseHoldersAcked(inst, inst.lb.oks)
+}
+
 var pRMWGet pineappleproto.RMWGet
 
 func (r *Replica) bcastRMWGet(instance int32, ballot int32, command []state.Command) {
@@ -402,98 +841,139 @@ func (r *Replica) bcastRMWGet(instance int32, ballot int32, command []state.Comm
 	pRMWGet.Instance = instance
 	pRMWGet.Ballot = ballot
 	pRMWGet.Command = command
+	pRMWGet.DoneUpTo = r.rmwDoneUpTo
+	pRMWGet.LeaderEpoch = r.leaderEpoch
 	args := &pRMWGet
 
-	n := r.N - 1
-	q := r.Id
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-		sent++
+	for _, q := range r.phasePeers(READ_QUORUM, nil, nil) {
 		r.SendMsg(q, r.rmwGetRPC, args)
 	}
 }
 
 func (r *Replica) handleRMWGet(rmwGet *pineappleproto.RMWGet) {
-	inst := r.instanceSpace[rmwGet.Instance]
-	key := int(rmwGet.Command[0].K)
+	if rmwGet.Instance <= r.rmwExecutedUpTo { // committed and freed
+		return
+	}
+	if r.fenced(rmwGet.LeaderEpoch) {
+		r.rejectRMWGet(rmwGet, r.defaultBallot)
+		return
+	}
+	inst := r.pendingRMWs[rmwGet.Instance]
+	key := rmwGet.Command[0].K
 
 	var rmwGetReply *pineappleproto.RMWGetReply
 
 	if inst == nil {
 		if rmwGet.Ballot < r.defaultBallot {
-			panic("outdated ballot received")
+			r.rejectRMWGet(rmwGet, r.defaultBallot)
+			return
 		} else {
-			r.instanceSpace[rmwGet.Instance] = &Instance{
+			r.pendingRMWs[rmwGet.Instance] = &Instance{
+				rmwId:  rmwGet.Instance,
 				cmds:   rmwGet.Command,
 				ballot: rmwGet.Ballot,
 				status: ACCEPTED,
 				lb:     nil,
 			}
-			rmwGetReply = &pineappleproto.RMWGetReply{Instance: rmwGet.Instance, Ballot: r.defaultBallot, Key: key}
 		}
-	} else if rmwGet.Ballot < inst.ballot {
-		panic("outdated ballot received")
+	} else if rmwGet.Ballot < inst.ballot || rmwGet.Ballot < r.defaultBallot {
+		r.rejectRMWGet(rmwGet, r.promisedBallot(inst))
+		return
 	} else {
 		// reordered ACCEPT
-		r.instanceSpace[rmwGet.Instance].cmds = rmwGet.Command
-		if r.instanceSpace[rmwGet.Instance].status != COMMITTED {
-			r.instanceSpace[rmwGet.Instance].status = ACCEPTED
+		if rmwGet.Ballot > inst.ballot {
+			// a new leader is running the RMW again, any older payload was not chosen
+			inst.setAccepted = false
 		}
-		data := r.data[key]
-		rmwGetReply = &pineappleproto.RMWGetReply{Instance: rmwGet.Instance, Ballot: r.defaultBallot, Key: key, Payload: data}
+		inst.cmds = rmwGet.Command
+		inst.ballot = rmwGet.Ballot
+		if inst.status != COMMITTED {
+			inst.status = ACCEPTED
+		}
+	}
+	r.acceptedBallot(rmwGet.Instance, rmwGet.Ballot)
+	r.learnDoneUpTo(rmwGet.DoneUpTo)
+	r.recordRMW(r.pendingRMWs[rmwGet.Instance])
+	r.sync()
+
+	data := r.data[key]
+	rmwGetReply = &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: TRUE, Ballot: rmwGet.Ballot, Key: key, Payload: data}
+	r.replyRMWGet(rmwGet.LeaderId, rmwGetReply)
+}
+
+// Highest ballot this acceptor has promised, or accepted for the instance
+func (r *Replica) promisedBallot(inst *Instance) int32 {
+	if inst.ballot > r.defaultBallot {
+		return inst.ballot
 	}
+	return r.defaultBallot
+}
 
+// NACK an RMWGet from a leader with an outdated ballot, telling it the ballot to beat
+func (r *Replica) rejectRMWGet(rmwGet *pineappleproto.RMWGet, ballot int32) {
+	rmwGetReply := &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: FALSE, Ballot: ballot,
+		Key: rmwGet.Command[0].K}
 	r.replyRMWGet(rmwGet.LeaderId, rmwGetReply)
 }
 
 // Chooses the most recent vt pair after waiting for majority ACKs (or increment timestamp if write)
 func (r *Replica) handleRMWGetReply(rmwGetReply *pineappleproto.RMWGetReply) {
-	inst := r.instanceSpace[rmwGetReply.Instance]
-	if inst.lb.rmwGetDone { // avoid calling handleRMWSet more than once
+	if r.learnLeaderEpoch(rmwGetReply.LeaderEpoch) {
 		return
 	}
+	inst := r.pendingRMWs[rmwGetReply.Instance]
+	if inst == nil || inst.lb == nil || inst.lb.rmwGetDone || staleNack(inst, rmwGetReply.OK, rmwGetReply.Ballot) {
+		return
+	}
+	if inst.lb.replied[rmwGetReply.ReplicaID] { // retransmitted RMWGet answered twice
+		return
+	}
+	inst.lb.replied[rmwGetReply.ReplicaID] = true
+	if rmwGetReply.OK == FALSE {
+		r.handleRMWNack(inst, rmwGetReply.Ballot)
+		return
+	}
+	if rmwGetReply.Ballot != inst.ballot {
+		// reply to a ballot this replica is no longer running
+		return
+	}
+	inst.receivedRMWData = append(inst.receivedRMWData, rmwGetReply.Payload)
 
-	r.instanceSpace[rmwGetReply.Instance].receivedRMWData =
-		append(r.instanceSpace[rmwGetReply.Instance].receivedRMWData, rmwGetReply.Payload)
-
-	inst.lb.rmwGetOKs++
+	inst.lb.oks[rmwGetReply.ReplicaID] = true
 
-	if inst.lb.rmwGetOKs+1 > r.N>>1 { // quorom of messages received
+	if r.isQuorum(READ_QUORUM, inst.lb.oks) { // quorom of messages received
 		key := rmwGetReply.Key
 
 		// Find the largest received timestamp
-		for _, data := range r.instanceSpace[rmwGetReply.Instance].receivedRMWData {
+		for _, data := range inst.receivedRMWData {
 			if r.isLargerTag(r.data[key].Tag, data.Tag) { // received value has larger tag
-				r.data[key] = rmwGetReply.Payload
+				r.setData(key, data)
 			}
 		}
 
-		r.instanceSpace[rmwGetReply.Instance].receivedRMWData = nil // clear slice, no longer needed
-		inst.lb.rmwGetDone = true                                   // rmwGet phase completed
+		inst.receivedRMWData = nil // clear slice, no longer needed
+		inst.lb.rmwGetDone = true  // rmwGet phase completed
 
 		inst.lb.nacks = 0
 		// If writing, choose a higher unique timestamp (by adjoining replica ID with Timestamp++)
-		newTag := pineappleproto.Tag{Timestamp: r.data[key].Tag.Timestamp + 1, ID: int(r.Id)}
-		newValue := r.data[key].Value + 1 // TODO: update RMW modify
-		r.data[key] = pineappleproto.Payload{Tag: newTag, Value: newValue}
-
-		r.recordInstanceMetadata(r.instanceSpace[rmwGetReply.Instance])
-		r.recordCommands(r.instanceSpace[rmwGetReply.Instance].cmds)
+		newTag := r.nextTag(key)
+		inst.oldValue = state.Value(r.data[key].Value)
+		newValue := inst.cmds[0].Modify(inst.oldValue)
+		r.setData(key, pineappleproto.Payload{Tag: newTag, Value: newValue})
+		inst.receivedRMW = r.data[key]
+		inst.setAccepted = true
+		r.startPhase(inst)
+
+		r.recordRMW(inst)
 		r.sync()
 
-		r.bcastRMWSet(rmwGetReply.Instance, rmwGetReply.Ballot, key)
+		r.bcastRMWSet(rmwGetReply.Instance, inst.ballot, key, inst.receivedRMW)
 	}
 }
 
 var pRMWSet pineappleproto.RMWSet
 
-func (r *Replica) bcastRMWSet(instance int32, ballot int32, key int) {
+func (r *Replica) bcastRMWSet(instance int32, ballot int32, key state.Key, payload pineappleproto.Payload) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
@@ -502,193 +982,982 @@ func (r *Replica) bcastRMWSet(instance int32, ballot int32, key int) {
 	pRMWSet.LeaderId = r.Id
 	pRMWSet.Instance = instance
 	pRMWSet.Ballot = ballot
-	pRMWSet.Command = r.instanceSpace[instance].cmds
+	pRMWSet.Command = r.pendingRMWs[instance].cmds
 	pRMWSet.Key = key
-	pRMWSet.Payload = r.data[key]
+	pRMWSet.Payload = payload
+	pRMWSet.DoneUpTo = r.rmwDoneUpTo
+	pRMWSet.LeaderEpoch = r.leaderEpoch
 	args := &pRMWSet
 
-	n := r.N - 1
-	q := r.Id
-
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-		sent++
+	for _, q := range r.phasePeers(ACCEPT_QUORUM, nil, r.leaseHoldersFor(r.pendingRMWs[instance], key)) {
 		r.SendMsg(q, r.rmwSetRPC, args)
 	}
 }
 
 func (r *Replica) handleRMWSet(rmwSet *pineappleproto.RMWSet) {
-	inst := r.instanceSpace[rmwSet.Instance]
+	if rmwSet.Instance <= r.rmwExecutedUpTo { // committed and freed
+		return
+	}
+	if r.fenced(rmwSet.LeaderEpoch) {
+		r.rejectRMWSet(rmwSet, r.defaultBallot)
+		return
+	}
+	inst := r.pendingRMWs[rmwSet.Instance]
 
 	var rmwSetReply *pineappleproto.RMWSetReply
 
 	if inst == nil {
 		if rmwSet.Ballot < r.defaultBallot {
-			panic("outdated ballot received")
+			r.rejectRMWSet(rmwSet, r.defaultBallot)
+			return
 		} else {
-			r.instanceSpace[rmwSet.Instance] = &Instance{
+			r.pendingRMWs[rmwSet.Instance] = &Instance{
+				rmwId:  rmwSet.Instance,
 				cmds:   rmwSet.Command,
 				ballot: rmwSet.Ballot,
 				status: ACCEPTED,
 				lb:     nil,
 			}
-			inst = r.instanceSpace[rmwSet.Instance]
-			rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
+			inst = r.pendingRMWs[rmwSet.Instance]
+			rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: rmwSet.Ballot}
 		}
-	} else if inst.ballot > rmwSet.Ballot {
-		panic("outdated ballot received")
+	} else if inst.ballot > rmwSet.Ballot || r.defaultBallot > rmwSet.Ballot {
+		r.rejectRMWSet(rmwSet, r.promisedBallot(inst))
+		return
 	} else if inst.ballot < rmwSet.Ballot {
 		inst.cmds = rmwSet.Command
 		inst.ballot = rmwSet.Ballot
 		inst.status = ACCEPTED
-		rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
+		rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: rmwSet.Ballot}
 	} else {
 		// reordered ACCEPT
-		r.instanceSpace[rmwSet.Instance].cmds = rmwSet.Command
-		if r.instanceSpace[rmwSet.Instance].status != COMMITTED {
-			r.instanceSpace[rmwSet.Instance].status = ACCEPTED
+		inst.cmds = rmwSet.Command
+		if inst.status != COMMITTED {
+			inst.status = ACCEPTED
 		}
-		rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
+		rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: rmwSet.Ballot}
 	}
+	r.acceptedBallot(rmwSet.Instance, rmwSet.Ballot)
+	r.learnDoneUpTo(rmwSet.DoneUpTo)
+
 	inst.receivedRMW = rmwSet.Payload // store received object in instance space
+	inst.setAccepted = true
 	if r.isLargerTag(r.data[rmwSet.Key].Tag, inst.receivedRMW.Tag) {
-		r.data[rmwSet.Key] = inst.receivedRMW
+		r.setData(rmwSet.Key, inst.receivedRMW)
 	}
+	r.recordRMW(inst)
+	r.sync()
+
+	r.replyRMWSet(rmwSet.LeaderId, rmwSet.Key, rmwSetReply)
+}
 
-	r.replyRMWSet(rmwSet.LeaderId, rmwSetReply)
+// NACK an RMWSet from a leader with an outdated ballot, telling it the ballot to beat
+func (r *Replica) rejectRMWSet(rmwSet *pineappleproto.RMWSet, ballot int32) {
+	rmwSetReply := &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: FALSE, Ballot: ballot}
+	r.replyRMWSet(rmwSet.LeaderId, rmwSet.Key, rmwSetReply)
 }
 
 // Response handler for Set request on nodes
 func (r *Replica) handleRMWSetReply(rmwSetReply *pineappleproto.RMWSetReply) {
-	inst := r.instanceSpace[rmwSetReply.Instance]
-	if inst.rmwId <= r.rmwDoneUpTo { // quorum of response already received
+	if r.learnLeaderEpoch(rmwSetReply.LeaderEpoch) {
+		return
+	}
+	inst := r.pendingRMWs[rmwSetReply.Instance]
+	if inst == nil || inst.lb == nil || inst.status == COMMITTED || staleNack(inst, rmwSetReply.OK, rmwSetReply.Ballot) {
+		return
+	}
+	if inst.lb.replied[rmwSetReply.ReplicaID] { // retransmitted RMWSet answered twice
+		return
+	}
+	inst.lb.replied[rmwSetReply.ReplicaID] = true
+	if rmwSetReply.OK == FALSE {
+		r.handleRMWNack(inst, rmwSetReply.Ballot)
+		return
+	}
+	if rmwSetReply.Ballot != inst.ballot {
 		return
 	}
 
-	inst.lb.rmwSetOKs++
+	inst.lb.oks[rmwSetReply.ReplicaID] = true
+	r.learnLeases(inst, rmwSetReply.Leases)
+
+	// Wait for a quorum of acknowledgements, including those of the leaseholders
+	if r.isQuorum(ACCEPT_QUORUM, inst.lb.oks) && r.leaseHoldersAcked(inst, inst.lb.oks) {
+		r.commitRMW(inst)
+	}
+}
 
-	// Wait for a majority of acknowledgements
-	if inst.lb.rmwSetOKs+1 > r.N>>1 {
-		r.pendingRMWs[inst.rmwId] = inst
+func (r *Replica) commitRMW(inst *Instance) {
+	inst.status = COMMITTED
+	r.backoffs = 0
+	for r.pendingRMWs[r.rmwDoneUpTo+1] != nil && r.pendingRMWs[r.rmwDoneUpTo+1].status == COMMITTED {
 		r.rmwDoneUpTo++
 	}
+	r.executeRMWs()
+}
 
+// Starts waiting for the replies of a new phase of an instance coordinated by this replica
+func (r *Replica) startPhase(inst *Instance) {
+	inst.lb.replied = make(map[int32]bool)
+	inst.lb.oks = make(map[int32]bool)
+	inst.lb.deadline = time.Now().Add(r.timeout)
+	inst.lb.retries = 0
 }
 
-func (r *Replica) executeRMWs() {
-	i := int32(0)
-	for !r.Shutdown {
-		executed := false
+// Retransmits the current phase of the instances that did not reach a quorum before their deadline,
+// to the peers that have not answered, including those a thrifty replica skipped.
+// After maxRetries the client gets a failure reply
+func (r *Replica) checkTimeouts() {
+	now := time.Now()
+	r.nextTimeoutCheck = now.Add(TIMEOUT_CHECK)
+
+	for instance, inst := range r.instanceSpace {
+		if inst.lb.getDone && r.setPhaseDone(inst) {
+			// was waiting for a lease to expire
+			r.replyClient(instance)
+			continue
+		}
+		if now.Before(inst.lb.deadline) {
+			continue
+		}
+		if inst.lb.retries >= r.maxRetries {
+			if (inst.lb.getDone || inst.lb.codedPhase != CODED_QUERY) && inst.cmds[0].Op != state.GET {
+				// some replicas may already hold the value
+				r.replyFailure(inst, genericsmrproto.UNKNOWN)
+			} else {
+				r.replyFailure(inst, FALSE)
+			}
+			delete(r.instanceSpace, instance)
+			continue
+		}
+		inst.lb.retries++
+		inst.lb.deadline = now.Add(r.timeout)
+		if r.coded != nil {
+			r.resendCoded(instance, inst)
+			continue
+		}
 
-		for i <= r.rmwDoneUpTo {
-			inst := r.pendingRMWs[i]
-			if inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
-				propreply := &genericsmrproto.ProposeReplyTS{
-					OK:        TRUE,
-					CommandId: inst.lb.clientProposals[0].CommandId,
-					Value:     state.NIL,
-					Timestamp: inst.lb.clientProposals[0].Timestamp}
-				inst.lb.completed = true
-				r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
+		write := inst.cmds[0].Op != state.GET
+		wr := FALSE
+		if write {
+			wr = TRUE
+		}
+		key := inst.cmds[0].K
+		if !inst.lb.getDone {
+			payload := pineappleproto.Payload{}
+			if !write {
+				payload = r.data[key]
 			}
-			executed = true
-			i++
+			r.resend(inst, r.getRPC, &pineappleproto.Get{ReplicaID: r.Id, Instance: instance,
+				Write: wr, Key: key, Payload: payload})
+		} else {
+			r.resend(inst, r.setRPC, &pineappleproto.Set{ReplicaID: r.Id, Instance: instance,
+				Write: wr, Key: key, Payload: inst.payload})
+		}
+	}
+	r.checkScanTimeouts(now)
+
+	for instance, inst := range r.pendingRMWs {
+		if inst.lb == nil || inst.status == COMMITTED {
+			continue
+		}
+		if inst.lb.rmwGetDone && r.isQuorum(ACCEPT_QUORUM, inst.lb.oks) && r.leaseHoldersAcked(inst, inst.lb.oks) {
+			// was waiting for a lease to expire
+			r.commitRMW(inst)
+			continue
+		}
+		if now.Before(inst.lb.deadline) {
+			continue
+		}
+		if inst.lb.retries >= r.maxRetries || !r.IsLeader {
+			// keep the instance, the RMW can still be committed by this replica or the next leader
+			r.replyFailure(inst, genericsmrproto.UNKNOWN)
+		}
+		inst.lb.retries++
+		inst.lb.deadline = now.Add(r.timeout)
+		if !r.IsLeader || r.takeover != nil {
+			// the instance is proposed again under the ballot of the next leader
+			continue
 		}
 
-		if !executed {
-			time.Sleep(CLOCK)
+		if !inst.lb.rmwGetDone {
+			r.resend(inst, r.rmwGetRPC, &pineappleproto.RMWGet{LeaderId: r.Id, Instance: instance,
+				Ballot: inst.ballot, Command: inst.cmds, DoneUpTo: r.rmwDoneUpTo, LeaderEpoch: r.leaderEpoch})
+		} else {
+			r.resend(inst, r.rmwSetRPC, &pineappleproto.RMWSet{LeaderId: r.Id, Instance: instance,
+				Ballot: inst.ballot, Command: inst.cmds, Key: inst.cmds[0].K, Payload: inst.receivedRMW,
+				DoneUpTo: r.rmwDoneUpTo, LeaderEpoch: r.leaderEpoch})
 		}
 	}
 }
 
-func (r *Replica) handlePropose(propose *genericsmr.Propose) {
-	for r.instanceSpace[r.crtInstance] != nil {
-		r.crtInstance++
+// Sends the message of the current phase again, to the peers that have not answered it
+func (r *Replica) resend(inst *Instance, code uint8, msg fastrpc.Serializable) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Retransmission failed:", err)
+		}
+	}()
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() || inst.lb.replied[q] {
+			continue
+		}
+		r.SendMsg(q, code, msg)
 	}
+}
 
-	instNo := r.crtInstance
+// Orders the peers by the round trip time of their beacons, so that phases are sent to the fastest
+// ones first. Peers that are down or never answered a beacon go last
+func (r *Replica) rankPeers() {
+	r.nextRanking = time.Now().Add(RANK_INTERVAL)
 
-	cmds := make([]state.Command, 1)
-	proposals := make([]*genericsmr.Propose, 1)
-	key := int(propose.Command.K)
-	cmds[0] = propose.Command
-	proposals[0] = propose
+	peers := make([]int32, 0, r.N-1)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			peers = append(peers, q)
+		}
+	}
+	// read once, the beacons keep updating them during the sort
+	rtt := make([]float64, r.N)
+	known := make([]bool, r.N)
+	for _, q := range peers {
+		rtt[q] = r.PeerRtt(q)
+		known[q] = r.Alive[q].Load() && rtt[q] > 0.0
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		if known[peers[i]] != known[peers[j]] {
+			return known[peers[i]]
+		}
+		return rtt[peers[i]] < rtt[peers[j]]
+	})
+	r.UpdatePreferredPeerOrder(peers)
+}
 
-	// ABD
-	r.instanceSpace[instNo] = &Instance{
-		cmds:   cmds,
-		ballot: 0,
+// Tell the client its request did not complete in time: FALSE if it did not take effect,
+// genericsmrproto.UNKNOWN if it may still
+func (r *Replica) replyFailure(inst *Instance, ok uint8) {
+	if inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
+		propreply := &genericsmrproto.ProposeReplyTS{
+			OK:        ok,
+			CommandId: inst.lb.clientProposals[0].CommandId,
+			Value:     state.NIL,
+			Timestamp: inst.lb.clientProposals[0].Timestamp}
+		inst.lb.completed = true
+		r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
+	}
+}
+
+// Replies to the clients of the RMWs committed up to rmwDoneUpTo, then frees their instances.
+// Late messages for freed instances are ignored
+func (r *Replica) executeRMWs() {
+	if int(r.rmwDoneUpTo-r.rmwExecutedUpTo) > len(r.pendingRMWs) {
+		// far behind after learning the progress of another leader, most instances are missing
+		for i, inst := range r.pendingRMWs {
+			if i <= r.rmwDoneUpTo {
+				r.executeRMW(inst)
+				delete(r.pendingRMWs, i)
+			}
+		}
+		r.rmwExecutedUpTo = r.rmwDoneUpTo
+		return
+	}
+
+	for r.rmwExecutedUpTo < r.rmwDoneUpTo {
+		r.rmwExecutedUpTo++
+		if inst := r.pendingRMWs[r.rmwExecutedUpTo]; inst != nil {
+			r.executeRMW(inst)
+			delete(r.pendingRMWs, r.rmwExecutedUpTo)
+		}
+	}
+}
+
+func (r *Replica) executeRMW(inst *Instance) {
+	// instances learned from another leader were not committed by this replica
+	if inst.status == COMMITTED && inst.lb != nil && inst.cmds[0].Op != state.NONE {
+		r.confirm(inst, inst.cmds[0].K, inst.receivedRMW.Tag)
+	}
+	if inst.lb == nil || inst.lb.clientProposals == nil || !r.Dreply || inst.lb.completed {
+		return
+	}
+	if !sameCommand(inst.cmds[0], inst.lb.clientProposals[0].Command) {
+		// the next leader chose another RMW or a no-op at the instance, so the one of the client never applies
+		r.replyFailure(inst, FALSE)
+		return
+	}
+	if inst.status != COMMITTED {
+		// committed by the next leader, which alone knows the value it read
+		r.replyFailure(inst, genericsmrproto.UNKNOWN)
+		return
+	}
+	propreply := &genericsmrproto.ProposeReplyTS{
+		OK:        TRUE,
+		Found:     TRUE,
+		CommandId: inst.lb.clientProposals[0].CommandId,
+		Value:     inst.receivedRMW.Value,
+		OldValue:  inst.oldValue,
+		TagTS:     int64(inst.receivedRMW.Tag.Timestamp),
+		TagID:     int32(inst.receivedRMW.Tag.ID),
+		Timestamp: inst.lb.clientProposals[0].Timestamp}
+	inst.lb.completed = true
+	r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
+}
+
+func sameCommand(a, b state.Command) bool {
+	return a.Op == b.Op && a.K == b.K && a.Fn == b.Fn && bytes.Equal(a.V, b.V) && bytes.Equal(a.Arg, b.Arg)
+}
+
+// Whether a reply refuses an older ballot of the instance. An acceptor refuses a ballot lower than the one it
+// promised and replies with the latter, so a refusal of the current ballot is always above it. Older refusals
+// must not count against the instance proposed again since, nor mark the acceptor as having answered it
+func staleNack(inst *Instance, ok uint8, ballot int32) bool {
+	return ok == FALSE && ballot <= inst.ballot
+}
+
+// An acceptor rejected an RMW phase because it promised a higher ballot to another leader.
+// Once a quorum can no longer accept the instance, back off and run phase 1 with a higher ballot
+func (r *Replica) handleRMWNack(inst *Instance, ballot int32) {
+	if inst.status == COMMITTED {
+		return
+	}
+	inst.lb.nacks++
+	if ballot > inst.lb.maxRecvBallot {
+		inst.lb.maxRecvBallot = ballot
+	}
+	kind := READ_QUORUM
+	if inst.lb.rmwGetDone {
+		kind = ACCEPT_QUORUM
+	}
+	refused := func(q int32) bool {
+		return inst.lb.replied[q] && !inst.lb.oks[q]
+	}
+	if !r.quorumReachable(kind, refused) {
+		r.backOff(inst.lb.maxRecvBallot)
+	}
+}
+
+// Schedule a new phase 1 after a randomized, exponentially growing delay,
+// so that competing leaders do not keep preempting each other
+func (r *Replica) backOff(ballot int32) {
+	if ballot > r.retryBallot {
+		r.retryBallot = ballot
+	}
+	if r.elect {
+		// the next election, unless another replica wins it first, picks a ballot above the one that rejected
+		r.stepDown()
+		return
+	}
+	if !r.retryAt.IsZero() {
+		return // retry already scheduled
+	}
+
+	backoff := int64(BACKOFF) << r.backoffs
+	if backoff > MAX_BACKOFF || backoff <= 0 {
+		backoff = MAX_BACKOFF
+	} else {
+		r.backoffs++
+	}
+	wait := time.Duration(backoff/2 + rand.Int63n(backoff/2+1))
+	r.retryAt = time.Now().Add(wait)
+	log.Printf("Replica %d rejected by ballot %d, retrying phase 1 in %v\n", r.Id, r.retryBallot, wait)
+}
+
+// Called on every clock tick: run phase 1 again once the backoff has expired
+func (r *Replica) retryRejectedBallot() {
+	if r.retryAt.IsZero() || time.Now().Before(r.retryAt) {
+		return
+	}
+	r.retryAt = time.Time{}
+	if !r.IsLeader {
+		// another leader prepared a higher ballot in the meantime
+		return
+	}
+	r.startTakeover(r.retryBallot)
+}
+
+// Keep track of the promised ballot and the RMW instances known to this acceptor
+func (r *Replica) acceptedBallot(instance int32, ballot int32) {
+	if ballot > r.defaultBallot {
+		r.defaultBallot = ballot
+	}
+	if instance >= r.crtRmwId {
+		r.crtRmwId = instance + 1
+	}
+}
+
+// Learns from the leader that the RMW instances up to doneUpTo are committed
+func (r *Replica) learnDoneUpTo(doneUpTo int32) {
+	if doneUpTo > r.rmwDoneUpTo {
+		r.rmwDoneUpTo = doneUpTo
+		r.executeRMWs()
+	}
+	if doneUpTo >= r.crtRmwId {
+		r.crtRmwId = doneUpTo + 1
+	}
+}
+
+// Ballots are unique per replica: the low BALLOT_ID_BITS hold the replica id
+func (r *Replica) makeUniqueBallot(ballot int32) int32 {
+	return (ballot << BALLOT_ID_BITS) | r.Id
+}
+
+// Smallest ballot owned by this replica that is larger than any ballot it has seen
+func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
+	return r.makeUniqueBallot((ballot >> BALLOT_ID_BITS) + 1)
+}
+
+// RMW instances from fromInstance on that this replica has accepted
+func (r *Replica) acceptedRMWs(fromInstance int32) []pineappleproto.AcceptedRMW {
+	accepted := make([]pineappleproto.AcceptedRMW, 0)
+	if fromInstance <= r.rmwExecutedUpTo {
+		// committed and freed
+		fromInstance = r.rmwExecutedUpTo + 1
+	}
+	for i := fromInstance; i < r.crtRmwId; i++ {
+		inst := r.pendingRMWs[i]
+		if inst == nil || inst.cmds == nil {
+			continue
+		}
+		acc := pineappleproto.AcceptedRMW{
+			Instance: i,
+			Ballot:   inst.ballot,
+			Phase:    pineappleproto.RMW_GET_PHASE,
+			Command:  inst.cmds,
+			Key:      inst.cmds[0].K,
+		}
+		if inst.setAccepted {
+			acc.Phase = pineappleproto.RMW_SET_PHASE
+			acc.Payload = inst.receivedRMW
+		}
+		accepted = append(accepted, acc)
+	}
+	return accepted
+}
+
+// Keep the RMW with the highest ballot for each instance; at equal ballots the Set phase wins
+func (tb *TakeoverBookkeeping) merge(accepted []pineappleproto.AcceptedRMW) {
+	for _, acc := range accepted {
+		prev, present := tb.accepted[acc.Instance]
+		if !present || acc.Ballot > prev.Ballot || (acc.Ballot == prev.Ballot && acc.Phase > prev.Phase) {
+			tb.accepted[acc.Instance] = acc
+		}
+	}
+}
+
+// Phase 1 (new leader)
+// Picks a ballot larger than any seen and prepares every RMW instance not known to be done
+func (r *Replica) startTakeover(minBallot int32) {
+	var queued []*genericsmr.Propose
+	if r.takeover != nil {
+		queued = r.takeover.queued
+	}
+	if minBallot < r.defaultBallot {
+		minBallot = r.defaultBallot
+	}
+
+	ballot := r.makeBallotLargerThan(minBallot)
+	r.defaultBallot = ballot
+	r.recordPromise(ballot)
+	r.sync()
+	r.IsLeader = true
+	r.votedFor = r.Id
+	r.takeover = &TakeoverBookkeeping{
+		ballot:        ballot,
+		fromInstance:  r.rmwDoneUpTo + 1,
+		promised:      map[int32]bool{},
+		refused:       map[int32]bool{},
+		maxRecvBallot: -1,
+		accepted:      map[int32]pineappleproto.AcceptedRMW{},
+		queued:        queued,
+	}
+	r.takeover.merge(r.acceptedRMWs(r.takeover.fromInstance))
+
+	log.Printf("Replica %d taking over as leader with ballot %d from RMW instance %d\n",
+		r.Id, ballot, r.takeover.fromInstance)
+	r.bcastPrepare(r.takeover.fromInstance, ballot)
+}
+
+func (r *Replica) bcastPrepare(instance int32, ballot int32) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Prepare bcast failed:", err)
+		}
+	}()
+	args := &pineappleproto.Prepare{LeaderId: r.Id, Instance: instance, Ballot: ballot, ToInfinity: TRUE,
+		LeaderEpoch: r.leaderEpoch}
+
+	n := r.N - 1
+	q := r.Id
+	for sent := 0; sent < n; {
+		q = (q + 1) % int32(r.N)
+		if q == r.Id {
+			break
+		}
+		if !r.Alive[q].Load() {
+			continue
+		}
+		sent++
+		r.SendMsg(q, r.prepareRPC, args)
+	}
+}
+
+// Promise not to accept lower ballots and report accepted RMWs to the new leader
+func (r *Replica) handlePrepare(prepare *pineappleproto.Prepare) {
+	var preply *pineappleproto.PrepareReply
+
+	if r.fenced(prepare.LeaderEpoch) || prepare.Ballot < r.defaultBallot || r.votedForOther(prepare.LeaderId) {
+		preply = &pineappleproto.PrepareReply{ReplicaID: r.Id, Instance: prepare.Instance, OK: FALSE, Ballot: r.defaultBallot,
+			Accepted: make([]pineappleproto.AcceptedRMW, 0)}
+	} else {
+		if prepare.ToInfinity == TRUE {
+			r.defaultBallot = prepare.Ballot
+			r.recordPromise(prepare.Ballot)
+			r.sync()
+		}
+		r.vote(prepare.LeaderId)
+		if prepare.LeaderId != r.Id && (r.IsLeader || r.takeover != nil) {
+			log.Printf("Replica %d stepping down for leader %d\n", r.Id, prepare.LeaderId)
+			r.stepDown()
+		}
+		preply = &pineappleproto.PrepareReply{ReplicaID: r.Id, Instance: prepare.Instance, OK: TRUE, Ballot: prepare.Ballot,
+			Accepted: r.acceptedRMWs(prepare.Instance), DoneUpTo: r.rmwExecutedUpTo}
+	}
+
+	r.replyPrepare(prepare.LeaderId, preply)
+}
+
+func (r *Replica) handlePrepareReply(preply *pineappleproto.PrepareReply) {
+	if r.learnLeaderEpoch(preply.LeaderEpoch) {
+		return
+	}
+	tb := r.takeover
+	if tb == nil || preply.Instance != tb.fromInstance {
+		// takeover already completed or abandoned
+		return
+	}
+
+	if preply.OK == TRUE {
+		if preply.Ballot != tb.ballot {
+			return
+		}
+		tb.promised[preply.ReplicaID] = true
+		tb.merge(preply.Accepted)
+		r.learnDoneUpTo(preply.DoneUpTo)
+
+		if r.isQuorum(PREPARE_QUORUM, tb.promised) {
+			r.finishTakeover()
+		}
+	} else {
+		// another replica has promised a higher ballot
+		tb.refused[preply.ReplicaID] = true
+		if preply.Ballot > tb.maxRecvBallot {
+			tb.maxRecvBallot = preply.Ballot
+		}
+		if !r.quorumReachable(PREPARE_QUORUM, func(q int32) bool { return tb.refused[q] }) {
+			// a quorum of promises can no longer be reached
+			r.backOff(tb.maxRecvBallot)
+		}
+	}
+}
+
+// Phase 2 (new leader)
+// Re-proposes every RMW reported by the quorum under the new ballot, then serves queued proposals
+func (r *Replica) finishTakeover() {
+	tb := r.takeover
+	r.takeover = nil
+
+	lastInstance := tb.fromInstance - 1
+	for instance := range tb.accepted {
+		if instance > lastInstance {
+			lastInstance = instance
+		}
+	}
+
+	fromInstance := tb.fromInstance
+	if fromInstance <= r.rmwDoneUpTo {
+		// committed, as learned from the quorum
+		fromInstance = r.rmwDoneUpTo + 1
+	}
+	for i := fromInstance; i <= lastInstance; i++ {
+		inst := &Instance{
+			rmwId:  i,
+			ballot: tb.ballot,
+			status: PREPARED,
+			lb:     &LeaderBookkeeping{maxRecvBallot: -1, completed: false},
+
+			leaseEpoch: r.instanceLeaseEpoch(),
+		}
+		r.startPhase(inst)
+		acc, present := tb.accepted[i]
+		if prev := r.pendingRMWs[i]; prev != nil && prev.lb != nil {
+			// keep the client waiting on an RMW this replica already coordinated
+			inst.lb.clientProposals = prev.lb.clientProposals
+			inst.lb.completed = prev.lb.completed
+			inst.oldValue = prev.oldValue
+		}
+		r.pendingRMWs[i] = inst
+
+		if !present {
+			// no RMW was chosen at this instance, fill the gap with a no-op
+			inst.cmds = []state.Command{{Op: state.NONE}}
+			inst.lb.rmwGetDone = true
+			inst.setAccepted = true
+			r.recordRMW(inst)
+			r.bcastRMWSet(i, tb.ballot, "", inst.receivedRMW)
+		} else if acc.Phase == pineappleproto.RMW_SET_PHASE {
+			// a value may have been chosen, propose it again
+			inst.cmds = acc.Command
+			inst.lb.rmwGetDone = true
+			inst.receivedRMW = acc.Payload
+			inst.setAccepted = true
+			if r.isLargerTag(r.data[acc.Key].Tag, acc.Payload.Tag) {
+				r.setData(acc.Key, acc.Payload)
+			}
+			r.recordRMW(inst)
+			r.bcastRMWSet(i, tb.ballot, acc.Key, acc.Payload)
+		} else {
+			// no value was chosen, run the whole RMW again
+			inst.cmds = acc.Command
+			r.bcastRMWGet(i, tb.ballot, acc.Command)
+		}
+	}
+
+	if lastInstance >= r.crtRmwId {
+		r.crtRmwId = lastInstance + 1
+	}
+	// replies are handled after the sync, so this replica's own accepts are durable when counted
+	r.sync()
+	log.Printf("Replica %d is the leader with ballot %d, recovered RMW instances %d to %d\n",
+		r.Id, tb.ballot, fromInstance, lastInstance)
+	if r.elect {
+		go r.publishLeader(r.leaderEpoch)
+	}
+
+	for _, propose := range tb.queued {
+		r.handlePropose(propose)
+	}
+}
+
+// Stop acting as the RMW leader after another replica prepared a higher ballot
+func (r *Replica) stepDown() {
+	r.releaseLease()
+	r.IsLeader = false
+	r.retryAt = time.Time{}
+	if r.elect {
+		// wait for the new leader before standing for election again
+		r.resetElection()
+	}
+	if r.takeover != nil {
+		for _, propose := range r.takeover.queued {
+			r.refusePropose(propose)
+		}
+		r.takeover = nil
+	}
+}
+
+// Tell a client that this replica cannot coordinate its request
+func (r *Replica) refusePropose(propose *genericsmr.Propose) {
+	propreply := &genericsmrproto.ProposeReplyTS{
+		OK:        FALSE,
+		CommandId: propose.CommandId,
+		Value:     state.NIL,
+		Timestamp: propose.Timestamp}
+	r.ReplyProposeTS(propreply, propose.Reply)
+}
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	cmds := make([]state.Command, 1)
+	proposals := make([]*genericsmr.Propose, 1)
+	key := propose.Command.K
+	cmds[0] = propose.Command
+	proposals[0] = propose
+
+	if r.removed() {
+		// clients of a removed replica must move to the group
+		r.refusePropose(propose)
+		return
+	}
+
+	if propose.Command.Op == state.GET {
+		local := r.localRead(propose)
+		r.countRead(key, local)
+		if local {
+			return
+		}
+	}
+
+	if propose.Command.Op == state.DELETE && r.coded != nil {
+		// fragments have no tombstones
+		r.refusePropose(propose)
+		return
+	}
+
+	// Use Paxos if operation is not Read / Write / Delete
+	if propose.Command.Op != state.PUT && propose.Command.Op != state.GET && propose.Command.Op != state.DELETE {
+		if r.coded != nil {
+			// RMWs need the whole value
+			r.refusePropose(propose)
+			return
+		}
+		if !state.KnownModify(propose.Command.Fn) {
+			// no replica could apply it
+			r.refusePropose(propose)
+			return
+		}
+		if r.takeover != nil {
+			// wait for phase 1 to complete before proposing new RMWs
+			r.takeover.queued = append(r.takeover.queued, propose)
+			return
+		}
+		if !r.IsLeader {
+			r.refusePropose(propose)
+			return
+		}
+
+		rmwId := r.crtRmwId
+		r.crtRmwId++
+		r.pendingRMWs[rmwId] = &Instance{
+			rmwId:  rmwId,
+			cmds:   cmds,
+			ballot: r.defaultBallot,
+			status: PREPARING,
+			lb:     &LeaderBookkeeping{clientProposals: proposals, maxRecvBallot: -1, completed: false},
+
+			leaseEpoch: r.instanceLeaseEpoch(),
+		}
+		r.startPhase(r.pendingRMWs[rmwId])
+		r.bcastRMWGet(rmwId, r.defaultBallot, cmds)
+		return
+	}
+
+	for r.instanceSpace[r.crtInstance] != nil {
+		r.crtInstance++
+	}
+
+	instNo := r.crtInstance
+	r.crtInstance++ // not reused for the next operation, so late replies to this one are ignored
+
+	// ABD
+	r.instanceSpace[instNo] = &Instance{
+		cmds:   cmds,
+		ballot: 0,
 		status: PREPARING,
 		lb: &LeaderBookkeeping{
 			hasMaxTag:       map[int32]bool{},
 			clientProposals: proposals,
 			getDone:         false,
 			completed:       false,
+			started:         time.Now(),
 		},
+		leaseEpoch: r.instanceLeaseEpoch(),
+	}
+	r.startPhase(r.instanceSpace[instNo])
+	if r.coded != nil {
+		r.startCoded(instNo)
+		return
 	}
 
-	// Use Paxos if operation is not Read / Write
-	if propose.Command.Op != state.PUT && propose.Command.Op != state.GET {
-		rmwId := r.crtRmwId
-		r.crtRmwId++
-		r.instanceSpace[instNo] = &Instance{
-			rmwId:  rmwId,
-			cmds:   cmds,
-			ballot: 0,
-			status: PREPARING,
-			lb:     &LeaderBookkeeping{clientProposals: proposals, completed: false},
-		}
-		r.bcastRMWGet(instNo, 0, cmds)
-	} else { // use ABD
-		// Construct the pineapple payload from proposal data
-		if propose.Command.Op == state.PUT { // write operation
-			r.bcastGet(instNo, true, key)
-		} else if propose.Command.Op == state.GET { // read operation
-			data, doesExist := r.data[key]
-			if !doesExist {
-				tag := pineappleproto.Tag{Timestamp: 0, ID: int(r.Id)}
-				r.instanceSpace[instNo].initialTag = tag
-				r.data[key] = pineappleproto.Payload{Tag: tag, Value: 0}
-			} else {
-				r.instanceSpace[instNo].initialTag = data.Tag
-			}
-			r.bcastGet(instNo, false, key)
+	// Construct the pineapple payload from proposal data
+	if propose.Command.Op == state.PUT || propose.Command.Op == state.DELETE { // write operation
+		r.bcastGet(instNo, true, key)
+	} else if propose.Command.Op == state.GET { // read operation
+		data, doesExist := r.data[key]
+		if !doesExist {
+			tag := pineappleproto.Tag{Timestamp: 0, ID: int(r.Id)}
+			r.instanceSpace[instNo].initialTag = tag
+			r.setData(key, pineappleproto.Payload{Tag: tag, Value: state.NIL})
+		} else {
+			r.instanceSpace[instNo].initialTag = data.Tag
 		}
+		r.bcastGet(instNo, false, key)
 	}
 }
 
-var clockChan chan bool
+// State transfer (joining replica)
+// Asks the live peers for their state, again if they stopped sending chunks. The replica has caught up once
+// a read quorum sent all of it, it then holds every value written before it asked
+func (r *Replica) requestCatchUp() {
+	if r.isQuorum(READ_QUORUM, r.catchUpDone) {
+		// no peer to copy from, keep the recovered state
+		r.finishCatchUp()
+		return
+	}
 
-// append a log entry to stable storage
-func (r *Replica) recordInstanceMetadata(inst *Instance) {
-	if !r.Durable {
+	r.catchUpAt = time.Now().Add(CATCHUP_TIMEOUT)
+	for _, q := range r.groupPeers() {
+		if r.catchUpDone[q] || !r.Alive[q].Load() {
+			continue
+		}
+		// chunks left from an earlier transfer arrive before the first one of this transfer, and are ignored
+		r.catchUpSeqs[q] = 0
+		log.Printf("Replica %d catching up from replica %d\n", r.Id, q)
+		r.SendMsg(q, r.catchUpRPC, &pineappleproto.CatchUp{ReplicaID: r.Id, FromInstance: r.rmwDoneUpTo + 1})
+	}
+}
+
+// State of this replica being sent to a peer catching up
+type catchUpSend struct {
+	seq      int32
+	data     []pineappleproto.KeyPayload
+	accepted []pineappleproto.AcceptedRMW
+	last     pineappleproto.CatchUpChunk // RMW progress when the peer asked
+}
+
+// State transfer (peer)
+// Copies data and the RMW instances from the requested one, and sends them in chunks of CATCHUP_CHUNK bytes,
+// one per clock tick so that the transfer does not stall the other messages. A request from the peer replaces
+// the transfer in progress, whose chunks are all sent before those of the new one.
+// A peer that is catching up too sends what it has, so replicas restarting together do not wait on each other
+func (r *Replica) handleCatchUp(catchUp *pineappleproto.CatchUp) {
+	data := make([]pineappleproto.KeyPayload, 0, len(r.data))
+	for key, payload := range r.data {
+		data = append(data, pineappleproto.KeyPayload{Key: key, Payload: payload})
+	}
+	r.catchUpOut[catchUp.ReplicaID] = &catchUpSend{
+		data:     data,
+		accepted: r.acceptedRMWs(catchUp.FromInstance),
+		last: pineappleproto.CatchUpChunk{
+			ReplicaID:     r.Id,
+			DefaultBallot: r.defaultBallot,
+			RmwDoneUpTo:   r.rmwDoneUpTo,
+			CrtRmwId:      r.crtRmwId,
+			CollectedUpTo: r.collectedUpTo,
+			LeaderEpoch:   r.leaderEpoch,
+		},
+	}
+	r.sendCatchUpChunk(catchUp.ReplicaID)
+}
+
+// Called on every clock tick: send the next chunk of each transfer
+func (r *Replica) sendCatchUpChunks() {
+	for q := range r.catchUpOut {
+		r.sendCatchUpChunk(q)
+	}
+}
+
+func (r *Replica) sendCatchUpChunk(q int32) {
+	out := r.catchUpOut[q]
+	chunk := out.last
+	chunk.Seq = out.seq
+	chunk.Last = FALSE
+	size := 0
+	n := 0
+	for ; n < len(out.data) && (n == 0 || size < CATCHUP_CHUNK); n++ {
+		size += CATCHUP_ENTRY + len(out.data[n].Key) + len(out.data[n].Payload.Value)
+	}
+	chunk.Data, out.data = out.data[:n], out.data[n:]
+	n = 0
+	for ; n < len(out.accepted) && size < CATCHUP_CHUNK; n++ {
+		size += acceptedSize(&out.accepted[n])
+	}
+	chunk.Accepted, out.accepted = out.accepted[:n], out.accepted[n:]
+	if len(out.data) == 0 && len(out.accepted) == 0 {
+		chunk.Last = TRUE
+		delete(r.catchUpOut, q)
+	}
+	out.seq++
+	r.SendMsg(q, r.catchUpChunkRPC, &chunk)
+}
+
+// Bytes an RMW instance takes in a state transfer message, about
+func acceptedSize(acc *pineappleproto.AcceptedRMW) int {
+	size := CATCHUP_ENTRY + len(acc.Key) + len(acc.Payload.Value)
+	for _, cmd := range acc.Command {
+		size += CATCHUP_ENTRY + len(cmd.K) + len(cmd.V) + len(cmd.Arg)
+	}
+	return size
+}
+
+// State transfer (joining replica)
+// Merges a chunk of the peer's state into this replica's
+func (r *Replica) handleCatchUpChunk(chunk *pineappleproto.CatchUpChunk) {
+	seq, asked := r.catchUpSeqs[chunk.ReplicaID]
+	if !r.catchingUp || !asked || r.catchUpDone[chunk.ReplicaID] || chunk.Seq != seq {
+		// chunk of a transfer this replica gave up on
 		return
 	}
+	r.catchUpSeqs[chunk.ReplicaID]++
+	r.catchUpAt = time.Now().Add(CATCHUP_TIMEOUT)
+
+	for _, kp := range chunk.Data {
+		if r.isLargerTag(r.data[kp.Key].Tag, kp.Payload.Tag) {
+			r.setData(kp.Key, kp.Payload)
+		}
+	}
+	for i := range chunk.Accepted {
+		acc := &chunk.Accepted[i]
+		inst := r.pendingRMWs[acc.Instance]
+		if inst == nil || inst.ballot < acc.Ballot || (inst.ballot == acc.Ballot && !inst.setAccepted) {
+			r.restoreRMW(acc)
+		}
+	}
+
+	if chunk.Last == TRUE {
+		if chunk.DefaultBallot > r.defaultBallot {
+			r.defaultBallot = chunk.DefaultBallot
+		}
+		if chunk.CrtRmwId > r.crtRmwId {
+			r.crtRmwId = chunk.CrtRmwId
+		}
+		r.learnCollectedUpTo(chunk.CollectedUpTo)
+		r.learnDoneUpTo(chunk.RmwDoneUpTo)
+		r.learnLeaderEpoch(chunk.LeaderEpoch)
+		r.catchUpDone[chunk.ReplicaID] = true
+		if r.isQuorum(READ_QUORUM, r.catchUpDone) {
+			r.finishCatchUp()
+		}
+	}
+}
+
+// Start voting in quorums and serving clients with the state copied from the peers
+func (r *Replica) finishCatchUp() {
+	r.catchingUp = false
+	r.checkpoint() // the copied state is not in the log
+	log.Printf("Replica %d caught up: %d keys, ballot %d, RMW instances up to %d\n",
+		r.Id, len(r.data), r.defaultBallot, r.crtRmwId-1)
 
-	var b [5]byte
-	binary.LittleEndian.PutUint32(b[0:4], uint32(inst.ballot))
-	b[4] = byte(inst.status)
-	r.StableStore.Write(b[:])
+	if r.Id == 0 {
+		// ballot 0 may have been superseded while this replica was down
+		r.startTakeover(r.defaultBallot)
+	}
 }
 
-// write a sequence of commands to stable storage
-func (r *Replica) recordCommands(cmds []state.Command) {
+// append a record to the stable store log, it is durable after the next sync
+func (r *Replica) record(rec *pineappleproto.LogRecord) {
 	if !r.Durable {
 		return
 	}
 
-	if cmds == nil {
-		return
+	rec.Marshal(r.stableWriter)
+	r.unsynced = true
+	r.records++
+}
+
+// log the value-tag pair stored for a key
+func (r *Replica) recordSet(key state.Key, payload pineappleproto.Payload) {
+	r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_SET, Key: key, Payload: payload})
+}
+
+// log a ballot promised for all RMW instances
+func (r *Replica) recordPromise(ballot int32) {
+	r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_PROMISE, Ballot: ballot})
+}
+
+// log the ballot, command and (once accepted) payload of an RMW instance
+func (r *Replica) recordRMW(inst *Instance) {
+	rec := &pineappleproto.LogRecord{
+		Type:     pineappleproto.LOG_RMW,
+		Instance: inst.rmwId,
+		Ballot:   inst.ballot,
+		Phase:    pineappleproto.RMW_GET_PHASE,
+		Command:  inst.cmds,
+		Key:      inst.cmds[0].K,
 	}
-	for i := 0; i < len(cmds); i++ {
-		cmds[i].Marshal(io.Writer(r.StableStore))
+	if inst.setAccepted {
+		rec.Phase = pineappleproto.RMW_SET_PHASE
+		rec.Payload = inst.receivedRMW
 	}
+	r.record(rec)
 }
 
 // sync with the stable store
@@ -697,10 +1966,212 @@ func (r *Replica) sync() {
 		return
 	}
 
+	r.stableWriter.Flush()
 	r.StableStore.Sync()
+	r.unsynced = false
+
+	held := r.heldReplies
+	r.heldReplies = nil
+	for _, reply := range held {
+		reply()
+	}
+}
+
+// Send a reply once the log records written so far are durable.
+// Replies are held until the next sync, so that one sync covers all the messages handled since the last one
+func (r *Replica) replyAfterSync(reply func()) {
+	if !r.unsynced {
+		reply()
+		return
+	}
+	r.heldReplies = append(r.heldReplies, reply)
 }
 
-func (r *Replica) clock() {
+// Group commit: sync the records written since the last clock tick and release the replies waiting for them
+func (r *Replica) groupCommit() {
+	if r.unsynced {
+		r.sync()
+	}
+}
+
+// Rebuilds data, the promised ballot and the accepted RMW instances by replaying the stable store log.
+// A record torn by the crash at the end of the log is discarded
+func (r *Replica) recover() {
+	if buf, err := os.ReadFile(r.snapshotFile()); err == nil {
+		snap := new(pineappleproto.Snapshot)
+		if err := snap.Unmarshal(bytes.NewReader(buf)); err != nil {
+			log.Fatal("Error reading the snapshot:", err)
+		}
+		r.restore(snap)
+	} else if !os.IsNotExist(err) {
+		log.Fatal("Error reading the snapshot:", err)
+	}
+
+	buf, err := io.ReadAll(r.StableStore)
+	if err != nil {
+		log.Fatal("Error reading the stable store:", err)
+	}
+
+	reader := bytes.NewReader(buf)
+	offset := 0
+	records := 0
+	for reader.Len() > 0 {
+		rec := new(pineappleproto.LogRecord)
+		if err := rec.Unmarshal(reader); err != nil {
+			break
+		}
+		offset = len(buf) - reader.Len()
+		records++
+		r.replay(rec)
+	}
+
+	if offset < len(buf) {
+		log.Printf("Replica %d discarding %d bytes of torn log records\n", r.Id, len(buf)-offset)
+		if err := r.StableStore.Truncate(int64(offset)); err != nil {
+			log.Fatal("Error truncating the stable store:", err)
+		}
+	}
+	if _, err := r.StableStore.Seek(int64(offset), io.SeekStart); err != nil {
+		log.Fatal("Error seeking the stable store:", err)
+	}
+
+	r.executeRMWs() // free the instances committed before the crash
+	log.Printf("Replica %d recovered %d log records: %d keys, ballot %d, RMW instances %d to %d\n",
+		r.Id, records, len(r.data), r.defaultBallot, r.rmwDoneUpTo+1, r.crtRmwId-1)
+}
+
+// apply a log record to the replica state
+func (r *Replica) replay(rec *pineappleproto.LogRecord) {
+	switch rec.Type {
+	case pineappleproto.LOG_SET:
+		if r.isLargerTag(r.data[rec.Key].Tag, rec.Payload.Tag) {
+			r.setData(rec.Key, rec.Payload)
+		}
+
+	case pineappleproto.LOG_PROMISE:
+		if rec.Ballot > r.defaultBallot {
+			r.defaultBallot = rec.Ballot
+		}
+
+	case pineappleproto.LOG_RMW:
+		r.restoreRMW(&pineappleproto.AcceptedRMW{Instance: rec.Instance, Ballot: rec.Ballot, Phase: rec.Phase,
+			Command: rec.Command, Key: rec.Key, Payload: rec.Payload})
+
+	case pineappleproto.LOG_COLLECT:
+		if r.data[rec.Key].Tag == rec.Payload.Tag {
+			r.collectTombstone(rec.Key, rec.Payload.Tag)
+		} else {
+			r.learnCollectedUpTo(rec.Payload.Tag.Timestamp)
+		}
+	}
+}
+
+// recreate an accepted RMW instance from the log or a snapshot
+func (r *Replica) restoreRMW(acc *pineappleproto.AcceptedRMW) {
+	if acc.Instance <= r.rmwExecutedUpTo {
+		return
+	}
+	r.pendingRMWs[acc.Instance] = &Instance{
+		rmwId:       acc.Instance,
+		cmds:        acc.Command,
+		ballot:      acc.Ballot,
+		status:      ACCEPTED,
+		receivedRMW: acc.Payload,
+		setAccepted: acc.Phase == pineappleproto.RMW_SET_PHASE,
+		lb:          nil,
+	}
+	r.acceptedBallot(acc.Instance, acc.Ballot)
+	if acc.Phase == pineappleproto.RMW_SET_PHASE && r.isLargerTag(r.data[acc.Key].Tag, acc.Payload.Tag) {
+		r.setData(acc.Key, acc.Payload)
+	}
+}
+
+func (r *Replica) snapshotFile() string {
+	return r.FileName("snapshot")
+}
+
+// Writes a snapshot of data and RMW progress, then truncates the log records it replaces
+func (r *Replica) checkpoint() {
+	if !r.Durable {
+		return
+	}
+	r.sync()
+
+	snap := &pineappleproto.Snapshot{
+		DefaultBallot: r.defaultBallot,
+		RmwDoneUpTo:   r.rmwDoneUpTo,
+		CrtRmwId:      r.crtRmwId,
+		CollectedUpTo: r.collectedUpTo,
+		Data:          make([]pineappleproto.KeyPayload, 0, len(r.data)),
+		Accepted:      r.acceptedRMWs(r.rmwDoneUpTo + 1),
+	}
+	for key, payload := range r.data {
+		snap.Data = append(snap.Data, pineappleproto.KeyPayload{Key: key, Payload: payload})
+	}
+
+	// write a new file and rename it, so that a crash leaves the previous snapshot intact
+	tmpFile := r.snapshotFile() + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		log.Println("Checkpoint failed:", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	snap.Marshal(w)
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpFile, r.snapshotFile())
+	}
+	if err == nil {
+		// the rename must be durable before the log it replaces is gone
+		err = syncDir(filepath.Dir(r.snapshotFile()))
+	}
+	if err != nil {
+		log.Println("Checkpoint failed:", err)
+		return
+	}
+
+	// replaying the old records after the snapshot rebuilds the same state, so a crash before this point is safe
+	if err := r.StableStore.Truncate(0); err != nil {
+		log.Fatal("Error truncating the stable store:", err)
+	}
+	if _, err := r.StableStore.Seek(0, io.SeekStart); err != nil {
+		log.Fatal("Error seeking the stable store:", err)
+	}
+	r.stableWriter.Reset(r.StableStore)
+	log.Printf("Replica %d checkpointed %d keys and %d RMW instances, replacing %d log records\n",
+		r.Id, len(snap.Data), len(snap.Accepted), r.records)
+	r.records = 0
+}
+
+// flush the entries of a directory to stable storage, as those renamed into it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// load the state saved by a checkpoint
+func (r *Replica) restore(snap *pineappleproto.Snapshot) {
+	r.defaultBallot = snap.DefaultBallot
+	r.rmwDoneUpTo = snap.RmwDoneUpTo
+	r.crtRmwId = snap.CrtRmwId
+	r.collectedUpTo = snap.CollectedUpTo
+	for _, kp := range snap.Data {
+		r.setData(kp.Key, kp.Payload)
+	}
+	for i := range snap.Accepted {
+		r.restoreRMW(&snap.Accepted[i])
+	}
+}
+
+func (r *Replica) clock(clockChan chan bool) {
 	for !r.Shutdown {
 		time.Sleep(CLOCK)
 		clockChan <- true
@@ -715,32 +2186,83 @@ func (r *Replica) Run() {
 
 	go r.WaitForClientConnections()
 
-	if r.Id == 0 {
-		go r.executeRMWs()
+	if r.catchingUp {
+		r.requestCatchUp()
+	} else if r.Id == 0 {
+		// replica 0 starts as the leader, owning ballot 0
+		r.IsLeader = true
+	}
+	if r.elect {
+		r.resetElection()
 	}
 
-	clockChan = make(chan bool, 1)
-	go r.clock()
+	// each replica ticks its own clock, several can run in a process
+	clockChan := make(chan bool, 1)
+	go r.clock(clockChan)
 
 	// We don't directly access r.ProposeChan, because we want to do pipelining periodically,
 	// so we introduce a channel pointer: onOffProposChan:
 	onOffProposeChan := r.ProposeChan
+	onOffScanChan := r.ScanChan
+	if r.catchingUp {
+		// clients wait until the replica has caught up
+		onOffProposeChan = nil
+		onOffScanChan = nil
+	}
 
 	for !r.Shutdown {
 
 		select {
 		case <-clockChan:
 			// activate the new proposals channel
-			onOffProposeChan = r.ProposeChan
+			if !r.catchingUp {
+				onOffProposeChan = r.ProposeChan
+				onOffScanChan = r.ScanChan
+			} else if time.Now().After(r.catchUpAt) {
+				r.requestCatchUp()
+			}
+			r.groupCommit()
+			r.sendCatchUpChunks()
+			if time.Now().After(r.nextTimeoutCheck) {
+				r.checkTimeouts()
+			}
+			if r.Beacon && time.Now().After(r.nextRanking) {
+				r.rankPeers()
+			}
+			if r.records >= CHECKPOINT_INTERVAL {
+				r.checkpoint()
+			}
+			r.retryRejectedBallot()
+			r.renewLease()
+			r.checkElection()
+			if time.Now().After(r.nextKeyLeaseSweep) {
+				r.sweepKeyLeases()
+			}
+			if time.Now().After(r.nextReadStats) {
+				r.reportReadStats()
+			}
+			if r.coded == nil && time.Now().After(r.nextTombstoneSweep) {
+				r.sweepTombstones()
+			}
+			break
+		case beacon := <-r.BeaconChan:
+			//got a Beacon message
+			r.ReplyBeacon(beacon)
 			break
 		case setS := <-r.setChan:
 			set := setS.(*pineappleproto.Set)
 			//got a Write message
+			if r.catchingUp {
+				break
+			}
 			r.handleSet(set)
 			break
 		case getS := <-r.getChan:
 			get := getS.(*pineappleproto.Get)
 			//got a Read message
+			if r.catchingUp {
+				break
+			}
 			r.handleGet(get)
 			break
 		case setReplyS := <-r.setReplyChan:
@@ -763,6 +2285,9 @@ func (r *Replica) Run() {
 		case rmwGetS := <-r.rmwGetChan:
 			rmwGet := rmwGetS.(*pineappleproto.RMWGet)
 			//got an RMWGet message
+			if r.catchingUp {
+				break
+			}
 			r.handleRMWGet(rmwGet)
 			break
 		case rmwGetReplyS := <-r.rmwGetReplyChan:
@@ -773,6 +2298,9 @@ func (r *Replica) Run() {
 		case rmwSetS := <-r.rmwSetChan:
 			rmwSet := rmwSetS.(*pineappleproto.RMWSet)
 			//got an Accept message
+			if r.catchingUp {
+				break
+			}
 			r.handleRMWSet(rmwSet)
 			break
 		case rmwSetReplyS := <-r.rmwSetReplyChan:
@@ -780,12 +2308,169 @@ func (r *Replica) Run() {
 			//got an Accept reply
 			r.handleRMWSetReply(rmwSetReply)
 			break
+		case prepareS := <-r.prepareChan:
+			prepare := prepareS.(*pineappleproto.Prepare)
+			//got a Prepare message
+			if r.catchingUp {
+				break
+			}
+			r.handlePrepare(prepare)
+			break
+		case prepareReplyS := <-r.prepareReplyChan:
+			prepareReply := prepareReplyS.(*pineappleproto.PrepareReply)
+			//got a Prepare reply
+			r.handlePrepareReply(prepareReply)
+			break
+		case leaderEpoch := <-r.beTheLeaderChan:
+			//asked by the master to become the leader
+			r.handleBeTheLeader(leaderEpoch)
+			break
+		case heartbeatS := <-r.heartbeatChan:
+			heartbeat := heartbeatS.(*pineappleproto.Heartbeat)
+			//got a heartbeat from the elected leader
+			r.handleHeartbeat(heartbeat)
+			break
+		case leaderEpoch := <-r.stepDownChan:
+			//told by the master that another replica leads
+			r.learnLeaderEpoch(leaderEpoch)
+			break
+		case catchUpS := <-r.catchUpChan:
+			catchUp := catchUpS.(*pineappleproto.CatchUp)
+			//got a state transfer request
+			r.handleCatchUp(catchUp)
+			break
+		case catchUpChunkS := <-r.catchUpChunkChan:
+			catchUpChunk := catchUpChunkS.(*pineappleproto.CatchUpChunk)
+			//got part of the state of a peer
+			r.handleCatchUpChunk(catchUpChunk)
+			break
+		case codedQueryS := <-r.codedQueryChan:
+			codedQuery := codedQueryS.(*pineappleproto.CodedQuery)
+			//got a Coded query message
+			if r.catchingUp {
+				break
+			}
+			r.handleCodedQuery(codedQuery)
+			break
+		case codedQueryReplyS := <-r.codedQueryReplyChan:
+			codedQueryReply := codedQueryReplyS.(*pineappleproto.CodedQueryReply)
+			//got a Coded query reply
+			r.handleCodedQueryReply(codedQueryReply)
+			break
+		case codedWriteS := <-r.codedWriteChan:
+			codedWrite := codedWriteS.(*pineappleproto.CodedWrite)
+			//got a Coded pre-write message
+			if r.catchingUp {
+				break
+			}
+			r.handleCodedWrite(codedWrite)
+			break
+		case codedWriteReplyS := <-r.codedWriteReplyChan:
+			codedWriteReply := codedWriteReplyS.(*pineappleproto.CodedWriteReply)
+			//got a Coded pre-write reply
+			r.handleCodedWriteReply(codedWriteReply)
+			break
+		case codedFinalizeS := <-r.codedFinalizeChan:
+			codedFinalize := codedFinalizeS.(*pineappleproto.CodedFinalize)
+			//got a Coded finalize message
+			if r.catchingUp {
+				break
+			}
+			r.handleCodedFinalize(codedFinalize)
+			break
+		case codedFinalizeReplyS := <-r.codedFinalizeReplyChan:
+			codedFinalizeReply := codedFinalizeReplyS.(*pineappleproto.CodedFinalizeReply)
+			//got a Coded finalize reply
+			r.handleCodedFinalizeReply(codedFinalizeReply)
+			break
+		case leaseRequestS := <-r.leaseRequestChan:
+			leaseRequest := leaseRequestS.(*pineappleproto.LeaseRequest)
+			//got a Lease request message
+			if r.catchingUp {
+				break
+			}
+			r.handleLeaseRequest(leaseRequest)
+			break
+		case leaseGrantS := <-r.leaseGrantChan:
+			leaseGrant := leaseGrantS.(*pineappleproto.LeaseGrant)
+			//got a Lease grant message
+			r.handleLeaseGrant(leaseGrant)
+			break
+		case leaseReleaseS := <-r.leaseReleaseChan:
+			leaseRelease := leaseReleaseS.(*pineappleproto.LeaseRelease)
+			//got a Lease release message
+			r.handleLeaseRelease(leaseRelease)
+			break
+		case tombstoneCheckS := <-r.tombstoneCheckChan:
+			tombstoneCheck := tombstoneCheckS.(*pineappleproto.TombstoneCheck)
+			//got a Tombstone check message
+			if r.catchingUp {
+				break
+			}
+			r.handleTombstoneCheck(tombstoneCheck)
+			break
+		case tombstoneCheckReplyS := <-r.tombstoneCheckReplyChan:
+			tombstoneCheckReply := tombstoneCheckReplyS.(*pineappleproto.TombstoneCheckReply)
+			//got a Tombstone check reply
+			r.handleTombstoneCheckReply(tombstoneCheckReply)
+			break
+		case scan := <-onOffScanChan:
+			//got a Scan from a client
+			r.handleScan(scan)
+			break
+		case scanQueryS := <-r.scanQueryChan:
+			scanQuery := scanQueryS.(*pineappleproto.ScanQuery)
+			//got a Scan query message
+			if r.catchingUp {
+				break
+			}
+			r.handleScanQuery(scanQuery)
+			break
+		case scanQueryReplyS := <-r.scanQueryReplyChan:
+			scanQueryReply := scanQueryReplyS.(*pineappleproto.ScanQueryReply)
+			//got a Scan query reply
+			r.handleScanQueryReply(scanQueryReply)
+			break
+		case scanWriteBackS := <-r.scanWriteBackChan:
+			scanWriteBack := scanWriteBackS.(*pineappleproto.ScanWriteBack)
+			//got a Scan write-back message
+			if r.catchingUp {
+				break
+			}
+			r.handleScanWriteBack(scanWriteBack)
+			break
+		case scanWriteBackReplyS := <-r.scanWriteBackReplyChan:
+			scanWriteBackReply := scanWriteBackReplyS.(*pineappleproto.ScanWriteBackReply)
+			//got a Scan write-back reply
+			r.handleScanWriteBackReply(scanWriteBackReply)
+			break
+		case <-r.checkpointChan:
+			//asked by an operator to checkpoint
+			r.checkpoint()
+			break
+		case rc := <-r.reconfigureChan:
+			//got a new configuration of the group from the master
+			r.handleReconfigure(rc)
+			break
 		}
 	}
 }
 
 /* RPC to be called by master */
+// The takeover itself runs on the main loop, since it touches the instance space
 func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
-	r.IsLeader = true
+	r.beTheLeaderChan <- args.LeaderEpoch
+	return nil
+}
+
+// Called by the master on the replicas other than the new leader once it fails over
+func (r *Replica) StepDown(args *genericsmrproto.StepDownArgs, reply *genericsmrproto.StepDownReply) error {
+	r.stepDownChan <- args.LeaderEpoch
+	return nil
+}
+
+// Called by operators to snapshot the replica state and truncate the stable store log
+func (r *Replica) Checkpoint(args *genericsmrproto.CheckpointArgs, reply *genericsmrproto.CheckpointReply) error {
+	r.checkpointChan <- true
 	return nil
 }
@@ -0,0 +1,444 @@
+package pineapple
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/masterproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+const TEST_DEADLINE = 20 * time.Second // for a command to complete, retries included
+
+// Client connection to a replica, sending one command at a time
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	crtId  int32
+}
+
+// Dials until the replica listens
+func dialTestClient(t *testing.T, addr string) *testClient {
+	deadline := time.Now().Add(TEST_DEADLINE)
+	conn, err := net.Dial("tcp", addr)
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn, bufio.NewReader(conn), bufio.NewWriter(conn), 0}
+}
+
+func (c *testClient) call(cmd state.Command) (*genericsmrproto.ProposeReplyTS, error) {
+	c.crtId++
+	propose := &genericsmrproto.Propose{CommandId: c.crtId, Command: cmd, Timestamp: time.Now().UnixNano()}
+	c.writer.WriteByte(genericsmrproto.PROPOSE)
+	propose.Marshal(c.writer)
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(TEST_DEADLINE))
+	for {
+		reply := new(genericsmrproto.ProposeReplyTS)
+		if err := reply.Unmarshal(c.reader); err != nil {
+			return nil, err
+		}
+		if reply.CommandId == c.crtId {
+			return reply, nil
+		}
+	}
+}
+
+// Sends the command again while the replica refuses it, as it did not take effect.
+// Calls refused, if not nil, before each new attempt
+func (c *testClient) callUntilDone(cmd state.Command, refused func()) (*genericsmrproto.ProposeReplyTS, error) {
+	deadline := time.Now().Add(TEST_DEADLINE)
+	for {
+		reply, err := c.call(cmd)
+		if err != nil || reply.OK != FALSE {
+			return reply, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("command %d refused until the deadline", reply.CommandId)
+		}
+		if refused != nil {
+			refused()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Addresses of n free local ports
+func freeAddrs(t *testing.T, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	return addrs
+}
+
+func testConfig(id int, addrs []string) *Config {
+	return &Config{Id: id, PeerAddrList: addrs, Dreply: true, Timeout: 100 * time.Millisecond, MaxRetries: 5,
+		QuorumMode: QUORUM_COUNT, CodedGC: 1}
+}
+
+// Runs the test in a temporary directory, where the replicas create their stable stores
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// A replica of a group of n that does not run, nor connect to its peers, which all count as alive.
+// The test calls its handlers, the messages it sends are dropped
+func stoppedReplica(t *testing.T, c *Config, n int) *Replica {
+	c.PeerAddrList = make([]string, n)
+	r := newReplica(c)
+	t.Cleanup(func() { r.StableStore.Close() })
+	for q := 0; q < n; q++ {
+		r.Alive[q].Store(true)
+	}
+	return r
+}
+
+// Starts a group of replicas listening on addrs, in a temporary directory
+func startTestReplicas(t *testing.T, addrs []string) []*Replica {
+	inTempDir(t)
+	replicas := make([]*Replica, len(addrs))
+	for i := range replicas {
+		replicas[i] = NewReplica(testConfig(i, addrs))
+	}
+
+	// a replica accepts the connections of the peers with higher ids before those of clients, and would take a
+	// client for a peer. The last replica accepts none, and once it served a read the others were all dialed
+	last := dialTestClient(t, addrs[len(addrs)-1])
+	if _, err := last.callUntilDone(state.Command{Op: state.GET, K: state.Key("ready")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return replicas
+}
+
+// Two replicas lead at once and propose a compare-and-swap from the absent value on the same keys.
+// A single value is chosen for each key: at most one swap succeeds, and the other reads its value
+func TestCompetingCoordinators(t *testing.T) {
+	addrs := freeAddrs(t, 3)
+	replicas := startTestReplicas(t, addrs)
+	// replica 0 starts as the leader. A coordinator preempted by the other takes over again in the same leader
+	// epoch, with a higher ballot, as if two masters each appointed one
+	lead := func(c int) func() {
+		return func() {
+			replicas[c].BeTheLeader(&genericsmrproto.BeTheLeaderArgs{LeaderEpoch: 0}, new(genericsmrproto.BeTheLeaderReply))
+		}
+	}
+	lead(1)()
+
+	coordinators := []*testClient{dialTestClient(t, addrs[0]), dialTestClient(t, addrs[1])}
+	readers := make([]*testClient, len(addrs))
+	for i, addr := range addrs {
+		readers[i] = dialTestClient(t, addr)
+	}
+
+	for k := 0; k < 20; k++ {
+		key := state.Key(fmt.Sprintf("key%d", k))
+		replies := make([]*genericsmrproto.ProposeReplyTS, len(coordinators))
+		errs := make(chan error, len(coordinators))
+		for c, client := range coordinators {
+			go func(c int, client *testClient) {
+				var err error
+				replies[c], err = client.callUntilDone(state.Command{Op: state.RMW, K: key,
+					V: state.IntValue(int64(c + 1)), Fn: state.COMPARE_AND_SWAP, Arg: state.NIL}, lead(c))
+				errs <- err
+			}(c, client)
+		}
+		for range coordinators {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var chosen state.Value
+		for i, reader := range readers {
+			reply, err := reader.callUntilDone(state.Command{Op: state.GET, K: key}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 0 && !bytes.Equal(reply.Value, chosen) {
+				t.Fatalf("%s: replica %d read %v, replica 0 read %v", key, i, reply.Value, chosen)
+			}
+			chosen = reply.Value
+		}
+
+		swapped := 0
+		for c, reply := range replies {
+			if reply.OK != TRUE {
+				continue // outcome unknown
+			}
+			if len(reply.OldValue) == 0 {
+				swapped++
+				if !bytes.Equal(chosen, state.IntValue(int64(c+1))) {
+					t.Errorf("%s: coordinator %d swapped in its value, but %v was chosen", key, c, chosen)
+				}
+			} else if !bytes.Equal(reply.OldValue, chosen) {
+				t.Errorf("%s: coordinator %d read %v, but %v was chosen", key, c, reply.OldValue, chosen)
+			}
+		}
+		if swapped > 1 {
+			t.Errorf("%s: both coordinators swapped in their value", key)
+		}
+	}
+}
+
+// Adds a fourth replica to a group and then removes one of the first three, as the master does, while a client
+// keeps writing. Run with -race, it also checks the replicas resize the group safely while serving their peers
+func TestReconfiguration(t *testing.T) {
+	addrs := freeAddrs(t, 4)
+	replicas := startTestReplicas(t, addrs[:3])
+	reconfigure := func(config *masterproto.ReconfigureArgs, ids ...int) *masterproto.ReconfigureReply {
+		reply := new(masterproto.ReconfigureReply)
+		for _, i := range ids {
+			if err := replicas[i].Reconfigure(config, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return reply
+	}
+
+	stop := make(chan bool)
+	written := make(chan error, 1)
+	var last int64
+	go func() {
+		writer := dialTestClient(t, addrs[0])
+		for {
+			select {
+			case <-stop:
+				written <- nil
+				return
+			default:
+			}
+			if _, err := writer.callUntilDone(state.Command{Op: state.PUT, K: state.Key("key"),
+				V: state.IntValue(last + 1)}, nil); err != nil {
+				written <- err
+				return
+			}
+			last++
+		}
+	}()
+
+	joint := &masterproto.ReconfigureArgs{Epoch: 1, NodeList: addrs, Members: []bool{true, true, true, true},
+		Old: []bool{true, true, true, false}}
+	reconfigure(joint, 0, 1, 2)
+	c := testConfig(3, addrs)
+	c.Group, c.Joining = joint, true
+	replicas = append(replicas, NewReplica(c))
+	deadline := time.Now().Add(TEST_DEADLINE)
+	for !reconfigure(joint, 3).CaughtUp {
+		if time.Now().After(deadline) {
+			t.Fatal("the added replica did not catch up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reconfigure(&masterproto.ReconfigureArgs{Epoch: 2, NodeList: addrs, Members: joint.Members}, 0, 1, 2, 3)
+
+	members := []bool{true, true, false, true}
+	reconfigure(&masterproto.ReconfigureArgs{Epoch: 3, NodeList: addrs, Members: members, Old: joint.Members},
+		0, 1, 2, 3)
+	reconfigure(&masterproto.ReconfigureArgs{Epoch: 4, NodeList: addrs, Members: members}, 0, 1, 2, 3)
+
+	close(stop)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 3} {
+		reply, err := dialTestClient(t, addrs[i]).callUntilDone(state.Command{Op: state.GET, K: state.Key("key")}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply.Value, state.IntValue(last)) {
+			t.Errorf("replica %d read %v, %v was written last", i, reply.Value, state.IntValue(last))
+		}
+	}
+}
+
+// An RMW with a modify function no replica registered is refused, and leaves its key unwritten
+func TestUnknownModify(t *testing.T) {
+	addrs := freeAddrs(t, 3)
+	startTestReplicas(t, addrs)
+	client := dialTestClient(t, addrs[0])
+
+	reply, err := client.call(state.Command{Op: state.RMW, K: state.Key("key"), V: state.IntValue(1), Fn: 255})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.OK != FALSE {
+		t.Fatalf("RMW with an unknown function answered %d", reply.OK)
+	}
+	// the same RMW with a registered function is not refused, and finds the key unwritten
+	reply, err = client.callUntilDone(state.Command{Op: state.RMW, K: state.Key("key"), V: state.IntValue(1),
+		Fn: state.FETCH_AND_ADD}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.OK != TRUE || len(reply.OldValue) != 0 {
+		t.Fatalf("RMW answered %d, read %v after the refused RMW", reply.OK, reply.OldValue)
+	}
+}
+
+// Durable replica 0 of a group of 3, recovering from the stable store of the previous one if recovering
+func durableReplica(t *testing.T, recovering bool) *Replica {
+	c := testConfig(0, nil)
+	c.Durable = true
+	c.Recovering = recovering
+	return stoppedReplica(t, c, 3)
+}
+
+func testPayload(timestamp int, value string) pineappleproto.Payload {
+	return pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: timestamp, ID: 1}, Value: state.Value(value)}
+}
+
+func testSet(r *Replica, key state.Key, payload pineappleproto.Payload) {
+	r.handleSet(&pineappleproto.Set{ReplicaID: 1, Key: key, Payload: payload})
+}
+
+func checkData(t *testing.T, r *Replica, want map[state.Key]pineappleproto.Payload) {
+	t.Helper()
+	if len(r.data) != len(want) || r.keys.Len() != len(want) {
+		t.Fatalf("%d keys, %d indexed, not %d", len(r.data), r.keys.Len(), len(want))
+	}
+	for key, payload := range want {
+		if got := r.data[key]; got.Tag != payload.Tag || !bytes.Equal(got.Value, payload.Value) ||
+			got.Deleted != payload.Deleted {
+			t.Fatalf("%s holds %v, not %v", key, got, payload)
+		}
+	}
+}
+
+func stableStoreSize(t *testing.T, r *Replica) int64 {
+	t.Helper()
+	info, err := os.Stat(r.FileName("stable-store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// The synced log records rebuild the values, ballot and collected tombstones
+func TestLogReplay(t *testing.T) {
+	inTempDir(t)
+	r := durableReplica(t, false)
+	testSet(r, "a", testPayload(1, "a1"))
+	testSet(r, "b", testPayload(1, "b1"))
+	testSet(r, "a", testPayload(3, "a3"))
+	testSet(r, "a", testPayload(2, "a2")) // older, not logged
+	testSet(r, "c", pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 4, ID: 1}, Deleted: TRUE})
+	testSet(r, "d", pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 6, ID: 1}, Deleted: TRUE})
+	r.collectTombstone("d", pineappleproto.Tag{Timestamp: 6, ID: 1})
+	r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_COLLECT, Key: "d",
+		Payload: pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 6, ID: 1}, Deleted: TRUE}})
+	r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_PROMISE, Ballot: 7})
+	r.sync()
+
+	recovered := durableReplica(t, true)
+	checkData(t, recovered, map[state.Key]pineappleproto.Payload{
+		"a": testPayload(3, "a3"),
+		"b": testPayload(1, "b1"),
+		"c": {Tag: pineappleproto.Tag{Timestamp: 4, ID: 1}, Deleted: TRUE},
+	})
+	if recovered.defaultBallot != 7 || recovered.collectedUpTo != 6 {
+		t.Fatalf("recovered ballot %d, collected up to %d", recovered.defaultBallot, recovered.collectedUpTo)
+	}
+}
+
+// A record torn by a crash is dropped and truncated, so that the records written after recovering replay too
+func TestTornLogTail(t *testing.T) {
+	inTempDir(t)
+	r := durableReplica(t, false)
+	testSet(r, "a", testPayload(1, "a1"))
+	r.sync()
+	whole := stableStoreSize(t, r)
+
+	var torn bytes.Buffer
+	w := bufio.NewWriter(&torn)
+	(&pineappleproto.LogRecord{Type: pineappleproto.LOG_SET, Key: "b", Payload: testPayload(1, "b1")}).Marshal(w)
+	w.Flush()
+	if _, err := r.StableStore.Write(torn.Bytes()[:torn.Len()-3]); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := durableReplica(t, true)
+	checkData(t, recovered, map[state.Key]pineappleproto.Payload{"a": testPayload(1, "a1")})
+	if size := stableStoreSize(t, recovered); size != whole {
+		t.Fatalf("stable store of %d bytes, not truncated to %d", size, whole)
+	}
+
+	testSet(recovered, "c", testPayload(2, "c2"))
+	recovered.sync()
+	again := durableReplica(t, true)
+	checkData(t, again, map[state.Key]pineappleproto.Payload{"a": testPayload(1, "a1"), "c": testPayload(2, "c2")})
+}
+
+// A checkpoint replaces the log with a snapshot, recovery loads it and replays the records written since.
+// Replaying the replaced records over the snapshot, as after a crash before the truncation, rebuilds the same state
+func TestCheckpointRecovery(t *testing.T) {
+	inTempDir(t)
+	r := durableReplica(t, false)
+	testSet(r, "a", testPayload(1, "a1"))
+	testSet(r, "b", testPayload(1, "b1"))
+	testSet(r, "c", pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 4, ID: 1}, Deleted: TRUE})
+	r.sync()
+	replaced, err := os.ReadFile(r.FileName("stable-store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.checkpoint()
+	if size := stableStoreSize(t, r); size != 0 || r.records != 0 {
+		t.Fatalf("stable store of %d bytes and %d records after the checkpoint", size, r.records)
+	}
+	if _, err := os.Stat(r.snapshotFile()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(r.snapshotFile() + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary snapshot left: %v", err)
+	}
+	testSet(r, "a", testPayload(2, "a2"))
+	testSet(r, "d", testPayload(2, "d2"))
+	r.sync()
+
+	want := map[state.Key]pineappleproto.Payload{
+		"a": testPayload(2, "a2"),
+		"b": testPayload(1, "b1"),
+		"c": {Tag: pineappleproto.Tag{Timestamp: 4, ID: 1}, Deleted: TRUE},
+		"d": testPayload(2, "d2"),
+	}
+	recovered := durableReplica(t, true)
+	checkData(t, recovered, want)
+
+	// crash between the rename of the snapshot and the truncation of the log
+	if err := os.WriteFile(r.FileName("stable-store"), replaced, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want["a"] = testPayload(1, "a1")
+	delete(want, "d")
+	checkData(t, durableReplica(t, true), want)
+}
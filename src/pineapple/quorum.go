@@ -0,0 +1,249 @@
+package pineapple
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Phases that wait for a quorum
+const (
+	READ_QUORUM    uint8 = iota // ABD get phase and RMWGet
+	WRITE_QUORUM                // ABD set phase
+	PREPARE_QUORUM              // RMW phase 1 (Prepare)
+	ACCEPT_QUORUM               // RMW phase 2 (RMWSet)
+)
+
+// How quorums are formed
+const (
+	QUORUM_COUNT   = "count"   // a number of replicas
+	QUORUM_WEIGHT  = "weight"  // replicas whose weights add up to a threshold
+	QUORUM_REGIONS = "regions" // a majority of the replicas of a majority of the regions
+)
+
+// Assigns each replica to a region and a weight
+type Topology struct {
+	Region []int    // region of each replica, as an index in Names
+	Weight []int    // weight of each replica
+	Names  []string // region names
+	Size   []int    // replicas in each region
+}
+
+// Reads a topology file with one "<replica id> <region> <weight>" line per replica.
+// Empty lines and lines starting with # are ignored
+func LoadTopology(path string, n int) (*Topology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &Topology{make([]int, n), make([]int, n), nil, nil}
+	seen := make([]bool, n)
+	regions := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected <replica id> <region> <weight>", path, line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 0 || id >= n {
+			return nil, fmt.Errorf("%s:%d: bad replica id %q", path, line, fields[0])
+		}
+		weight, err := strconv.Atoi(fields[2])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s:%d: bad weight %q", path, line, fields[2])
+		}
+		region, present := regions[fields[1]]
+		if !present {
+			region = len(t.Names)
+			regions[fields[1]] = region
+			t.Names = append(t.Names, fields[1])
+			t.Size = append(t.Size, 0)
+		}
+		if seen[id] {
+			t.Size[t.Region[id]]--
+		}
+		seen[id] = true
+		t.Region[id] = region
+		t.Weight[id] = weight
+		t.Size[region]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for id := 0; id < n; id++ {
+		if !seen[id] {
+			return nil, fmt.Errorf("%s: replica %d has no region", path, id)
+		}
+	}
+	return t, nil
+}
+
+func (t *Topology) totalWeight() int {
+	total := 0
+	for _, w := range t.Weight {
+		total += w
+	}
+	return total
+}
+
+// Replaces unset quorum sizes by a majority, and stops the replica if quorums that must intersect may not.
+// Weighted quorums are sized in weight rather than in replicas
+func (r *Replica) checkQuorums() {
+	total := r.N
+	switch r.quorumMode {
+	case QUORUM_COUNT:
+	case QUORUM_WEIGHT, QUORUM_REGIONS:
+		if r.topology == nil {
+			log.Fatalf("Quorum mode %s needs a topology\n", r.quorumMode)
+		}
+		if r.quorumMode == QUORUM_REGIONS {
+			for region, size := range r.topology.Size {
+				if size == 0 {
+					// its majority could never be reached
+					log.Fatalf("Region %s of the topology has no replicas\n", r.topology.Names[region])
+				}
+			}
+			for _, q := range []int{r.readQuorum, r.writeQuorum, r.prepareQuorum, r.acceptQuorum} {
+				if q != 0 {
+					log.Fatalf("Quorum sizes cannot be set in quorum mode %s\n", r.quorumMode)
+				}
+			}
+			// a majority of a majority always intersects another one
+			return
+		}
+		total = r.topology.totalWeight()
+	default:
+		log.Fatalf("Unknown quorum mode %s\n", r.quorumMode)
+	}
+
+	majority := total>>1 + 1
+	for _, q := range []*int{&r.readQuorum, &r.writeQuorum, &r.prepareQuorum, &r.acceptQuorum} {
+		if *q == 0 {
+			*q = majority
+		}
+		if *q < 1 || *q > total {
+			log.Fatalf("Quorum size %d out of range for a total of %d\n", *q, total)
+		}
+	}
+	if r.readQuorum+r.writeQuorum <= total {
+		// a read could miss the last write
+		log.Fatalf("Read quorum %d and write quorum %d do not intersect\n", r.readQuorum, r.writeQuorum)
+	}
+	if r.readQuorum+r.acceptQuorum <= total {
+		// a read could miss the last RMW
+		log.Fatalf("Read quorum %d and accept quorum %d do not intersect\n", r.readQuorum, r.acceptQuorum)
+	}
+	if r.prepareQuorum+r.acceptQuorum <= total {
+		// a new leader could miss a chosen RMW
+		log.Fatalf("Prepare quorum %d and accept quorum %d do not intersect\n", r.prepareQuorum, r.acceptQuorum)
+	}
+}
+
+func (r *Replica) quorumSize(kind uint8) int {
+	switch kind {
+	case READ_QUORUM:
+		return r.readQuorum
+	case WRITE_QUORUM:
+		return r.writeQuorum
+	case PREPARE_QUORUM:
+		return r.prepareQuorum
+	default:
+		return r.acceptQuorum
+	}
+}
+
+// Whether the peers in acks, together with this replica, form a quorum for the phase.
+// Only members count, and while switching configurations the old members must form a majority too
+func (r *Replica) isQuorum(kind uint8, acks map[int32]bool) bool {
+	if r.oldMembers != nil && !r.isMajorityOf(r.oldMembers, acks) {
+		return false
+	}
+	switch r.quorumMode {
+	case QUORUM_WEIGHT:
+		weight := r.topology.Weight[r.Id]
+		for q, ok := range acks {
+			if ok && q != r.Id {
+				weight += r.topology.Weight[q]
+			}
+		}
+		return weight >= r.quorumSize(kind)
+
+	case QUORUM_REGIONS:
+		members := make([]int, len(r.topology.Names))
+		members[r.topology.Region[r.Id]]++
+		for q, ok := range acks {
+			if ok && q != r.Id {
+				members[r.topology.Region[q]]++
+			}
+		}
+		regions := 0
+		for region, count := range members {
+			if count > r.topology.Size[region]>>1 {
+				regions++
+			}
+		}
+		return regions > len(members)>>1
+
+	default:
+		count := 0
+		if r.members[r.Id] {
+			count++
+		}
+		for q, ok := range acks {
+			if ok && q != r.Id && r.members[q] {
+				count++
+			}
+		}
+		return count >= r.quorumSize(kind)
+	}
+}
+
+// Whether a quorum for the phase can still be formed without the peers that refused it
+func (r *Replica) quorumReachable(kind uint8, refused func(q int32) bool) bool {
+	rest := make(map[int32]bool, r.N)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && !refused(q) {
+			rest[q] = true
+		}
+	}
+	return r.isQuorum(kind, rest)
+}
+
+// Peers to send a phase to, fastest first. Peers in has already count towards the quorum and are skipped.
+// A thrifty replica only picks enough alive peers to form a quorum, otherwise every alive peer is picked.
+// Leaseholders, which must acknowledge every write, come first
+func (r *Replica) phasePeers(kind uint8, has map[int32]bool, holders []int32) []int32 {
+	peers := make([]int32, 0, r.N-1)
+	chosen := make(map[int32]bool, r.N)
+	for q, ok := range has {
+		chosen[q] = ok
+	}
+	for _, q := range holders {
+		if q != r.Id && r.Alive[q].Load() && !chosen[q] {
+			peers = append(peers, q)
+			chosen[q] = true
+		}
+	}
+	for i := 0; i < r.N-1; i++ {
+		if r.Thrifty && r.isQuorum(kind, chosen) {
+			break
+		}
+		q := r.PreferredPeerOrder[i]
+		if !r.Alive[q].Load() || chosen[q] {
+			continue
+		}
+		peers = append(peers, q)
+		chosen[q] = true
+	}
+	return peers
+}
@@ -0,0 +1,149 @@
+package pineapple
+
+import (
+	"fmt"
+	"log"
+
+	"pineapple/src/masterproto"
+)
+
+// Membership reconfiguration.
+// The master changes the replicas of a group one at a time, in two epochs. In the first one, quorums must be
+// formed among both the old and the new members; a replica being added copies the state of a read quorum of
+// the old members meanwhile, without voting. Once every live replica switched to it and the new replica caught
+// up, the master moves the group to a second epoch with the new members only. Any majorities of two member
+// sets that differ by one replica intersect, so operations still in flight keep seeing each other
+
+// Configuration received from the master, applied by the Run loop
+type reconfiguration struct {
+	args  *masterproto.ReconfigureArgs
+	reply *masterproto.ReconfigureReply
+	done  chan error
+}
+
+// Called by the master to move the replica to a new configuration of its group
+func (r *Replica) Reconfigure(args *masterproto.ReconfigureArgs, reply *masterproto.ReconfigureReply) error {
+	rc := &reconfiguration{args, reply, make(chan error, 1)}
+	r.reconfigureChan <- rc
+	return <-rc.done
+}
+
+func allMembers(n int) []bool {
+	members := make([]bool, n)
+	for q := range members {
+		members[q] = true
+	}
+	return members
+}
+
+func countMembers(members []bool) int {
+	count := 0
+	for _, member := range members {
+		if member {
+			count++
+		}
+	}
+	return count
+}
+
+// Only majority quorums counted in replicas are resized with the group
+func (r *Replica) checkReconfigurable() error {
+	if r.quorumMode != QUORUM_COUNT {
+		return fmt.Errorf("groups with %s quorums cannot be reconfigured", r.quorumMode)
+	}
+	if r.coded != nil {
+		return fmt.Errorf("groups storing coded fragments cannot be reconfigured")
+	}
+	majority := countMembers(r.members)>>1 + 1
+	for _, q := range []int{r.readQuorum, r.writeQuorum, r.prepareQuorum, r.acceptQuorum} {
+		if q != majority {
+			return fmt.Errorf("groups with quorums other than majorities cannot be reconfigured")
+		}
+	}
+	return nil
+}
+
+// Switch to a configuration: connect to the new replicas, drop the removed ones and resize the quorums
+func (r *Replica) applyConfig(config *masterproto.ReconfigureArgs) error {
+	if len(config.NodeList) > r.N {
+		if err := r.AddPeers(config.NodeList[r.N:]); err != nil {
+			return err
+		}
+	}
+	r.epoch = config.Epoch
+	r.members = append([]bool(nil), config.Members...)
+	r.oldMembers = nil
+	if config.Old != nil {
+		r.oldMembers = append([]bool(nil), config.Old...)
+	}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && !r.inGroup(q) && !r.Removed[q] {
+			r.RemovePeer(q)
+		}
+	}
+
+	majority := countMembers(r.members)>>1 + 1
+	r.readQuorum, r.writeQuorum, r.prepareQuorum, r.acceptQuorum = majority, majority, majority, majority
+	return nil
+}
+
+func (r *Replica) handleReconfigure(rc *reconfiguration) {
+	if rc.args.Epoch > r.epoch {
+		if err := r.checkReconfigurable(); err != nil {
+			rc.done <- err
+			return
+		}
+		if err := r.applyConfig(rc.args); err != nil {
+			rc.done <- err
+			return
+		}
+		log.Printf("Replica %d switched to configuration epoch %d, members %v, old members %v\n",
+			r.Id, r.epoch, r.members, r.oldMembers)
+		if r.removed() {
+			log.Printf("Replica %d was removed from the group\n", r.Id)
+			if r.IsLeader {
+				r.stepDown()
+			}
+			for _, q := range r.groupPeers() {
+				r.RemovePeer(q)
+			}
+		}
+	}
+	rc.reply.Epoch = r.epoch
+	rc.reply.CaughtUp = !r.catchingUp
+	rc.done <- nil
+}
+
+// Is the replica a member, or an old member while switching configurations
+func (r *Replica) inGroup(q int32) bool {
+	return r.members[q] || (r.oldMembers != nil && r.oldMembers[q])
+}
+
+func (r *Replica) removed() bool {
+	return !r.inGroup(r.Id)
+}
+
+// Peers still in the group, including a replica being added
+func (r *Replica) groupPeers() []int32 {
+	peers := make([]int32, 0, r.N-1)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && !r.Removed[q] {
+			peers = append(peers, q)
+		}
+	}
+	return peers
+}
+
+// Whether the peers in acks, together with this replica if it is one, form a majority of a member set
+func (r *Replica) isMajorityOf(members []bool, acks map[int32]bool) bool {
+	count := 0
+	if members[r.Id] {
+		count++
+	}
+	for q, ok := range acks {
+		if ok && q != r.Id && members[q] {
+			count++
+		}
+	}
+	return count >= countMembers(members)>>1+1
+}
@@ -0,0 +1,306 @@
+package pineapple
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"pineapple/src/fastrpc"
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+const SCAN_CHUNK = 100       // entries per reply streamed to the client
+const MAX_SCAN_LIMIT = 10000 // most entries returned by a scan
+
+// Phases of a quorum scan
+const (
+	SCAN_QUERY uint8 = iota
+	SCAN_WRITE_BACK
+)
+
+// Range scans.
+// A local scan returns the entries of the replica that received it, which may be stale. A quorum scan runs
+// ABD on every key of the range at once: it collects the entries of a read quorum, keeps the value with the
+// largest tag of each key, and stores on a write quorum the values too few replicas had before replying.
+// Each key is then read atomically, but the scan is no snapshot, writes to other keys may land while it runs.
+// As for GETs, the holders of read leases on the keys must have the values returned: the replicas report the
+// leases they granted on the range, and the write-back waits for the holders to acknowledge it
+
+// Quorum scan coordinated by this replica
+type scanOp struct {
+	scan     *genericsmr.Scan
+	limit    int
+	phase    uint8
+	code     uint8 // message of the current phase, resent on timeout
+	msg      fastrpc.Serializable
+	replied  map[int32]bool
+	oks      map[int32]bool
+	deadline time.Time
+	retries  int
+	entries  map[state.Key]pineappleproto.Payload // largest tag received for each key
+	hasMax   map[state.Key]map[int32]bool         // replicas that sent it
+	full     bool                                 // a replica stopped at the limit
+	cutoff   state.Key                            // smallest last key sent by those replicas, later keys may be missing
+	result   []pineappleproto.KeyPayload
+	more     bool                // entries after the result may exist
+	holders  map[int32]time.Time // leaseholders reported by the peers, with their expiry
+}
+
+func scanLimit(limit int32) int {
+	if limit <= 0 || limit > MAX_SCAN_LIMIT {
+		return MAX_SCAN_LIMIT
+	}
+	return int(limit)
+}
+
+// Entries of this replica in a key range, in key order, and whether it stopped at the limit.
+// Keys never written are skipped, tombstones too unless asked for
+func (r *Replica) localEntries(start state.Key, end state.Key, limit int, tombstones bool) ([]pineappleproto.KeyPayload, bool) {
+	entries := make([]pineappleproto.KeyPayload, 0)
+	full := false
+	r.keys.Range(start, end, func(key state.Key) bool {
+		payload := r.data[key]
+		if payload.Tag.Timestamp == 0 || (payload.Deleted == TRUE && !tombstones) {
+			return true
+		}
+		if len(entries) == limit {
+			full = true
+			return false
+		}
+		entries = append(entries, pineappleproto.KeyPayload{Key: key, Payload: payload})
+		return true
+	})
+	return entries, full
+}
+
+func (r *Replica) handleScan(scan *genericsmr.Scan) {
+	if r.coded != nil || r.removed() {
+		// fragments cannot be compared across keys without decoding them, a removed replica is stale
+		r.replyScan(scan, nil, false, FALSE)
+		return
+	}
+	limit := scanLimit(scan.Limit)
+	if scan.Quorum == FALSE {
+		entries, full := r.localEntries(scan.Start, scan.End, limit, false)
+		r.replyScan(scan, entries, full, TRUE)
+		return
+	}
+
+	id := r.crtScan
+	r.crtScan++
+	op := &scanOp{
+		scan:    scan,
+		limit:   limit,
+		entries: make(map[state.Key]pineappleproto.Payload),
+		hasMax:  make(map[state.Key]map[int32]bool),
+	}
+	r.scans[id] = op
+	own, full := r.localEntries(scan.Start, scan.End, limit, true)
+	r.mergeScanEntries(op, r.Id, own, full)
+	r.startScanPhase(op, SCAN_QUERY, r.scanQueryRPC,
+		&pineappleproto.ScanQuery{ReplicaID: r.Id, Scan: id, Start: scan.Start, End: scan.End, Limit: int32(limit)})
+	if r.isQuorum(READ_QUORUM, op.oks) {
+		r.finishScanQuery(id, op)
+		return
+	}
+	r.bcastScan(op, READ_QUORUM)
+}
+
+func (r *Replica) startScanPhase(op *scanOp, phase uint8, code uint8, msg fastrpc.Serializable) {
+	op.phase = phase
+	op.code = code
+	op.msg = msg
+	op.replied = make(map[int32]bool)
+	op.oks = make(map[int32]bool)
+	op.deadline = time.Now().Add(r.timeout)
+	op.retries = 0
+}
+
+func (r *Replica) bcastScan(op *scanOp, kind uint8) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Scan bcast failed:", err)
+		}
+	}()
+	for _, q := range r.phasePeers(kind, nil, liveHolders(op.holders)) {
+		r.SendMsg(q, op.code, op.msg)
+	}
+}
+
+// Keep the entries with the largest tags, and the last key of replicas that stopped at the limit
+func (r *Replica) mergeScanEntries(op *scanOp, q int32, data []pineappleproto.KeyPayload, full bool) {
+	for _, kp := range data {
+		current, present := op.entries[kp.Key]
+		if !present || r.isLargerTag(current.Tag, kp.Payload.Tag) {
+			op.entries[kp.Key] = kp.Payload
+			op.hasMax[kp.Key] = map[int32]bool{q: true}
+		} else if current.Tag == kp.Payload.Tag {
+			op.hasMax[kp.Key][q] = true
+		}
+	}
+	if full && len(data) > 0 {
+		last := data[len(data)-1].Key
+		if !op.full || last < op.cutoff {
+			op.cutoff = last
+		}
+		op.full = true
+	}
+}
+
+func (r *Replica) handleScanQuery(query *pineappleproto.ScanQuery) {
+	data, full := r.localEntries(query.Start, query.End, scanLimit(query.Limit), true)
+	reply := &pineappleproto.ScanQueryReply{ReplicaID: r.Id, Scan: query.Scan, Full: FALSE, Data: data,
+		Leases: r.grantedLeasesIn(query.Start, query.End)}
+	if full {
+		reply.Full = TRUE
+	}
+	r.replyAfterSync(func() { r.SendMsg(query.ReplicaID, r.scanQueryReplyRPC, reply) })
+}
+
+func (r *Replica) handleScanQueryReply(reply *pineappleproto.ScanQueryReply) {
+	op := r.scans[reply.Scan]
+	if op == nil || op.phase != SCAN_QUERY || op.replied[reply.ReplicaID] {
+		return
+	}
+	op.replied[reply.ReplicaID] = true
+	op.oks[reply.ReplicaID] = true
+	op.holders = r.addLeases(op.holders, reply.Leases)
+	r.mergeScanEntries(op, reply.ReplicaID, reply.Data, reply.Full == TRUE)
+	if r.isQuorum(READ_QUORUM, op.oks) {
+		r.finishScanQuery(reply.Scan, op)
+	}
+}
+
+// A read quorum answered: keep the keys every replica sent entries up to, store their largest tags locally,
+// then write back those a write quorum or a leaseholder does not have yet
+func (r *Replica) finishScanQuery(id int32, op *scanOp) {
+	op.holders = r.addLeases(op.holders, r.grantedLeasesIn(op.scan.Start, op.scan.End))
+	keys := make([]state.Key, 0, len(op.entries))
+	for key := range op.entries {
+		if !op.full || key <= op.cutoff {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	op.more = op.full
+	writeBack := make([]pineappleproto.KeyPayload, 0)
+	for _, key := range keys {
+		if len(op.result) == op.limit {
+			op.more = true
+			break
+		}
+		payload := op.entries[key]
+		if r.isLargerTag(r.data[key].Tag, payload.Tag) {
+			r.setData(key, payload)
+			r.recordSet(key, payload)
+		}
+		if !r.isQuorum(WRITE_QUORUM, op.hasMax[key]) || !holdersAcked(op.holders, op.hasMax[key]) {
+			writeBack = append(writeBack, pineappleproto.KeyPayload{Key: key, Payload: payload})
+		}
+		if found(payload) == TRUE {
+			op.result = append(op.result, pineappleproto.KeyPayload{Key: key, Payload: payload})
+		}
+	}
+
+	r.startScanPhase(op, SCAN_WRITE_BACK, r.scanWriteBackRPC,
+		&pineappleproto.ScanWriteBack{ReplicaID: r.Id, Scan: id, Data: writeBack})
+	if len(writeBack) == 0 || r.writeBackDone(op) {
+		r.finishScan(id, op)
+		return
+	}
+	r.bcastScan(op, WRITE_QUORUM)
+}
+
+func (r *Replica) handleScanWriteBack(writeBack *pineappleproto.ScanWriteBack) {
+	written := make(map[state.Key]bool, len(writeBack.Data))
+	for _, kp := range writeBack.Data {
+		written[kp.Key] = true
+		if r.isLargerTag(r.data[kp.Key].Tag, kp.Payload.Tag) {
+			r.setData(kp.Key, kp.Payload)
+			r.recordSet(kp.Key, kp.Payload)
+		}
+	}
+	reply := &pineappleproto.ScanWriteBackReply{ReplicaID: r.Id, Scan: writeBack.Scan,
+		Leases: r.grantedLeasesOn(func(key state.Key) bool { return written[key] })}
+	r.replyAfterSync(func() { r.SendMsg(writeBack.ReplicaID, r.scanWriteBackReplyRPC, reply) })
+}
+
+func (r *Replica) handleScanWriteBackReply(reply *pineappleproto.ScanWriteBackReply) {
+	op := r.scans[reply.Scan]
+	if op == nil || op.phase != SCAN_WRITE_BACK || op.replied[reply.ReplicaID] {
+		return
+	}
+	op.replied[reply.ReplicaID] = true
+	op.oks[reply.ReplicaID] = true
+	op.holders = r.addLeases(op.holders, reply.Leases)
+	if r.writeBackDone(op) {
+		r.finishScan(reply.Scan, op)
+	}
+}
+
+// Wait for a write quorum of acknowledgements, including those of the leaseholders
+func (r *Replica) writeBackDone(op *scanOp) bool {
+	return r.isQuorum(WRITE_QUORUM, op.oks) && holdersAcked(op.holders, op.oks)
+}
+
+// Reply to the client once the values this replica stored for the scan are durable
+func (r *Replica) finishScan(id int32, op *scanOp) {
+	delete(r.scans, id)
+	r.replyAfterSync(func() { r.replyScan(op.scan, op.result, op.more, TRUE) })
+}
+
+// Stream the entries found to the client, SCAN_CHUNK at a time
+func (r *Replica) replyScan(scan *genericsmr.Scan, entries []pineappleproto.KeyPayload, more bool, ok uint8) {
+	for start := 0; ; start += SCAN_CHUNK {
+		end := start + SCAN_CHUNK
+		if end > len(entries) {
+			end = len(entries)
+		}
+		reply := &genericsmrproto.ScanReply{
+			OK:        ok,
+			CommandId: scan.CommandId,
+			Last:      FALSE,
+			More:      FALSE,
+			Entries:   make([]genericsmrproto.ScanEntry, 0, end-start),
+			Timestamp: scan.Timestamp}
+		for _, kp := range entries[start:end] {
+			reply.Entries = append(reply.Entries, genericsmrproto.ScanEntry{Key: kp.Key, Value: kp.Payload.Value,
+				TagTS: int64(kp.Payload.Tag.Timestamp), TagID: int32(kp.Payload.Tag.ID)})
+		}
+		if end == len(entries) {
+			reply.Last = TRUE
+			if more {
+				reply.More = TRUE
+			}
+		}
+		r.ReplyScan(reply, scan.Reply)
+		if reply.Last == TRUE {
+			return
+		}
+	}
+}
+
+// Resend the current phase of the scans that did not reach a quorum in time, fail them after maxRetries
+func (r *Replica) checkScanTimeouts(now time.Time) {
+	for id, op := range r.scans {
+		if now.Before(op.deadline) {
+			continue
+		}
+		if op.retries >= r.maxRetries {
+			delete(r.scans, id)
+			r.replyScan(op.scan, nil, false, FALSE)
+			continue
+		}
+		op.retries++
+		op.deadline = now.Add(r.timeout)
+		for q := int32(0); q < int32(r.N); q++ {
+			if q != r.Id && r.Alive[q].Load() && !op.replied[q] {
+				r.SendMsg(q, op.code, op.msg)
+			}
+		}
+	}
+}
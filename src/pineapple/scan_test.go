@@ -0,0 +1,49 @@
+package pineapple
+
+import (
+	"testing"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Local entries skip tombstones unless asked for, and report whether the limit cut the range short
+func TestLocalEntries(t *testing.T) {
+	inTempDir(t)
+	r := stoppedReplica(t, testConfig(0, nil), 3)
+	for i, key := range []state.Key{"a", "b", "c", "d"} {
+		r.setData(key, pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: i + 1}, Value: state.Value(key)})
+	}
+	r.setData("bb", pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 1}, Deleted: TRUE})
+
+	tests := []struct {
+		start, end state.Key
+		limit      int
+		tombstones bool
+		want       string
+		full       bool
+	}{
+		{"", "", 10, false, "a b c d", false},
+		{"", "", 10, true, "a b bb c d", false},
+		{"b", "d", 10, false, "b c", false},
+		{"b", "d", 10, true, "b bb c", false},
+		{"", "", 4, false, "a b c d", false},
+		{"", "", 3, false, "a b c", true},
+		{"b", "", 1, true, "b", true},
+		{"bb", "c", 1, false, "", false},
+	}
+	for _, test := range tests {
+		entries, full := r.localEntries(test.start, test.end, test.limit, test.tombstones)
+		got := ""
+		for _, e := range entries {
+			if got != "" {
+				got += " "
+			}
+			got += string(e.Key)
+		}
+		if got != test.want || full != test.full {
+			t.Errorf("[%q, %q) limit %d, tombstones %v: %q full %v, not %q full %v",
+				test.start, test.end, test.limit, test.tombstones, got, full, test.want, test.full)
+		}
+	}
+}
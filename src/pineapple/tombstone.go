@@ -0,0 +1,182 @@
+package pineapple
+
+import (
+	"log"
+	"time"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+const TOMBSTONE_SWEEP = 1000 * 1000 * 1000      // look for tombstones to garbage collect every second
+const TOMBSTONE_GRACE = 10 * 1000 * 1000 * 1000 // least time a tombstone is kept after this replica stored it
+const TOMBSTONE_BATCH = 1000                    // tombstones checked per message
+
+// Deletes and tombstones.
+// A DELETE is an ABD write of an empty payload marked as deleted, ordered against concurrent writes by its tag.
+// Once every replica reports the tombstone, a newer value or no value for the key, no replica can still
+// return an older value, and the tombstone is removed. The replica then tags later writes above the collected tag,
+// so that they still win over the tombstone on the replicas that have not collected it yet. Peers acknowledging
+// a tombstone they hold no value for do the same, the others hold its tag or a newer one, and replicas joining
+// later copy the highest collected tag with the state.
+// The grace period outlasts the retransmissions of operations, so no older value is still in flight
+
+// Tombstone stored by this replica
+type tombstone struct {
+	tag  pineappleproto.Tag
+	seen time.Time // when the sweep first found it
+}
+
+// Tombstones whose tags this replica asked its peers for
+type tombstoneCheck struct {
+	seq        int32
+	tombstones []pineappleproto.KeyTag
+	replied    map[int32]bool
+	acked      []int // peers holding no older value, by tombstone
+	peers      int   // peers in the group, all of them must acknowledge
+}
+
+// Does the payload hold a value, rather than a tombstone or the initial empty payload
+func found(payload pineappleproto.Payload) uint8 {
+	if payload.Deleted == TRUE || payload.Tag.Timestamp == 0 {
+		return FALSE
+	}
+	return TRUE
+}
+
+// Tag of a write by this replica, above the tag stored for the key and those of the collected tombstones
+func (r *Replica) nextTag(key state.Key) pineappleproto.Tag {
+	timestamp := r.data[key].Tag.Timestamp
+	if r.collectedUpTo > timestamp {
+		timestamp = r.collectedUpTo
+	}
+	return pineappleproto.Tag{Timestamp: timestamp + 1, ID: int(r.Id)}
+}
+
+// Ask the peers for their tags of the tombstones kept for the grace period.
+// A check still waiting for replies is replaced, its late replies are ignored
+func (r *Replica) sweepTombstones() {
+	now := time.Now()
+	r.nextTombstoneSweep = now.Add(TOMBSTONE_SWEEP)
+	r.gcCheck = nil
+
+	for key, payload := range r.data {
+		if payload.Deleted == FALSE {
+			continue
+		}
+		if ts, present := r.tombstones[key]; !present || ts.tag != payload.Tag {
+			r.tombstones[key] = tombstone{payload.Tag, now}
+		}
+	}
+	candidates := make([]pineappleproto.KeyTag, 0)
+	for key, ts := range r.tombstones {
+		if payload := r.data[key]; payload.Deleted == FALSE || payload.Tag != ts.tag {
+			// overwritten or collected
+			delete(r.tombstones, key)
+			continue
+		}
+		if now.Sub(ts.seen) >= TOMBSTONE_GRACE && len(candidates) < TOMBSTONE_BATCH {
+			candidates = append(candidates, pineappleproto.KeyTag{Key: key, Tag: ts.tag})
+		}
+	}
+	if len(candidates) == 0 || r.catchingUp {
+		return
+	}
+	peers := r.groupPeers()
+	for _, q := range peers {
+		if !r.Alive[q].Load() {
+			// the peer cannot acknowledge the tombstones
+			return
+		}
+	}
+
+	r.gcSeq++
+	r.gcCheck = &tombstoneCheck{r.gcSeq, candidates, make(map[int32]bool), make([]int, len(candidates)), len(peers)}
+	if len(peers) == 0 {
+		r.collectTombstones()
+		return
+	}
+	r.bcastTombstoneCheck(&pineappleproto.TombstoneCheck{ReplicaID: r.Id, Seq: r.gcSeq, Tombstones: candidates})
+}
+
+func (r *Replica) bcastTombstoneCheck(check *pineappleproto.TombstoneCheck) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Tombstone check bcast failed:", err)
+		}
+	}()
+	for _, q := range r.groupPeers() {
+		r.SendMsg(q, r.tombstoneCheckRPC, check)
+	}
+}
+
+func (r *Replica) handleTombstoneCheck(check *pineappleproto.TombstoneCheck) {
+	reply := &pineappleproto.TombstoneCheckReply{ReplicaID: r.Id, Seq: check.Seq,
+		Tags: make([]pineappleproto.Tag, len(check.Tombstones))}
+	for i, kt := range check.Tombstones {
+		reply.Tags[i] = r.data[kt.Key].Tag
+		if reply.Tags[i].Timestamp == 0 && kt.Tag.Timestamp > r.collectedUpTo {
+			// the checking replica may collect it, a write coordinated here must still win over the tombstone
+			r.learnCollectedUpTo(kt.Tag.Timestamp)
+			r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_COLLECT, Key: kt.Key,
+				Payload: pineappleproto.Payload{Tag: kt.Tag, Deleted: TRUE}})
+		}
+	}
+	r.replyAfterSync(func() { r.SendMsg(check.ReplicaID, r.tombstoneCheckReplyRPC, reply) })
+}
+
+// Count the peers holding no older value than the tombstones, then collect the tombstones all of them cover
+func (r *Replica) handleTombstoneCheckReply(reply *pineappleproto.TombstoneCheckReply) {
+	check := r.gcCheck
+	if check == nil || reply.Seq != check.seq || check.replied[reply.ReplicaID] ||
+		len(reply.Tags) != len(check.tombstones) {
+		return
+	}
+	check.replied[reply.ReplicaID] = true
+	for i, tag := range reply.Tags {
+		kt := check.tombstones[i]
+		// a zero timestamp means the peer has no value, or already collected the tombstone
+		if tag.Timestamp == 0 || tag == kt.Tag || tag.Timestamp > kt.Tag.Timestamp {
+			check.acked[i]++
+		}
+	}
+	if len(check.replied) == check.peers {
+		r.collectTombstones()
+	}
+}
+
+// Remove the tombstones acknowledged by every peer, unless they were overwritten since the check
+func (r *Replica) collectTombstones() {
+	check := r.gcCheck
+	r.gcCheck = nil
+	collected := 0
+	for i, kt := range check.tombstones {
+		if check.acked[i] < check.peers {
+			continue
+		}
+		if payload := r.data[kt.Key]; payload.Deleted == FALSE || payload.Tag != kt.Tag {
+			continue
+		}
+		r.collectTombstone(kt.Key, kt.Tag)
+		r.record(&pineappleproto.LogRecord{Type: pineappleproto.LOG_COLLECT, Key: kt.Key,
+			Payload: pineappleproto.Payload{Tag: kt.Tag, Deleted: TRUE}})
+		collected++
+	}
+	if collected > 0 {
+		log.Printf("Replica %d collected %d tombstones\n", r.Id, collected)
+	}
+}
+
+func (r *Replica) collectTombstone(key state.Key, tag pineappleproto.Tag) {
+	delete(r.data, key)
+	r.keys.Delete(key)
+	delete(r.tombstones, key)
+	delete(r.confirmed, key)
+	r.learnCollectedUpTo(tag.Timestamp)
+}
+
+func (r *Replica) learnCollectedUpTo(timestamp int) {
+	if timestamp > r.collectedUpTo {
+		r.collectedUpTo = timestamp
+	}
+}
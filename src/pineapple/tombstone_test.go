@@ -0,0 +1,138 @@
+package pineapple
+
+import (
+	"testing"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Stores a tombstone and backdates it past the grace period
+func agedTombstone(r *Replica, key state.Key, tag pineappleproto.Tag) {
+	r.setData(key, pineappleproto.Payload{Tag: tag, Deleted: TRUE})
+	r.sweepTombstones()
+	ts := r.tombstones[key]
+	ts.seen = ts.seen.Add(-TOMBSTONE_GRACE)
+	r.tombstones[key] = ts
+}
+
+// Sweeps and checks the tombstones asked to the peers
+func sweepChecking(t *testing.T, r *Replica, keys ...state.Key) {
+	t.Helper()
+	r.sweepTombstones()
+	if r.gcCheck == nil || len(r.gcCheck.tombstones) != len(keys) {
+		t.Fatalf("checking %v, not %v", r.gcCheck, keys)
+	}
+	for i, key := range keys {
+		if r.gcCheck.tombstones[i].Key != key {
+			t.Fatalf("checking %v, not %v", r.gcCheck.tombstones, keys)
+		}
+	}
+}
+
+func replyTags(r *Replica, from int32, tags ...pineappleproto.Tag) {
+	r.handleTombstoneCheckReply(&pineappleproto.TombstoneCheckReply{ReplicaID: from, Seq: r.gcCheck.seq, Tags: tags})
+}
+
+// A tombstone is kept while a peer holds an older value, which then cannot come back, and collected once
+// every peer holds the tombstone or no value. Later writes are tagged above it
+func TestTombstoneCollection(t *testing.T) {
+	inTempDir(t)
+	r := stoppedReplica(t, testConfig(0, nil), 3)
+	const key = state.Key("7")
+	deleted := pineappleproto.Tag{Timestamp: 5, ID: 1}
+
+	agedTombstone(r, key, deleted)
+	sweepChecking(t, r, key)
+	replyTags(r, 1, deleted)
+	replyTags(r, 2, pineappleproto.Tag{Timestamp: 3, ID: 2}) // lagging peer
+	if payload, present := r.data[key]; !present || payload.Deleted != TRUE {
+		t.Fatalf("collected the tombstone a peer holds an older value against: %v", payload)
+	}
+
+	// the lagging peer writes the older value back
+	r.handleSet(&pineappleproto.Set{ReplicaID: 2, Key: key,
+		Payload: pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 3, ID: 2}, Value: state.Value("old")}})
+	if payload := r.data[key]; payload.Tag != deleted || payload.Deleted != TRUE {
+		t.Fatalf("older value overwrote the tombstone: %v", payload)
+	}
+
+	sweepChecking(t, r, key)
+	replyTags(r, 1, deleted)
+	replyTags(r, 2, pineappleproto.Tag{}) // no value
+	if payload, present := r.data[key]; present {
+		t.Fatalf("tombstone not collected: %v", payload)
+	}
+	if r.collectedUpTo != deleted.Timestamp {
+		t.Fatalf("collected up to %d, not %d", r.collectedUpTo, deleted.Timestamp)
+	}
+	if tag := r.nextTag(key); tag.Timestamp <= deleted.Timestamp {
+		t.Fatalf("write tagged %v, not above the tombstone %v", tag, deleted)
+	}
+}
+
+// A tombstone overwritten while being checked is not collected
+func TestTombstoneOverwrittenDuringCheck(t *testing.T) {
+	inTempDir(t)
+	r := stoppedReplica(t, testConfig(0, nil), 2)
+	const key = state.Key("7")
+	deleted := pineappleproto.Tag{Timestamp: 5, ID: 1}
+
+	agedTombstone(r, key, deleted)
+	sweepChecking(t, r, key)
+	newer := pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 6, ID: 1}, Value: state.Value("new")}
+	r.setData(key, newer)
+	replyTags(r, 1, deleted)
+	if payload := r.data[key]; payload.Tag != newer.Tag || payload.Deleted != FALSE {
+		t.Fatalf("collected the value written over the tombstone: %v", payload)
+	}
+}
+
+// Tombstones are not checked before the grace period, nor while a peer is down
+func TestTombstoneSweepWaits(t *testing.T) {
+	inTempDir(t)
+	r := stoppedReplica(t, testConfig(0, nil), 3)
+	const key = state.Key("7")
+
+	r.setData(key, pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: 5, ID: 1}, Deleted: TRUE})
+	r.sweepTombstones()
+	r.sweepTombstones()
+	if r.gcCheck != nil {
+		t.Fatalf("checking %v within the grace period", r.gcCheck.tombstones)
+	}
+
+	agedTombstone(r, key, pineappleproto.Tag{Timestamp: 5, ID: 1})
+	r.Alive[2].Store(false)
+	r.sweepTombstones()
+	if r.gcCheck != nil {
+		t.Fatalf("checking %v with a peer down", r.gcCheck.tombstones)
+	}
+	r.Alive[2].Store(true)
+	sweepChecking(t, r, key)
+}
+
+// A replica acknowledging a tombstone it holds no value for tags its later writes above it, after recovering too
+func TestTombstoneCheckWithoutValue(t *testing.T) {
+	inTempDir(t)
+	c := testConfig(2, nil)
+	c.Durable = true
+	r := stoppedReplica(t, c, 3)
+	const key = state.Key("7")
+	deleted := pineappleproto.Tag{Timestamp: 5, ID: 1}
+
+	r.handleTombstoneCheck(&pineappleproto.TombstoneCheck{ReplicaID: 0, Seq: 1,
+		Tombstones: []pineappleproto.KeyTag{{Key: key, Tag: deleted}}})
+	if tag := r.nextTag(key); tag.Timestamp <= deleted.Timestamp {
+		t.Fatalf("write tagged %v, not above the acknowledged tombstone %v", tag, deleted)
+	}
+	r.sync()
+
+	c.Recovering = true
+	recovered := stoppedReplica(t, c, 3)
+	if recovered.collectedUpTo != deleted.Timestamp {
+		t.Fatalf("recovered collected up to %d, not %d", recovered.collectedUpTo, deleted.Timestamp)
+	}
+	if _, present := recovered.data[key]; present {
+		t.Fatalf("recovered a value for %s", key)
+	}
+}
@@ -9,21 +9,28 @@ const (
 	ACCEPT_REPLY
 )
 
+// Phase of an RMW instance reported by an acceptor
+const (
+	RMW_GET_PHASE uint8 = iota
+	RMW_SET_PHASE
+)
+
 type Tag struct {
 	Timestamp int
 	ID        int
 }
 
 type Payload struct {
-	Tag   Tag
-	Value int
+	Tag     Tag
+	Value   state.Value
+	Deleted uint8 // tombstone written by a DELETE, Value is empty
 }
 
 type Get struct {
 	ReplicaID int32
 	Instance  int32
 	Write     uint8
-	Key       int
+	Key       state.Key
 	Payload   Payload
 }
 
@@ -32,63 +39,97 @@ type GetReply struct {
 	Instance  int32
 	OK        uint8
 	Write     uint8
-	Key       int
+	Key       state.Key
 	Payload   Payload
+	KeyLease  int         // nanoseconds of the read lease on the key granted to the coordinator, 0 if none
+	Leases    []LeaseInfo // leases granted by the sender that cover the key
 }
 
 type Set struct {
 	ReplicaID int32
 	Instance  int32
 	Write     uint8
-	Key       int
+	Key       state.Key
 	Payload   Payload
 }
 
 type SetReply struct {
-	Instance int32
+	ReplicaID int32
+	Instance  int32
+	Leases    []LeaseInfo
 }
 
 type Prepare struct {
-	LeaderId   int32
-	Instance   int32
-	Ballot     int32
-	ToInfinity uint8
+	LeaderId    int32
+	Instance    int32
+	Ballot      int32
+	ToInfinity  uint8
+	LeaderEpoch int32 // epoch in which the master made the sender leader
 }
 
 type PrepareReply struct {
+	ReplicaID   int32
+	Instance    int32
+	OK          uint8
+	Ballot      int32
+	Accepted    []AcceptedRMW
+	DoneUpTo    int32 // RMW instances known to be committed, not included in Accepted
+	LeaderEpoch int32 // latest leader epoch known to the acceptor
+}
+
+// Sent by the RMW leader to the replicas of its group when they elect it (see pineapple/election.go)
+type Heartbeat struct {
+	LeaderId    int32
+	LeaderEpoch int32
+}
+
+// RMW instance accepted by an acceptor, returned to a new leader during Prepare
+type AcceptedRMW struct {
 	Instance int32
-	OK       uint8
 	Ballot   int32
+	Phase    uint8
 	Command  []state.Command
+	Key      state.Key
+	Payload  Payload
 }
 
 type RMWGet struct {
-	LeaderId int32
-	Instance int32
-	Ballot   int32
-	Command  []state.Command
+	LeaderId    int32
+	Instance    int32
+	Ballot      int32
+	Command     []state.Command
+	DoneUpTo    int32 // RMW instances committed by the leader
+	LeaderEpoch int32
 }
 
 type RMWGetReply struct {
-	Instance int32
-	Ballot   int32
-	Key      int
-	Payload  Payload
+	ReplicaID   int32
+	Instance    int32
+	OK          uint8
+	Ballot      int32
+	Key         state.Key
+	Payload     Payload
+	LeaderEpoch int32
 }
 
 type RMWSet struct {
-	LeaderId int32
-	Instance int32
-	Ballot   int32
-	Command  []state.Command
-	Key      int
-	Payload  Payload
+	LeaderId    int32
+	Instance    int32
+	Ballot      int32
+	Command     []state.Command
+	Key         state.Key
+	Payload     Payload
+	DoneUpTo    int32 // RMW instances committed by the leader
+	LeaderEpoch int32
 }
 
 type RMWSetReply struct {
-	Instance int32
-	OK       uint8
-	Ballot   int32
+	ReplicaID   int32
+	Instance    int32
+	OK          uint8
+	Ballot      int32
+	Leases      []LeaseInfo
+	LeaderEpoch int32
 }
 
 type Commit struct {
@@ -104,3 +145,185 @@ type CommitShort struct {
 	Count    int32
 	Ballot   int32
 }
+
+// Asks the replicas for a lease letting the RMW leader serve reads locally.
+// Replicas that grant it report it to the coordinators of writes until it expires
+type LeaseRequest struct {
+	LeaderId int32
+	Seq      int32
+	Duration int64 // nanoseconds
+}
+
+type LeaseGrant struct {
+	ReplicaID int32
+	Seq       int32
+	OK        uint8
+}
+
+// Read lease held by a replica, reported by a replica that granted it.
+// The holder must acknowledge writes to the keys it covers until it expires
+type LeaseInfo struct {
+	Holder int32
+	Left   int // nanoseconds before the lease expires
+}
+
+// Sent by a leader stepping down, so that its lease can be granted to the next one
+type LeaseRelease struct {
+	LeaderId int32
+}
+
+// Erasure-coded ABD: replicas store one fragment of each value.
+// A write queries the highest finalized tag, pre-writes the fragments under a new tag, then finalizes it.
+// A read queries the highest finalized tag, then finalizes it and collects fragments to decode the value
+type CodedQuery struct {
+	ReplicaID int32
+	Instance  int32
+	Key       state.Key
+}
+
+type CodedQueryReply struct {
+	ReplicaID int32
+	Instance  int32
+	Tag       Tag // highest finalized tag of the key
+}
+
+// Pre-write of the fragment of the receiver
+type CodedWrite struct {
+	ReplicaID int32
+	Instance  int32
+	Key       state.Key
+	Tag       Tag
+	Size      int // bytes of the coded value
+	Fragment  []byte
+}
+
+type CodedWriteReply struct {
+	ReplicaID int32
+	Instance  int32
+	Key       state.Key
+	Tag       Tag
+}
+
+type CodedFinalize struct {
+	ReplicaID int32
+	Instance  int32
+	Read      uint8 // return the fragment of the tag
+	Key       state.Key
+	Tag       Tag
+}
+
+type CodedFinalizeReply struct {
+	ReplicaID int32
+	Instance  int32
+	Key       state.Key
+	Tag       Tag   // key and tag finalized, replies to an earlier operation with the same instance are ignored
+	Has       uint8 // the fragment is included, it is not if it was not received or was garbage collected
+	Size      int
+	Fragment  []byte
+}
+
+// Types of records in the stable store log
+const (
+	LOG_SET     uint8 = iota // value-tag pair stored for a key
+	LOG_PROMISE              // ballot promised to a leader
+	LOG_RMW                  // RMW instance accepted
+	LOG_COLLECT              // tombstone garbage collected
+)
+
+// Record appended to the stable store before replying to the message that caused it
+type LogRecord struct {
+	Type     uint8
+	Instance int32
+	Ballot   int32
+	Phase    uint8
+	Command  []state.Command
+	Key      state.Key
+	Payload  Payload
+}
+
+// Value-tag pair stored for a key
+type KeyPayload struct {
+	Key     state.Key
+	Payload Payload
+}
+
+// Checkpoint of the replica state, replacing the log records written before it
+type Snapshot struct {
+	DefaultBallot int32
+	RmwDoneUpTo   int32
+	CrtRmwId      int32
+	CollectedUpTo int
+	Data          []KeyPayload
+	Accepted      []AcceptedRMW // RMW instances after RmwDoneUpTo
+}
+
+// Request for the state of a peer, sent by a replica catching up after being down
+type CatchUp struct {
+	ReplicaID    int32
+	FromInstance int32 // first RMW instance the replica is missing
+}
+
+// Part of the state of a peer. The last chunk also carries the RMW progress
+type CatchUpChunk struct {
+	ReplicaID     int32
+	Seq           int32
+	Last          uint8
+	DefaultBallot int32
+	RmwDoneUpTo   int32
+	CrtRmwId      int32
+	CollectedUpTo int
+	Data          []KeyPayload
+	Accepted      []AcceptedRMW
+	LeaderEpoch   int32
+}
+
+// Tag of the value stored for a key
+type KeyTag struct {
+	Key state.Key
+	Tag Tag
+}
+
+// Asks a peer for its tags of keys whose tombstones the sender wants to garbage collect
+type TombstoneCheck struct {
+	ReplicaID  int32
+	Seq        int32
+	Tombstones []KeyTag
+}
+
+// Tags stored by the peer for the keys checked, in the same order
+type TombstoneCheckReply struct {
+	ReplicaID int32
+	Seq       int32
+	Tags      []Tag
+}
+
+// Asks a peer for the entries it stores in a key range, for a quorum scan
+type ScanQuery struct {
+	ReplicaID int32
+	Scan      int32
+	Start     state.Key
+	End       state.Key // excluded, no bound if empty
+	Limit     int32
+}
+
+// Entries of the peer in the range, tombstones included, in key order
+type ScanQueryReply struct {
+	ReplicaID int32
+	Scan      int32
+	Full      uint8 // the peer stopped at the limit, it may have entries after the last one sent
+	Data      []KeyPayload
+	Leases    []LeaseInfo // leases granted by the sender that cover keys in the range
+}
+
+// Values returned by a quorum scan, stored on the peers that did not have them
+type ScanWriteBack struct {
+	ReplicaID int32
+	Scan      int32
+	Data      []KeyPayload
+}
+
+type ScanWriteBackReply struct {
+	ReplicaID int32
+	Scan      int32
+	Leases    []LeaseInfo // leases granted by the sender that cover the keys written back
+}
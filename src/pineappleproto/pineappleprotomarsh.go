@@ -18,7 +18,7 @@ func (t *Set) New() fastrpc.Serializable {
 	return new(Set)
 }
 func (t *Set) BinarySize() (nbytes int, sizeKnown bool) {
-	return 41, true
+	return 0, false
 }
 
 type SetCache struct {
@@ -51,9 +51,9 @@ func (p *SetCache) Put(t *Set) {
 	p.mu.Unlock()
 }
 func (t *Set) Marshal(wire io.Writer) {
-	var b [41]byte
+	var b [9]byte
 	var bs []byte
-	bs = b[:41]
+	bs = b[:9]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -65,59 +65,27 @@ func (t *Set) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp32 >> 8)
 	bs[7] = byte(tmp32)
 	bs[8] = byte(t.Write)
-	tmp64 := t.Key
-	bs[9] = byte(tmp64 >> 56)
-	bs[10] = byte(tmp64 >> 48)
-	bs[11] = byte(tmp64 >> 40)
-	bs[12] = byte(tmp64 >> 32)
-	bs[13] = byte(tmp64 >> 24)
-	bs[14] = byte(tmp64 >> 16)
-	bs[15] = byte(tmp64 >> 8)
-	bs[16] = byte(tmp64)
-	tmp64 = t.Payload.Tag.Timestamp
-	bs[17] = byte(tmp64 >> 56)
-	bs[18] = byte(tmp64 >> 48)
-	bs[19] = byte(tmp64 >> 40)
-	bs[20] = byte(tmp64 >> 32)
-	bs[21] = byte(tmp64 >> 24)
-	bs[22] = byte(tmp64 >> 16)
-	bs[23] = byte(tmp64 >> 8)
-	bs[24] = byte(tmp64)
-	tmp64 = t.Payload.Tag.ID
-	bs[25] = byte(tmp64 >> 56)
-	bs[26] = byte(tmp64 >> 48)
-	bs[27] = byte(tmp64 >> 40)
-	bs[28] = byte(tmp64 >> 32)
-	bs[29] = byte(tmp64 >> 24)
-	bs[30] = byte(tmp64 >> 16)
-	bs[31] = byte(tmp64 >> 8)
-	bs[32] = byte(tmp64)
-	tmp64 = t.Payload.Value
-	bs[33] = byte(tmp64 >> 56)
-	bs[34] = byte(tmp64 >> 48)
-	bs[35] = byte(tmp64 >> 40)
-	bs[36] = byte(tmp64 >> 32)
-	bs[37] = byte(tmp64 >> 24)
-	bs[38] = byte(tmp64 >> 16)
-	bs[39] = byte(tmp64 >> 8)
-	bs[40] = byte(tmp64)
 	wire.Write(bs)
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
 }
 
 func (t *Set) Unmarshal(wire io.Reader) error {
-	var b [41]byte
+	var b [9]byte
 	var bs []byte
-	bs = b[:41]
-	if _, err := io.ReadAtLeast(wire, bs, 41); err != nil {
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.Write = uint8(bs[8])
-	t.Key = int(((uint64(bs[9]) << 56) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 40) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 24) | (uint64(bs[14]) << 16) | (uint64(bs[15]) << 8) | uint64(bs[16])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[17]) << 56) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 40) | (uint64(bs[20]) << 32) | (uint64(bs[21]) << 24) | (uint64(bs[22]) << 16) | (uint64(bs[23]) << 8) | uint64(bs[24])))
-	t.Payload.Tag.ID = int(((uint64(bs[25]) << 56) | (uint64(bs[26]) << 48) | (uint64(bs[27]) << 40) | (uint64(bs[28]) << 32) | (uint64(bs[29]) << 24) | (uint64(bs[30]) << 16) | (uint64(bs[31]) << 8) | uint64(bs[32])))
-	t.Payload.Value = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -125,7 +93,7 @@ func (t *SetReply) New() fastrpc.Serializable {
 	return new(SetReply)
 }
 func (t *SetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 4, true
+	return 0, false
 }
 
 type SetReplyCache struct {
@@ -158,25 +126,78 @@ func (p *SetReplyCache) Put(t *SetReply) {
 	p.mu.Unlock()
 }
 func (t *SetReply) Marshal(wire io.Writer) {
-	var b [4]byte
+	var b [10]byte
 	var bs []byte
-	bs = b[:4]
-	tmp32 := t.Instance
+	bs = b[:8]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Leases))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Leases[i].Holder
+		bs[0] = byte(tmp32 >> 24)
+		bs[1] = byte(tmp32 >> 16)
+		bs[2] = byte(tmp32 >> 8)
+		bs[3] = byte(tmp32)
+		wire.Write(bs)
+		bs = b[:8]
+		tmp64 := t.Leases[i].Left
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
 }
 
-func (t *SetReply) Unmarshal(wire io.Reader) error {
-	var b [4]byte
+func (t *SetReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
 	var bs []byte
-	bs = b[:4]
-	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Leases = make([]LeaseInfo, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Leases[i].Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Leases[i].Left = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
 	return nil
 }
 
@@ -217,7 +238,7 @@ func (p *RMWSetCache) Put(t *RMWSet) {
 	p.mu.Unlock()
 }
 func (t *RMWSet) Marshal(wire io.Writer) {
-	var b [32]byte
+	var b [12]byte
 	var bs []byte
 	bs = b[:12]
 	tmp32 := t.LeaderId
@@ -244,42 +265,19 @@ func (t *RMWSet) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
-	tmp64 := t.Key
-	bs[0] = byte(tmp64 >> 56)
-	bs[1] = byte(tmp64 >> 48)
-	bs[2] = byte(tmp64 >> 40)
-	bs[3] = byte(tmp64 >> 32)
-	bs[4] = byte(tmp64 >> 24)
-	bs[5] = byte(tmp64 >> 16)
-	bs[6] = byte(tmp64 >> 8)
-	bs[7] = byte(tmp64)
-	tmp64 = t.Payload.Tag.Timestamp
-	bs[8] = byte(tmp64 >> 56)
-	bs[9] = byte(tmp64 >> 48)
-	bs[10] = byte(tmp64 >> 40)
-	bs[11] = byte(tmp64 >> 32)
-	bs[12] = byte(tmp64 >> 24)
-	bs[13] = byte(tmp64 >> 16)
-	bs[14] = byte(tmp64 >> 8)
-	bs[15] = byte(tmp64)
-	tmp64 = t.Payload.Tag.ID
-	bs[16] = byte(tmp64 >> 56)
-	bs[17] = byte(tmp64 >> 48)
-	bs[18] = byte(tmp64 >> 40)
-	bs[19] = byte(tmp64 >> 32)
-	bs[20] = byte(tmp64 >> 24)
-	bs[21] = byte(tmp64 >> 16)
-	bs[22] = byte(tmp64 >> 8)
-	bs[23] = byte(tmp64)
-	tmp64 = t.Payload.Value
-	bs[24] = byte(tmp64 >> 56)
-	bs[25] = byte(tmp64 >> 48)
-	bs[26] = byte(tmp64 >> 40)
-	bs[27] = byte(tmp64 >> 32)
-	bs[28] = byte(tmp64 >> 24)
-	bs[29] = byte(tmp64 >> 16)
-	bs[30] = byte(tmp64 >> 8)
-	bs[31] = byte(tmp64)
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
+	bs = b[:8]
+	tmp32 = t.DoneUpTo
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.LeaderEpoch
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
 	wire.Write(bs)
 }
 
@@ -289,7 +287,7 @@ func (t *RMWSet) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [32]byte
+	var b [12]byte
 	var bs []byte
 	bs = b[:12]
 	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
@@ -304,16 +302,22 @@ func (t *RMWSet) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
-	bs = b[:32]
-	if _, err := io.ReadAtLeast(wire, bs, 32); err != nil {
+	if err := t.Key.Unmarshal(wire); err != nil {
 		return err
 	}
-	t.Key = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
-	t.Payload.Tag.ID = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
-	t.Payload.Value = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.DoneUpTo = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.LeaderEpoch = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
 
@@ -398,7 +402,7 @@ func (t *Get) New() fastrpc.Serializable {
 	return new(Get)
 }
 func (t *Get) BinarySize() (nbytes int, sizeKnown bool) {
-	return 41, true
+	return 0, false
 }
 
 type GetCache struct {
@@ -431,9 +435,9 @@ func (p *GetCache) Put(t *Get) {
 	p.mu.Unlock()
 }
 func (t *Get) Marshal(wire io.Writer) {
-	var b [41]byte
+	var b [9]byte
 	var bs []byte
-	bs = b[:41]
+	bs = b[:9]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -445,59 +449,27 @@ func (t *Get) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp32 >> 8)
 	bs[7] = byte(tmp32)
 	bs[8] = byte(t.Write)
-	tmp64 := t.Key
-	bs[9] = byte(tmp64 >> 56)
-	bs[10] = byte(tmp64 >> 48)
-	bs[11] = byte(tmp64 >> 40)
-	bs[12] = byte(tmp64 >> 32)
-	bs[13] = byte(tmp64 >> 24)
-	bs[14] = byte(tmp64 >> 16)
-	bs[15] = byte(tmp64 >> 8)
-	bs[16] = byte(tmp64)
-	tmp64 = t.Payload.Tag.Timestamp
-	bs[17] = byte(tmp64 >> 56)
-	bs[18] = byte(tmp64 >> 48)
-	bs[19] = byte(tmp64 >> 40)
-	bs[20] = byte(tmp64 >> 32)
-	bs[21] = byte(tmp64 >> 24)
-	bs[22] = byte(tmp64 >> 16)
-	bs[23] = byte(tmp64 >> 8)
-	bs[24] = byte(tmp64)
-	tmp64 = t.Payload.Tag.ID
-	bs[25] = byte(tmp64 >> 56)
-	bs[26] = byte(tmp64 >> 48)
-	bs[27] = byte(tmp64 >> 40)
-	bs[28] = byte(tmp64 >> 32)
-	bs[29] = byte(tmp64 >> 24)
-	bs[30] = byte(tmp64 >> 16)
-	bs[31] = byte(tmp64 >> 8)
-	bs[32] = byte(tmp64)
-	tmp64 = t.Payload.Value
-	bs[33] = byte(tmp64 >> 56)
-	bs[34] = byte(tmp64 >> 48)
-	bs[35] = byte(tmp64 >> 40)
-	bs[36] = byte(tmp64 >> 32)
-	bs[37] = byte(tmp64 >> 24)
-	bs[38] = byte(tmp64 >> 16)
-	bs[39] = byte(tmp64 >> 8)
-	bs[40] = byte(tmp64)
 	wire.Write(bs)
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
 }
 
 func (t *Get) Unmarshal(wire io.Reader) error {
-	var b [41]byte
+	var b [9]byte
 	var bs []byte
-	bs = b[:41]
-	if _, err := io.ReadAtLeast(wire, bs, 41); err != nil {
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.Write = uint8(bs[8])
-	t.Key = int(((uint64(bs[9]) << 56) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 40) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 24) | (uint64(bs[14]) << 16) | (uint64(bs[15]) << 8) | uint64(bs[16])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[17]) << 56) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 40) | (uint64(bs[20]) << 32) | (uint64(bs[21]) << 24) | (uint64(bs[22]) << 16) | (uint64(bs[23]) << 8) | uint64(bs[24])))
-	t.Payload.Tag.ID = int(((uint64(bs[25]) << 56) | (uint64(bs[26]) << 48) | (uint64(bs[27]) << 40) | (uint64(bs[28]) << 32) | (uint64(bs[29]) << 24) | (uint64(bs[30]) << 16) | (uint64(bs[31]) << 8) | uint64(bs[32])))
-	t.Payload.Value = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -505,7 +477,7 @@ func (t *GetReply) New() fastrpc.Serializable {
 	return new(GetReply)
 }
 func (t *GetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 42, true
+	return 0, false
 }
 
 type GetReplyCache struct {
@@ -538,9 +510,9 @@ func (p *GetReplyCache) Put(t *GetReply) {
 	p.mu.Unlock()
 }
 func (t *GetReply) Marshal(wire io.Writer) {
-	var b [42]byte
+	var b [10]byte
 	var bs []byte
-	bs = b[:42]
+	bs = b[:10]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -553,60 +525,91 @@ func (t *GetReply) Marshal(wire io.Writer) {
 	bs[7] = byte(tmp32)
 	bs[8] = byte(t.OK)
 	bs[9] = byte(t.Write)
-	tmp64 := t.Key
-	bs[10] = byte(tmp64 >> 56)
-	bs[11] = byte(tmp64 >> 48)
-	bs[12] = byte(tmp64 >> 40)
-	bs[13] = byte(tmp64 >> 32)
-	bs[14] = byte(tmp64 >> 24)
-	bs[15] = byte(tmp64 >> 16)
-	bs[16] = byte(tmp64 >> 8)
-	bs[17] = byte(tmp64)
-	tmp64 = t.Payload.Tag.Timestamp
-	bs[18] = byte(tmp64 >> 56)
-	bs[19] = byte(tmp64 >> 48)
-	bs[20] = byte(tmp64 >> 40)
-	bs[21] = byte(tmp64 >> 32)
-	bs[22] = byte(tmp64 >> 24)
-	bs[23] = byte(tmp64 >> 16)
-	bs[24] = byte(tmp64 >> 8)
-	bs[25] = byte(tmp64)
-	tmp64 = t.Payload.Tag.ID
-	bs[26] = byte(tmp64 >> 56)
-	bs[27] = byte(tmp64 >> 48)
-	bs[28] = byte(tmp64 >> 40)
-	bs[29] = byte(tmp64 >> 32)
-	bs[30] = byte(tmp64 >> 24)
-	bs[31] = byte(tmp64 >> 16)
-	bs[32] = byte(tmp64 >> 8)
-	bs[33] = byte(tmp64)
-	tmp64 = t.Payload.Value
-	bs[34] = byte(tmp64 >> 56)
-	bs[35] = byte(tmp64 >> 48)
-	bs[36] = byte(tmp64 >> 40)
-	bs[37] = byte(tmp64 >> 32)
-	bs[38] = byte(tmp64 >> 24)
-	bs[39] = byte(tmp64 >> 16)
-	bs[40] = byte(tmp64 >> 8)
-	bs[41] = byte(tmp64)
 	wire.Write(bs)
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
+	bs = b[:8]
+	tmp64 := t.KeyLease
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Leases))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Leases[i].Holder
+		bs[0] = byte(tmp32 >> 24)
+		bs[1] = byte(tmp32 >> 16)
+		bs[2] = byte(tmp32 >> 8)
+		bs[3] = byte(tmp32)
+		wire.Write(bs)
+		bs = b[:8]
+		tmp64 = t.Leases[i].Left
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
 }
 
-func (t *GetReply) Unmarshal(wire io.Reader) error {
-	var b [42]byte
+func (t *GetReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
 	var bs []byte
-	bs = b[:42]
-	if _, err := io.ReadAtLeast(wire, bs, 42); err != nil {
+	bs = b[:10]
+	if _, err := io.ReadAtLeast(wire, bs, 10); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.OK = uint8(bs[8])
 	t.Write = uint8(bs[9])
-	t.Key = int(((uint64(bs[10]) << 56) | (uint64(bs[11]) << 48) | (uint64(bs[12]) << 40) | (uint64(bs[13]) << 32) | (uint64(bs[14]) << 24) | (uint64(bs[15]) << 16) | (uint64(bs[16]) << 8) | uint64(bs[17])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[18]) << 56) | (uint64(bs[19]) << 48) | (uint64(bs[20]) << 40) | (uint64(bs[21]) << 32) | (uint64(bs[22]) << 24) | (uint64(bs[23]) << 16) | (uint64(bs[24]) << 8) | uint64(bs[25])))
-	t.Payload.Tag.ID = int(((uint64(bs[26]) << 56) | (uint64(bs[27]) << 48) | (uint64(bs[28]) << 40) | (uint64(bs[29]) << 32) | (uint64(bs[30]) << 24) | (uint64(bs[31]) << 16) | (uint64(bs[32]) << 8) | uint64(bs[33])))
-	t.Payload.Value = int(((uint64(bs[34]) << 56) | (uint64(bs[35]) << 48) | (uint64(bs[36]) << 40) | (uint64(bs[37]) << 32) | (uint64(bs[38]) << 24) | (uint64(bs[39]) << 16) | (uint64(bs[40]) << 8) | uint64(bs[41])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.KeyLease = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Leases = make([]LeaseInfo, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Leases[i].Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Leases[i].Left = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
 	return nil
 }
 
@@ -647,29 +650,46 @@ func (p *PrepareReplyCache) Put(t *PrepareReply) {
 	p.mu.Unlock()
 }
 func (t *PrepareReply) Marshal(wire io.Writer) {
-	var b [10]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
-	tmp32 := t.Instance
+	bs = b[:13]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	bs[4] = byte(t.OK)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[5] = byte(tmp32 >> 24)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 8)
-	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
 	wire.Write(bs)
 	bs = b[:]
-	alen1 := int64(len(t.Command))
+	alen1 := int64(len(t.Accepted))
 	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
 		wire.Write(b[0:wlen])
 	}
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Marshal(wire)
+		t.Accepted[i].Marshal(wire)
 	}
+	bs = b[:8]
+	tmp32 = t.DoneUpTo
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.LeaderEpoch
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
 }
 
 func (t *PrepareReply) Unmarshal(rr io.Reader) error {
@@ -678,23 +698,32 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [10]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.OK = uint8(bs[4])
-	t.Ballot = int32(((uint32(bs[5]) << 24) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 8) | uint32(bs[8])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
 	}
-	t.Command = make([]state.Command, alen1)
+	t.Accepted = make([]AcceptedRMW, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Accepted[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.DoneUpTo = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.LeaderEpoch = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
 
@@ -775,7 +804,7 @@ func (t *Prepare) New() fastrpc.Serializable {
 	return new(Prepare)
 }
 func (t *Prepare) BinarySize() (nbytes int, sizeKnown bool) {
-	return 13, true
+	return 17, true
 }
 
 type PrepareCache struct {
@@ -808,9 +837,9 @@ func (p *PrepareCache) Put(t *Prepare) {
 	p.mu.Unlock()
 }
 func (t *Prepare) Marshal(wire io.Writer) {
-	var b [13]byte
+	var b [17]byte
 	var bs []byte
-	bs = b[:13]
+	bs = b[:17]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -827,20 +856,26 @@ func (t *Prepare) Marshal(wire io.Writer) {
 	bs[10] = byte(tmp32 >> 8)
 	bs[11] = byte(tmp32)
 	bs[12] = byte(t.ToInfinity)
+	tmp32 = t.LeaderEpoch
+	bs[13] = byte(tmp32 >> 24)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 8)
+	bs[16] = byte(tmp32)
 	wire.Write(bs)
 }
 
 func (t *Prepare) Unmarshal(wire io.Reader) error {
-	var b [13]byte
+	var b [17]byte
 	var bs []byte
-	bs = b[:13]
-	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+	bs = b[:17]
+	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
 		return err
 	}
 	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.Ballot = int32(((uint32(bs[8]) << 24) | (uint32(bs[9]) << 16) | (uint32(bs[10]) << 8) | uint32(bs[11])))
 	t.ToInfinity = uint8(bs[12])
+	t.LeaderEpoch = int32(((uint32(bs[13]) << 24) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 8) | uint32(bs[16])))
 	return nil
 }
 
@@ -931,7 +966,9 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -940,7 +977,7 @@ func (t *Payload) New() fastrpc.Serializable {
 	return new(Payload)
 }
 func (t *Payload) BinarySize() (nbytes int, sizeKnown bool) {
-	return 24, true
+	return 0, false
 }
 
 type PayloadCache struct {
@@ -973,9 +1010,9 @@ func (p *PayloadCache) Put(t *Payload) {
 	p.mu.Unlock()
 }
 func (t *Payload) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:24]
+	bs = b[:16]
 	tmp64 := t.Tag.Timestamp
 	bs[0] = byte(tmp64 >> 56)
 	bs[1] = byte(tmp64 >> 48)
@@ -994,28 +1031,30 @@ func (t *Payload) Marshal(wire io.Writer) {
 	bs[13] = byte(tmp64 >> 16)
 	bs[14] = byte(tmp64 >> 8)
 	bs[15] = byte(tmp64)
-	tmp64 = t.Value
-	bs[16] = byte(tmp64 >> 56)
-	bs[17] = byte(tmp64 >> 48)
-	bs[18] = byte(tmp64 >> 40)
-	bs[19] = byte(tmp64 >> 32)
-	bs[20] = byte(tmp64 >> 24)
-	bs[21] = byte(tmp64 >> 16)
-	bs[22] = byte(tmp64 >> 8)
-	bs[23] = byte(tmp64)
+	wire.Write(bs)
+	t.Value.Marshal(wire)
+	bs = b[:1]
+	bs[0] = byte(t.Deleted)
 	wire.Write(bs)
 }
 
 func (t *Payload) Unmarshal(wire io.Reader) error {
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
 	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
-	t.Value = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:1]
+	if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+		return err
+	}
+	t.Deleted = uint8(bs[0])
 	return nil
 }
 
@@ -1083,6 +1122,18 @@ func (t *RMWGet) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	bs = b[:8]
+	tmp32 = t.DoneUpTo
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.LeaderEpoch
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
 }
 
 func (t *RMWGet) Unmarshal(rr io.Reader) error {
@@ -1106,8 +1157,16 @@ func (t *RMWGet) Unmarshal(rr io.Reader) error {
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
 	}
+	t.DoneUpTo = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.LeaderEpoch = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
 
@@ -1115,7 +1174,7 @@ func (t *RMWGetReply) New() fastrpc.Serializable {
 	return new(RMWGetReply)
 }
 func (t *RMWGetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 40, true
+	return 0, false
 }
 
 type RMWGetReplyCache struct {
@@ -1148,71 +1207,59 @@ func (p *RMWGetReplyCache) Put(t *RMWGetReply) {
 	p.mu.Unlock()
 }
 func (t *RMWGetReply) Marshal(wire io.Writer) {
-	var b [40]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:40]
-	tmp32 := t.Instance
+	bs = b[:13]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	tmp32 = t.Ballot
+	tmp32 = t.Instance
 	bs[4] = byte(tmp32 >> 24)
 	bs[5] = byte(tmp32 >> 16)
 	bs[6] = byte(tmp32 >> 8)
 	bs[7] = byte(tmp32)
-	tmp64 := t.Key
-	bs[8] = byte(tmp64 >> 56)
-	bs[9] = byte(tmp64 >> 48)
-	bs[10] = byte(tmp64 >> 40)
-	bs[11] = byte(tmp64 >> 32)
-	bs[12] = byte(tmp64 >> 24)
-	bs[13] = byte(tmp64 >> 16)
-	bs[14] = byte(tmp64 >> 8)
-	bs[15] = byte(tmp64)
-	tmp64 = t.Payload.Tag.Timestamp
-	bs[16] = byte(tmp64 >> 56)
-	bs[17] = byte(tmp64 >> 48)
-	bs[18] = byte(tmp64 >> 40)
-	bs[19] = byte(tmp64 >> 32)
-	bs[20] = byte(tmp64 >> 24)
-	bs[21] = byte(tmp64 >> 16)
-	bs[22] = byte(tmp64 >> 8)
-	bs[23] = byte(tmp64)
-	tmp64 = t.Payload.Tag.ID
-	bs[24] = byte(tmp64 >> 56)
-	bs[25] = byte(tmp64 >> 48)
-	bs[26] = byte(tmp64 >> 40)
-	bs[27] = byte(tmp64 >> 32)
-	bs[28] = byte(tmp64 >> 24)
-	bs[29] = byte(tmp64 >> 16)
-	bs[30] = byte(tmp64 >> 8)
-	bs[31] = byte(tmp64)
-	tmp64 = t.Payload.Value
-	bs[32] = byte(tmp64 >> 56)
-	bs[33] = byte(tmp64 >> 48)
-	bs[34] = byte(tmp64 >> 40)
-	bs[35] = byte(tmp64 >> 32)
-	bs[36] = byte(tmp64 >> 24)
-	bs[37] = byte(tmp64 >> 16)
-	bs[38] = byte(tmp64 >> 8)
-	bs[39] = byte(tmp64)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
 	wire.Write(bs)
-}
-
-func (t *RMWGetReply) Unmarshal(wire io.Reader) error {
-	var b [40]byte
-	var bs []byte
-	bs = b[:40]
-	if _, err := io.ReadAtLeast(wire, bs, 40); err != nil {
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
+	bs = b[:4]
+	tmp32 = t.LeaderEpoch
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *RMWGetReply) Unmarshal(wire io.Reader) error {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.Ballot = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
-	t.Key = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
-	t.Payload.Tag.ID = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
-	t.Payload.Value = int(((uint64(bs[32]) << 56) | (uint64(bs[33]) << 48) | (uint64(bs[34]) << 40) | (uint64(bs[35]) << 32) | (uint64(bs[36]) << 24) | (uint64(bs[37]) << 16) | (uint64(bs[38]) << 8) | uint64(bs[39])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderEpoch = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	return nil
 }
 
@@ -1220,7 +1267,7 @@ func (t *RMWSetReply) New() fastrpc.Serializable {
 	return new(RMWSetReply)
 }
 func (t *RMWSetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 9, true
+	return 0, false
 }
 
 type RMWSetReplyCache struct {
@@ -1253,7 +1300,139 @@ func (p *RMWSetReplyCache) Put(t *RMWSetReply) {
 	p.mu.Unlock()
 }
 func (t *RMWSetReply) Marshal(wire io.Writer) {
-	var b [9]byte
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Leases))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Leases[i].Holder
+		bs[0] = byte(tmp32 >> 24)
+		bs[1] = byte(tmp32 >> 16)
+		bs[2] = byte(tmp32 >> 8)
+		bs[3] = byte(tmp32)
+		wire.Write(bs)
+		bs = b[:8]
+		tmp64 := t.Leases[i].Left
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
+	bs = b[:4]
+	tmp32 = t.LeaderEpoch
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *RMWSetReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Leases = make([]LeaseInfo, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Leases[i].Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Leases[i].Left = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderEpoch = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	return nil
+}
+
+func (t *AcceptedRMW) New() fastrpc.Serializable {
+	return new(AcceptedRMW)
+}
+func (t *AcceptedRMW) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AcceptedRMWCache struct {
+	mu    sync.Mutex
+	cache []*AcceptedRMW
+}
+
+func NewAcceptedRMWCache() *AcceptedRMWCache {
+	c := &AcceptedRMWCache{}
+	c.cache = make([]*AcceptedRMW, 0)
+	return c
+}
+
+func (p *AcceptedRMWCache) Get() *AcceptedRMW {
+	var t *AcceptedRMW
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AcceptedRMW{}
+	}
+	return t
+}
+func (p *AcceptedRMWCache) Put(t *AcceptedRMW) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AcceptedRMW) Marshal(wire io.Writer) {
+	var b [10]byte
 	var bs []byte
 	bs = b[:9]
 	tmp32 := t.Instance
@@ -1261,24 +1440,2183 @@ func (t *RMWSetReply) Marshal(wire io.Writer) {
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	bs[4] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.Phase)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Command))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Marshal(wire)
+	}
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
+}
+
+func (t *AcceptedRMW) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Ballot = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Phase = uint8(bs[8])
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Command = make([]state.Command, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *LogRecord) New() fastrpc.Serializable {
+	return new(LogRecord)
+}
+func (t *LogRecord) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LogRecordCache struct {
+	mu    sync.Mutex
+	cache []*LogRecord
+}
+
+func NewLogRecordCache() *LogRecordCache {
+	c := &LogRecordCache{}
+	c.cache = make([]*LogRecord, 0)
+	return c
+}
+
+func (p *LogRecordCache) Get() *LogRecord {
+	var t *LogRecord
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LogRecord{}
+	}
+	return t
+}
+func (p *LogRecordCache) Put(t *LogRecord) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LogRecord) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:10]
+	bs[0] = byte(t.Type)
+	tmp32 := t.Instance
+	bs[1] = byte(tmp32 >> 24)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 8)
+	bs[4] = byte(tmp32)
 	tmp32 = t.Ballot
 	bs[5] = byte(tmp32 >> 24)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 8)
 	bs[8] = byte(tmp32)
+	bs[9] = byte(t.Phase)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Command))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Marshal(wire)
+	}
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
 }
 
-func (t *RMWSetReply) Unmarshal(wire io.Reader) error {
-	var b [9]byte
+func (t *LogRecord) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
 	var bs []byte
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:10]
+	if _, err := io.ReadAtLeast(wire, bs, 10); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.OK = uint8(bs[4])
+	t.Type = uint8(bs[0])
+	t.Instance = int32(((uint32(bs[1]) << 24) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 8) | uint32(bs[4])))
 	t.Ballot = int32(((uint32(bs[5]) << 24) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 8) | uint32(bs[8])))
+	t.Phase = uint8(bs[9])
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Command = make([]state.Command, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *KeyPayload) New() fastrpc.Serializable {
+	return new(KeyPayload)
+}
+func (t *KeyPayload) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type KeyPayloadCache struct {
+	mu    sync.Mutex
+	cache []*KeyPayload
+}
+
+func NewKeyPayloadCache() *KeyPayloadCache {
+	c := &KeyPayloadCache{}
+	c.cache = make([]*KeyPayload, 0)
+	return c
+}
+
+func (p *KeyPayloadCache) Get() *KeyPayload {
+	var t *KeyPayload
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &KeyPayload{}
+	}
+	return t
+}
+func (p *KeyPayloadCache) Put(t *KeyPayload) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *KeyPayload) Marshal(wire io.Writer) {
+	t.Key.Marshal(wire)
+	t.Payload.Marshal(wire)
+}
+
+func (t *KeyPayload) Unmarshal(wire io.Reader) error {
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Payload.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Snapshot) New() fastrpc.Serializable {
+	return new(Snapshot)
+}
+func (t *Snapshot) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type SnapshotCache struct {
+	mu    sync.Mutex
+	cache []*Snapshot
+}
+
+func NewSnapshotCache() *SnapshotCache {
+	c := &SnapshotCache{}
+	c.cache = make([]*Snapshot, 0)
+	return c
+}
+
+func (p *SnapshotCache) Get() *Snapshot {
+	var t *Snapshot
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Snapshot{}
+	}
+	return t
+}
+func (p *SnapshotCache) Put(t *Snapshot) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Snapshot) Marshal(wire io.Writer) {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	tmp32 := t.DefaultBallot
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.RmwDoneUpTo
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	tmp32 = t.CrtRmwId
+	bs[8] = byte(tmp32 >> 24)
+	bs[9] = byte(tmp32 >> 16)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32)
+	tmp64 := t.CollectedUpTo
+	bs[12] = byte(tmp64 >> 56)
+	bs[13] = byte(tmp64 >> 48)
+	bs[14] = byte(tmp64 >> 40)
+	bs[15] = byte(tmp64 >> 32)
+	bs[16] = byte(tmp64 >> 24)
+	bs[17] = byte(tmp64 >> 16)
+	bs[18] = byte(tmp64 >> 8)
+	bs[19] = byte(tmp64)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Data))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Data[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.Accepted))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		t.Accepted[i].Marshal(wire)
+	}
+}
+
+func (t *Snapshot) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.DefaultBallot = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.RmwDoneUpTo = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.CrtRmwId = int32(((uint32(bs[8]) << 24) | (uint32(bs[9]) << 16) | (uint32(bs[10]) << 8) | uint32(bs[11])))
+	t.CollectedUpTo = int(((uint64(bs[12]) << 56) | (uint64(bs[13]) << 48) | (uint64(bs[14]) << 40) | (uint64(bs[15]) << 32) | (uint64(bs[16]) << 24) | (uint64(bs[17]) << 16) | (uint64(bs[18]) << 8) | uint64(bs[19])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Data = make([]KeyPayload, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Data[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Accepted = make([]AcceptedRMW, alen2)
+	for i := int64(0); i < alen2; i++ {
+		if err := t.Accepted[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *CatchUp) New() fastrpc.Serializable {
+	return new(CatchUp)
+}
+func (t *CatchUp) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type CatchUpCache struct {
+	mu    sync.Mutex
+	cache []*CatchUp
+}
+
+func NewCatchUpCache() *CatchUpCache {
+	c := &CatchUpCache{}
+	c.cache = make([]*CatchUp, 0)
+	return c
+}
+
+func (p *CatchUpCache) Get() *CatchUp {
+	var t *CatchUp
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CatchUp{}
+	}
+	return t
+}
+func (p *CatchUpCache) Put(t *CatchUp) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CatchUp) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.FromInstance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *CatchUp) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.FromInstance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	return nil
+}
+
+func (t *CatchUpChunk) New() fastrpc.Serializable {
+	return new(CatchUpChunk)
+}
+func (t *CatchUpChunk) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CatchUpChunkCache struct {
+	mu    sync.Mutex
+	cache []*CatchUpChunk
+}
+
+func NewCatchUpChunkCache() *CatchUpChunkCache {
+	c := &CatchUpChunkCache{}
+	c.cache = make([]*CatchUpChunk, 0)
+	return c
+}
+
+func (p *CatchUpChunkCache) Get() *CatchUpChunk {
+	var t *CatchUpChunk
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CatchUpChunk{}
+	}
+	return t
+}
+func (p *CatchUpChunkCache) Put(t *CatchUpChunk) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CatchUpChunk) Marshal(wire io.Writer) {
+	var b [29]byte
+	var bs []byte
+	bs = b[:29]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.Last)
+	tmp32 = t.DefaultBallot
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
+	tmp32 = t.RmwDoneUpTo
+	bs[13] = byte(tmp32 >> 24)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 8)
+	bs[16] = byte(tmp32)
+	tmp32 = t.CrtRmwId
+	bs[17] = byte(tmp32 >> 24)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 8)
+	bs[20] = byte(tmp32)
+	tmp64 := t.CollectedUpTo
+	bs[21] = byte(tmp64 >> 56)
+	bs[22] = byte(tmp64 >> 48)
+	bs[23] = byte(tmp64 >> 40)
+	bs[24] = byte(tmp64 >> 32)
+	bs[25] = byte(tmp64 >> 24)
+	bs[26] = byte(tmp64 >> 16)
+	bs[27] = byte(tmp64 >> 8)
+	bs[28] = byte(tmp64)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Data))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Data[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.Accepted))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		t.Accepted[i].Marshal(wire)
+	}
+	bs = b[:4]
+	tmp32 = t.LeaderEpoch
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *CatchUpChunk) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [29]byte
+	var bs []byte
+	bs = b[:29]
+	if _, err := io.ReadAtLeast(wire, bs, 29); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Seq = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Last = uint8(bs[8])
+	t.DefaultBallot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	t.RmwDoneUpTo = int32(((uint32(bs[13]) << 24) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 8) | uint32(bs[16])))
+	t.CrtRmwId = int32(((uint32(bs[17]) << 24) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 8) | uint32(bs[20])))
+	t.CollectedUpTo = int(((uint64(bs[21]) << 56) | (uint64(bs[22]) << 48) | (uint64(bs[23]) << 40) | (uint64(bs[24]) << 32) | (uint64(bs[25]) << 24) | (uint64(bs[26]) << 16) | (uint64(bs[27]) << 8) | uint64(bs[28])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Data = make([]KeyPayload, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Data[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Accepted = make([]AcceptedRMW, alen2)
+	for i := int64(0); i < alen2; i++ {
+		if err := t.Accepted[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderEpoch = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	return nil
+}
+
+func (t *LeaseGrant) New() fastrpc.Serializable {
+	return new(LeaseGrant)
+}
+func (t *LeaseGrant) BinarySize() (nbytes int, sizeKnown bool) {
+	return 9, true
+}
+
+type LeaseGrantCache struct {
+	mu    sync.Mutex
+	cache []*LeaseGrant
+}
+
+func NewLeaseGrantCache() *LeaseGrantCache {
+	c := &LeaseGrantCache{}
+	c.cache = make([]*LeaseGrant, 0)
+	return c
+}
+
+func (p *LeaseGrantCache) Get() *LeaseGrant {
+	var t *LeaseGrant
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseGrant{}
+	}
+	return t
+}
+func (p *LeaseGrantCache) Put(t *LeaseGrant) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseGrant) Marshal(wire io.Writer) {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
+	wire.Write(bs)
+}
+
+func (t *LeaseGrant) Unmarshal(wire io.Reader) error {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Seq = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	return nil
+}
+
+func (t *LeaseRelease) New() fastrpc.Serializable {
+	return new(LeaseRelease)
+}
+func (t *LeaseRelease) BinarySize() (nbytes int, sizeKnown bool) {
+	return 4, true
+}
+
+type LeaseReleaseCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRelease
+}
+
+func NewLeaseReleaseCache() *LeaseReleaseCache {
+	c := &LeaseReleaseCache{}
+	c.cache = make([]*LeaseRelease, 0)
+	return c
+}
+
+func (p *LeaseReleaseCache) Get() *LeaseRelease {
+	var t *LeaseRelease
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRelease{}
+	}
+	return t
+}
+func (p *LeaseReleaseCache) Put(t *LeaseRelease) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseRelease) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *LeaseRelease) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	return nil
+}
+
+func (t *LeaseRequest) New() fastrpc.Serializable {
+	return new(LeaseRequest)
+}
+func (t *LeaseRequest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 16, true
+}
+
+type LeaseRequestCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRequest
+}
+
+func NewLeaseRequestCache() *LeaseRequestCache {
+	c := &LeaseRequestCache{}
+	c.cache = make([]*LeaseRequest, 0)
+	return c
+}
+
+func (p *LeaseRequestCache) Get() *LeaseRequest {
+	var t *LeaseRequest
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRequest{}
+	}
+	return t
+}
+func (p *LeaseRequestCache) Put(t *LeaseRequest) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseRequest) Marshal(wire io.Writer) {
+	var b [16]byte
+	var bs []byte
+	bs = b[:16]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	tmp64 := t.Duration
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *LeaseRequest) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	var bs []byte
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Seq = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Duration = int64(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	return nil
+}
+
+func (t *LeaseInfo) New() fastrpc.Serializable {
+	return new(LeaseInfo)
+}
+func (t *LeaseInfo) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+type LeaseInfoCache struct {
+	mu    sync.Mutex
+	cache []*LeaseInfo
+}
+
+func NewLeaseInfoCache() *LeaseInfoCache {
+	c := &LeaseInfoCache{}
+	c.cache = make([]*LeaseInfo, 0)
+	return c
+}
+
+func (p *LeaseInfoCache) Get() *LeaseInfo {
+	var t *LeaseInfo
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseInfo{}
+	}
+	return t
+}
+func (p *LeaseInfoCache) Put(t *LeaseInfo) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseInfo) Marshal(wire io.Writer) {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	tmp32 := t.Holder
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp64 := t.Left
+	bs[4] = byte(tmp64 >> 56)
+	bs[5] = byte(tmp64 >> 48)
+	bs[6] = byte(tmp64 >> 40)
+	bs[7] = byte(tmp64 >> 32)
+	bs[8] = byte(tmp64 >> 24)
+	bs[9] = byte(tmp64 >> 16)
+	bs[10] = byte(tmp64 >> 8)
+	bs[11] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *LeaseInfo) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Left = int(((uint64(bs[4]) << 56) | (uint64(bs[5]) << 48) | (uint64(bs[6]) << 40) | (uint64(bs[7]) << 32) | (uint64(bs[8]) << 24) | (uint64(bs[9]) << 16) | (uint64(bs[10]) << 8) | uint64(bs[11])))
+	return nil
+}
+
+func (t *CodedFinalize) New() fastrpc.Serializable {
+	return new(CodedFinalize)
+}
+func (t *CodedFinalize) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CodedFinalizeCache struct {
+	mu    sync.Mutex
+	cache []*CodedFinalize
+}
+
+func NewCodedFinalizeCache() *CodedFinalizeCache {
+	c := &CodedFinalizeCache{}
+	c.cache = make([]*CodedFinalize, 0)
+	return c
+}
+
+func (p *CodedFinalizeCache) Get() *CodedFinalize {
+	var t *CodedFinalize
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedFinalize{}
+	}
+	return t
+}
+func (p *CodedFinalizeCache) Put(t *CodedFinalize) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedFinalize) Marshal(wire io.Writer) {
+	var b [16]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.Read)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:16]
+	tmp64 := t.Tag.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *CodedFinalize) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Read = uint8(bs[8])
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	return nil
+}
+
+func (t *CodedFinalizeReply) New() fastrpc.Serializable {
+	return new(CodedFinalizeReply)
+}
+func (t *CodedFinalizeReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CodedFinalizeReplyCache struct {
+	mu    sync.Mutex
+	cache []*CodedFinalizeReply
+}
+
+func NewCodedFinalizeReplyCache() *CodedFinalizeReplyCache {
+	c := &CodedFinalizeReplyCache{}
+	c.cache = make([]*CodedFinalizeReply, 0)
+	return c
+}
+
+func (p *CodedFinalizeReplyCache) Get() *CodedFinalizeReply {
+	var t *CodedFinalizeReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedFinalizeReply{}
+	}
+	return t
+}
+func (p *CodedFinalizeReplyCache) Put(t *CodedFinalizeReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedFinalizeReply) Marshal(wire io.Writer) {
+	var b [25]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:25]
+	tmp64 := t.Tag.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	bs[16] = byte(t.Has)
+	tmp64 = t.Size
+	bs[17] = byte(tmp64 >> 56)
+	bs[18] = byte(tmp64 >> 48)
+	bs[19] = byte(tmp64 >> 40)
+	bs[20] = byte(tmp64 >> 32)
+	bs[21] = byte(tmp64 >> 24)
+	bs[22] = byte(tmp64 >> 16)
+	bs[23] = byte(tmp64 >> 8)
+	bs[24] = byte(tmp64)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Fragment))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		bs[0] = byte(t.Fragment[i])
+		wire.Write(bs)
+	}
+}
+
+func (t *CodedFinalizeReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [25]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:25]
+	if _, err := io.ReadAtLeast(wire, bs, 25); err != nil {
+		return err
+	}
+	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.Has = uint8(bs[16])
+	t.Size = int(((uint64(bs[17]) << 56) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 40) | (uint64(bs[20]) << 32) | (uint64(bs[21]) << 24) | (uint64(bs[22]) << 16) | (uint64(bs[23]) << 8) | uint64(bs[24])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Fragment = make([]byte, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+			return err
+		}
+		t.Fragment[i] = byte(bs[0])
+	}
+	return nil
+}
+
+func (t *CodedQuery) New() fastrpc.Serializable {
+	return new(CodedQuery)
+}
+func (t *CodedQuery) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CodedQueryCache struct {
+	mu    sync.Mutex
+	cache []*CodedQuery
+}
+
+func NewCodedQueryCache() *CodedQueryCache {
+	c := &CodedQueryCache{}
+	c.cache = make([]*CodedQuery, 0)
+	return c
+}
+
+func (p *CodedQueryCache) Get() *CodedQuery {
+	var t *CodedQuery
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedQuery{}
+	}
+	return t
+}
+func (p *CodedQueryCache) Put(t *CodedQuery) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedQuery) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *CodedQuery) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *CodedQueryReply) New() fastrpc.Serializable {
+	return new(CodedQueryReply)
+}
+func (t *CodedQueryReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 24, true
+}
+
+type CodedQueryReplyCache struct {
+	mu    sync.Mutex
+	cache []*CodedQueryReply
+}
+
+func NewCodedQueryReplyCache() *CodedQueryReplyCache {
+	c := &CodedQueryReplyCache{}
+	c.cache = make([]*CodedQueryReply, 0)
+	return c
+}
+
+func (p *CodedQueryReplyCache) Get() *CodedQueryReply {
+	var t *CodedQueryReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedQueryReply{}
+	}
+	return t
+}
+func (p *CodedQueryReplyCache) Put(t *CodedQueryReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedQueryReply) Marshal(wire io.Writer) {
+	var b [24]byte
+	var bs []byte
+	bs = b[:24]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	tmp64 := t.Tag.Timestamp
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[16] = byte(tmp64 >> 56)
+	bs[17] = byte(tmp64 >> 48)
+	bs[18] = byte(tmp64 >> 40)
+	bs[19] = byte(tmp64 >> 32)
+	bs[20] = byte(tmp64 >> 24)
+	bs[21] = byte(tmp64 >> 16)
+	bs[22] = byte(tmp64 >> 8)
+	bs[23] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *CodedQueryReply) Unmarshal(wire io.Reader) error {
+	var b [24]byte
+	var bs []byte
+	bs = b[:24]
+	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Tag.Timestamp = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.Tag.ID = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	return nil
+}
+
+func (t *CodedWrite) New() fastrpc.Serializable {
+	return new(CodedWrite)
+}
+func (t *CodedWrite) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CodedWriteCache struct {
+	mu    sync.Mutex
+	cache []*CodedWrite
+}
+
+func NewCodedWriteCache() *CodedWriteCache {
+	c := &CodedWriteCache{}
+	c.cache = make([]*CodedWrite, 0)
+	return c
+}
+
+func (p *CodedWriteCache) Get() *CodedWrite {
+	var t *CodedWrite
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedWrite{}
+	}
+	return t
+}
+func (p *CodedWriteCache) Put(t *CodedWrite) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedWrite) Marshal(wire io.Writer) {
+	var b [24]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:24]
+	tmp64 := t.Tag.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	tmp64 = t.Size
+	bs[16] = byte(tmp64 >> 56)
+	bs[17] = byte(tmp64 >> 48)
+	bs[18] = byte(tmp64 >> 40)
+	bs[19] = byte(tmp64 >> 32)
+	bs[20] = byte(tmp64 >> 24)
+	bs[21] = byte(tmp64 >> 16)
+	bs[22] = byte(tmp64 >> 8)
+	bs[23] = byte(tmp64)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Fragment))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		bs[0] = byte(t.Fragment[i])
+		wire.Write(bs)
+	}
+}
+
+func (t *CodedWrite) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [24]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:24]
+	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+		return err
+	}
+	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.Size = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Fragment = make([]byte, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+			return err
+		}
+		t.Fragment[i] = byte(bs[0])
+	}
+	return nil
+}
+
+func (t *CodedWriteReply) New() fastrpc.Serializable {
+	return new(CodedWriteReply)
+}
+func (t *CodedWriteReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CodedWriteReplyCache struct {
+	mu    sync.Mutex
+	cache []*CodedWriteReply
+}
+
+func NewCodedWriteReplyCache() *CodedWriteReplyCache {
+	c := &CodedWriteReplyCache{}
+	c.cache = make([]*CodedWriteReply, 0)
+	return c
+}
+
+func (p *CodedWriteReplyCache) Get() *CodedWriteReply {
+	var t *CodedWriteReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CodedWriteReply{}
+	}
+	return t
+}
+func (p *CodedWriteReplyCache) Put(t *CodedWriteReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CodedWriteReply) Marshal(wire io.Writer) {
+	var b [16]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:16]
+	tmp64 := t.Tag.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *CodedWriteReply) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	return nil
+}
+
+func (t *KeyTag) New() fastrpc.Serializable {
+	return new(KeyTag)
+}
+func (t *KeyTag) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type KeyTagCache struct {
+	mu    sync.Mutex
+	cache []*KeyTag
+}
+
+func NewKeyTagCache() *KeyTagCache {
+	c := &KeyTagCache{}
+	c.cache = make([]*KeyTag, 0)
+	return c
+}
+
+func (p *KeyTagCache) Get() *KeyTag {
+	var t *KeyTag
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &KeyTag{}
+	}
+	return t
+}
+func (p *KeyTagCache) Put(t *KeyTag) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *KeyTag) Marshal(wire io.Writer) {
+	var b [16]byte
+	var bs []byte
+	t.Key.Marshal(wire)
+	bs = b[:16]
+	tmp64 := t.Tag.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Tag.ID
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *KeyTag) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	var bs []byte
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	return nil
+}
+
+func (t *TombstoneCheck) New() fastrpc.Serializable {
+	return new(TombstoneCheck)
+}
+func (t *TombstoneCheck) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type TombstoneCheckCache struct {
+	mu    sync.Mutex
+	cache []*TombstoneCheck
+}
+
+func NewTombstoneCheckCache() *TombstoneCheckCache {
+	c := &TombstoneCheckCache{}
+	c.cache = make([]*TombstoneCheck, 0)
+	return c
+}
+
+func (p *TombstoneCheckCache) Get() *TombstoneCheck {
+	var t *TombstoneCheck
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &TombstoneCheck{}
+	}
+	return t
+}
+func (p *TombstoneCheckCache) Put(t *TombstoneCheck) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *TombstoneCheck) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Tombstones))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Tombstones[i].Marshal(wire)
+	}
+}
+
+func (t *TombstoneCheck) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Seq = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Tombstones = make([]KeyTag, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Tombstones[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TombstoneCheckReply) New() fastrpc.Serializable {
+	return new(TombstoneCheckReply)
+}
+func (t *TombstoneCheckReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type TombstoneCheckReplyCache struct {
+	mu    sync.Mutex
+	cache []*TombstoneCheckReply
+}
+
+func NewTombstoneCheckReplyCache() *TombstoneCheckReplyCache {
+	c := &TombstoneCheckReplyCache{}
+	c.cache = make([]*TombstoneCheckReply, 0)
+	return c
+}
+
+func (p *TombstoneCheckReplyCache) Get() *TombstoneCheckReply {
+	var t *TombstoneCheckReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &TombstoneCheckReply{}
+	}
+	return t
+}
+func (p *TombstoneCheckReplyCache) Put(t *TombstoneCheckReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *TombstoneCheckReply) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Tags))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:8]
+		tmp64 := t.Tags[i].Timestamp
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+		tmp64 = t.Tags[i].ID
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
+}
+
+func (t *TombstoneCheckReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Seq = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Tags = make([]Tag, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Tags[i].Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Tags[i].ID = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
+	return nil
+}
+
+func (t *ScanQuery) New() fastrpc.Serializable {
+	return new(ScanQuery)
+}
+func (t *ScanQuery) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanQueryCache struct {
+	mu    sync.Mutex
+	cache []*ScanQuery
+}
+
+func NewScanQueryCache() *ScanQueryCache {
+	c := &ScanQueryCache{}
+	c.cache = make([]*ScanQuery, 0)
+	return c
+}
+
+func (p *ScanQueryCache) Get() *ScanQuery {
+	var t *ScanQuery
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanQuery{}
+	}
+	return t
+}
+func (p *ScanQueryCache) Put(t *ScanQuery) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanQuery) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Scan
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Start.Marshal(wire)
+	t.End.Marshal(wire)
+	bs = b[:4]
+	tmp32 = t.Limit
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *ScanQuery) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Scan = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Start.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.End.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Limit = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	return nil
+}
+
+func (t *ScanQueryReply) New() fastrpc.Serializable {
+	return new(ScanQueryReply)
+}
+func (t *ScanQueryReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanQueryReplyCache struct {
+	mu    sync.Mutex
+	cache []*ScanQueryReply
+}
+
+func NewScanQueryReplyCache() *ScanQueryReplyCache {
+	c := &ScanQueryReplyCache{}
+	c.cache = make([]*ScanQueryReply, 0)
+	return c
+}
+
+func (p *ScanQueryReplyCache) Get() *ScanQueryReply {
+	var t *ScanQueryReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanQueryReply{}
+	}
+	return t
+}
+func (p *ScanQueryReplyCache) Put(t *ScanQueryReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanQueryReply) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Scan
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.Full)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Data))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Data[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.Leases))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.Leases[i].Holder
+		bs[0] = byte(tmp32 >> 24)
+		bs[1] = byte(tmp32 >> 16)
+		bs[2] = byte(tmp32 >> 8)
+		bs[3] = byte(tmp32)
+		wire.Write(bs)
+		bs = b[:8]
+		tmp64 := t.Leases[i].Left
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
+}
+
+func (t *ScanQueryReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Scan = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.Full = uint8(bs[8])
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Data = make([]KeyPayload, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Data[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Leases = make([]LeaseInfo, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Leases[i].Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Leases[i].Left = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
+	return nil
+}
+
+func (t *ScanWriteBack) New() fastrpc.Serializable {
+	return new(ScanWriteBack)
+}
+func (t *ScanWriteBack) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanWriteBackCache struct {
+	mu    sync.Mutex
+	cache []*ScanWriteBack
+}
+
+func NewScanWriteBackCache() *ScanWriteBackCache {
+	c := &ScanWriteBackCache{}
+	c.cache = make([]*ScanWriteBack, 0)
+	return c
+}
+
+func (p *ScanWriteBackCache) Get() *ScanWriteBack {
+	var t *ScanWriteBack
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanWriteBack{}
+	}
+	return t
+}
+func (p *ScanWriteBackCache) Put(t *ScanWriteBack) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanWriteBack) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Scan
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Data))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Data[i].Marshal(wire)
+	}
+}
+
+func (t *ScanWriteBack) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Scan = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Data = make([]KeyPayload, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Data[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *ScanWriteBackReply) New() fastrpc.Serializable {
+	return new(ScanWriteBackReply)
+}
+func (t *ScanWriteBackReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ScanWriteBackReplyCache struct {
+	mu    sync.Mutex
+	cache []*ScanWriteBackReply
+}
+
+func NewScanWriteBackReplyCache() *ScanWriteBackReplyCache {
+	c := &ScanWriteBackReplyCache{}
+	c.cache = make([]*ScanWriteBackReply, 0)
+	return c
+}
+
+func (p *ScanWriteBackReplyCache) Get() *ScanWriteBackReply {
+	var t *ScanWriteBackReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ScanWriteBackReply{}
+	}
+	return t
+}
+func (p *ScanWriteBackReplyCache) Put(t *ScanWriteBackReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ScanWriteBackReply) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Scan
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Leases))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Leases[i].Holder
+		bs[0] = byte(tmp32 >> 24)
+		bs[1] = byte(tmp32 >> 16)
+		bs[2] = byte(tmp32 >> 8)
+		bs[3] = byte(tmp32)
+		wire.Write(bs)
+		bs = b[:8]
+		tmp64 := t.Leases[i].Left
+		bs[0] = byte(tmp64 >> 56)
+		bs[1] = byte(tmp64 >> 48)
+		bs[2] = byte(tmp64 >> 40)
+		bs[3] = byte(tmp64 >> 32)
+		bs[4] = byte(tmp64 >> 24)
+		bs[5] = byte(tmp64 >> 16)
+		bs[6] = byte(tmp64 >> 8)
+		bs[7] = byte(tmp64)
+		wire.Write(bs)
+	}
+}
+
+func (t *ScanWriteBackReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Scan = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Leases = make([]LeaseInfo, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Leases[i].Holder = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Leases[i].Left = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	}
+	return nil
+}
+
+func (t *Heartbeat) New() fastrpc.Serializable {
+	return new(Heartbeat)
+}
+func (t *Heartbeat) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type HeartbeatCache struct {
+	mu    sync.Mutex
+	cache []*Heartbeat
+}
+
+func NewHeartbeatCache() *HeartbeatCache {
+	c := &HeartbeatCache{}
+	c.cache = make([]*Heartbeat, 0)
+	return c
+}
+
+func (p *HeartbeatCache) Get() *Heartbeat {
+	var t *Heartbeat
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Heartbeat{}
+	}
+	return t
+}
+func (p *HeartbeatCache) Put(t *Heartbeat) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Heartbeat) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.LeaderEpoch
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+}
+
+func (t *Heartbeat) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.LeaderEpoch = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
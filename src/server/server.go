@@ -20,15 +20,33 @@ import (
 
 var masterAddr *string = flag.String("maddr", "10.10.1.1", "Master address. Defaults to 10.10.1.1.")
 var masterPort *int = flag.Int("mport", 7087, "Master port.  Defaults to 7087.")
+var masterList *string = flag.String("masters", "", "Comma-separated addr:port of replicated masters, instead of -maddr and -mport.")
 var myAddr *string = flag.String("addr", "10.10.1.1", "Server address (this machine). Defaults to 10.10.1.1.")
 var portnum *int = flag.Int("port", 7070, "Port # to listen on. Defaults to 7070")
+var shardId *int = flag.Int("shard", 0, "Shard whose replica group this server joins. Defaults to 0.")
+var join *bool = flag.Bool("join", false, "Join a running replica group as a new replica, copying its state before counting in its quorums.")
+var elect *bool = flag.Bool("elect", false, "Elect the RMW leader among the replicas of the group, with heartbeats and randomized election timeouts, instead of the master appointing it. The master only learns the leader, for the clients. All the replicas of the group must use it.")
 var doPineapple *bool = flag.Bool("pineapple", true, " Use Pineapple as the replication protocol. Defaults to true.")
 var procs *int = flag.Int("p", 2, "GOMAXPROCS. Defaults to 2")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var exec = flag.Bool("exec", false, "Execute commands.")
 var dreply = flag.Bool("dreply", true, "Reply to client only after command has been executed.")
 var beacon = flag.Bool("beacon", false, "Send beacons to other replicas to compare their relative speeds.")
+var quorumMode = flag.String("quorum", pineapple.QUORUM_COUNT, "How quorums are formed: count, weight (weights add up to the quorum sizes) or regions (a majority of each of a majority of regions).")
+var topologyFile = flag.String("topology", "", "File assigning each replica to a region and a weight, one \"<id> <region> <weight>\" line per replica.")
+var readQuorum = flag.Int("readquorum", 0, "Replicas (or weight) answering an ABD read phase. Defaults to a majority.")
+var writeQuorum = flag.Int("writequorum", 0, "Replicas (or weight) acknowledging an ABD write phase. Defaults to a majority.")
+var prepareQuorum = flag.Int("preparequorum", 0, "Replicas (or weight) promising a new RMW leader (phase 1). Defaults to a majority.")
+var acceptQuorum = flag.Int("acceptquorum", 0, "Replicas (or weight) accepting an RMW (phase 2). Defaults to a majority.")
+var lease = flag.Int("lease", 0, "Milliseconds of the read lease of the RMW leader, which then answers GETs locally. 0 disables leases.")
+var keyLease = flag.Int("keylease", 0, "Milliseconds of the read leases on keys granted to the replicas reading them, which then answer GETs on those keys locally. 0 disables them.")
+var coded = flag.Int("coded", 0, "Store values as fragments of a k-of-N Reed-Solomon code instead of replicating them, with k given here. GETs and PUTs only, with the quorums sized by the code. 0 disables coding.")
+var codedGC = flag.Int("codedgc", 1, "Finalized versions of each key whose fragments are kept besides the latest one, in coded mode.")
+var thrifty = flag.Bool("thrifty", false, "Send each phase to the fastest majority only, and to the other replicas on timeout.")
 var durable = flag.Bool("durable", false, "Log to a stable store (i.e., a file in the current dir).")
+var recoverState = flag.Bool("recover", false, "Rebuild the replica state from the stable store of a previous -durable run.")
+var phaseTimeout = flag.Int("phasetimeout", 100, "Milliseconds to wait for a quorum before retransmitting a phase.")
+var retries = flag.Int("retries", 5, "Retransmissions of a phase before replying to the client with a failure.")
 
 func main() {
 	flag.Parse()
@@ -47,13 +65,54 @@ func main() {
 		go catchKill(interrupt)
 	}
 
-	log.Printf("Server starting on port %d\n", *portnum)
+	log.Printf("Server starting on port %d, in shard %d\n", *portnum, *shardId)
 
-	replicaId, nodeList := registerWithMaster(fmt.Sprintf("%s:%d", *masterAddr, *masterPort))
+	var replicaId int
+	var config masterproto.ReconfigureArgs
+	masters := masterproto.Masters(*masterList, *masterAddr, *masterPort)
+	if *join {
+		replicaId, config = joinGroup(masters)
+	} else {
+		replicaId, config = registerWithMaster(masters)
+	}
+	nodeList := config.NodeList
 
 	if *doPineapple {
+		var topology *pineapple.Topology
+		if *topologyFile != "" {
+			var err error
+			if topology, err = pineapple.LoadTopology(*topologyFile, len(nodeList)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		log.Println("Starting Pineapple replica...")
-		rep := pineapple.NewReplica(replicaId, nodeList, *exec, *dreply)
+		rep := pineapple.NewReplica(&pineapple.Config{
+			Id:               replicaId,
+			Shard:            *shardId,
+			PeerAddrList:     nodeList,
+			Thrifty:          *thrifty,
+			Exec:             *exec,
+			Dreply:           *dreply,
+			Beacon:           *beacon,
+			Durable:          *durable,
+			Recovering:       *recoverState,
+			Timeout:          time.Duration(*phaseTimeout) * time.Millisecond,
+			MaxRetries:       *retries,
+			QuorumMode:       *quorumMode,
+			Topology:         topology,
+			ReadQuorum:       *readQuorum,
+			WriteQuorum:      *writeQuorum,
+			PrepareQuorum:    *prepareQuorum,
+			AcceptQuorum:     *acceptQuorum,
+			LeaseDuration:    time.Duration(*lease) * time.Millisecond,
+			KeyLeaseDuration: time.Duration(*keyLease) * time.Millisecond,
+			CodedK:           *coded,
+			CodedGC:          *codedGC,
+			Group:            &config,
+			Joining:          *join,
+			Elect:            *elect,
+			Masters:          masters})
 		rpc.Register(rep)
 	}
 
@@ -67,23 +126,38 @@ func main() {
 	http.Serve(l, nil)
 }
 
-func registerWithMaster(masterAddr string) (int, []string) {
-	args := &masterproto.RegisterArgs{*myAddr, *portnum}
+func registerWithMaster(masters []string) (int, masterproto.ReconfigureArgs) {
+	args := &masterproto.RegisterArgs{*myAddr, *portnum, *shardId, *elect}
 	var reply masterproto.RegisterReply
 
 	for done := false; !done; {
-		mcli, err := rpc.DialHTTP("tcp", masterAddr)
+		err := masterproto.Call(masters, "Master.Register", args, &reply)
+		if err == nil && reply.Ready == true {
+			done = true
+			break
+		}
+		time.Sleep(1e9)
+	}
+
+	return reply.ReplicaId, reply.Config
+}
+
+// Asks the master to add this server to the group of its shard
+func joinGroup(masters []string) (int, masterproto.ReconfigureArgs) {
+	args := &masterproto.AddReplicaArgs{Addr: *myAddr, Port: *portnum, Shard: *shardId}
+	var reply masterproto.AddReplicaReply
+
+	for done := false; !done; {
+		err := masterproto.Call(masters, "Master.AddReplica", args, &reply)
 		if err == nil {
-			err = mcli.Call("Master.Register", args, &reply)
-			if err == nil && reply.Ready == true {
-				done = true
-				break
-			}
+			done = true
+			break
 		}
+		log.Println("Could not join the group:", err)
 		time.Sleep(1e9)
 	}
 
-	return reply.ReplicaId, reply.NodeList
+	return reply.ReplicaId, reply.Config
 }
 
 func catchKill(interrupt chan os.Signal) {
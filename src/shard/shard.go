@@ -0,0 +1,119 @@
+package shard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"pineapple/src/state"
+)
+
+// Key ranges of the shards, each held by its own replica group.
+// Shard i holds the keys from Splits[i-1] (included) to Splits[i] (excluded), the first shard has no lower
+// bound and the last no upper bound. Keys are ordered byte-wise, as in range scans
+type Map struct {
+	Splits []state.Key // in increasing order, one less than the shards
+}
+
+func New(splits []state.Key) (*Map, error) {
+	for i := range splits {
+		if splits[i] == "" {
+			return nil, fmt.Errorf("empty split key")
+		}
+		if i > 0 && splits[i] <= splits[i-1] {
+			return nil, fmt.Errorf("split keys %q and %q are not in increasing order", splits[i-1], splits[i])
+		}
+	}
+	return &Map{splits}, nil
+}
+
+// Map splitting evenly the keys 0 to keys-1 written in decimal, as those of the benchmark clients.
+// The keys are ordered byte-wise, so each split is the key of a given rank in that order
+func Even(shards int, keys int64) (*Map, error) {
+	if keys < int64(shards) {
+		return nil, fmt.Errorf("%d keys cannot be split into %d shards", keys, shards)
+	}
+	splits := make([]state.Key, 0, shards-1)
+	for i := 1; i < shards; i++ {
+		rank := int64(i)*(keys/int64(shards)) + int64(i)*(keys%int64(shards))/int64(shards) // i*keys/shards
+		splits = append(splits, intKeyOfRank(rank, keys))
+	}
+	return &Map{splits}, nil
+}
+
+// Key of the given rank, from 0, among the keys 0 to keys-1 written in decimal and ordered byte-wise.
+// Walks down the decimal prefixes, skipping those whose keys all come before the rank
+func intKeyOfRank(rank int64, keys int64) state.Key {
+	if rank == 0 {
+		return state.IntKey(0)
+	}
+	prefix := int64(1)
+	rank-- // keys of rank 1 and over, from 1 to keys-1, are ranked from 0 under the prefixes 1 to 9
+	for rank > 0 {
+		if under := keysUnder(prefix, keys-1); under <= rank {
+			prefix++
+			rank -= under
+		} else {
+			prefix *= 10
+			rank--
+		}
+	}
+	return state.IntKey(prefix)
+}
+
+// Keys from 1 to max starting with the decimal digits of prefix, the prefix included
+func keysUnder(prefix int64, max int64) int64 {
+	count := int64(0)
+	first, last := prefix, prefix // keys under the prefix with as many digits as first
+	for {
+		if last >= max {
+			return count + max - first + 1
+		}
+		count += last - first + 1
+		if first > max/10 {
+			return count
+		}
+		first *= 10
+		if last > (max-9)/10 {
+			last = max
+		} else {
+			last = last*10 + 9
+		}
+	}
+}
+
+// Map given by comma-separated split keys, or the even map of evenKeys keys if there are none
+func Parse(splits string, shards int, evenKeys int64) (*Map, error) {
+	if splits == "" {
+		return Even(shards, evenKeys)
+	}
+	keys := make([]state.Key, 0, shards-1)
+	for _, s := range strings.Split(splits, ",") {
+		keys = append(keys, state.Key(s))
+	}
+	if len(keys) != shards-1 {
+		return nil, fmt.Errorf("%d split keys given for %d shards", len(keys), shards)
+	}
+	return New(keys)
+}
+
+func (m *Map) Shards() int {
+	return len(m.Splits) + 1
+}
+
+// Shard holding the key
+func (m *Map) Lookup(key state.Key) int {
+	return sort.Search(len(m.Splits), func(i int) bool { return key < m.Splits[i] })
+}
+
+// Keys held by a shard, from start (included) to end (excluded). An empty end means no upper bound
+func (m *Map) Range(shard int) (state.Key, state.Key) {
+	var start, end state.Key
+	if shard > 0 {
+		start = m.Splits[shard-1]
+	}
+	if shard < len(m.Splits) {
+		end = m.Splits[shard]
+	}
+	return start, end
+}
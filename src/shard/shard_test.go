@@ -0,0 +1,132 @@
+package shard
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+// The keys 0 to keys-1 in byte-wise order
+func sortedIntKeys(keys int64) []state.Key {
+	sorted := make([]state.Key, keys)
+	for k := range sorted {
+		sorted[k] = state.IntKey(int64(k))
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func TestNew(t *testing.T) {
+	for _, splits := range [][]state.Key{{""}, {"b", "a"}, {"a", "a"}} {
+		if _, err := New(splits); err == nil {
+			t.Errorf("built a map split at %q", splits)
+		}
+	}
+	if m, err := New(nil); err != nil || m.Shards() != 1 {
+		t.Fatalf("map without splits: %v, %v", m, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse("g,p", 3, 0)
+	if err != nil || !reflect.DeepEqual(m.Splits, []state.Key{"g", "p"}) {
+		t.Fatalf("parsed %v, %v", m, err)
+	}
+	for _, bad := range []struct {
+		splits string
+		shards int
+	}{{"g", 3}, {"g,p", 2}, {"p,g", 3}, {"g,,p", 4}} {
+		if m, err := Parse(bad.splits, bad.shards, 0); err == nil {
+			t.Errorf("parsed %q for %d shards: %v", bad.splits, bad.shards, m.Splits)
+		}
+	}
+	if m, err := Parse("", 4, 1000); err != nil || m.Shards() != 4 {
+		t.Fatalf("even map: %v, %v", m, err)
+	}
+}
+
+// A key belongs to the shard whose range holds it, splits included in the shard they start
+func TestLookupRange(t *testing.T) {
+	m, err := New([]state.Key{"g", "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key   state.Key
+		shard int
+	}{{"", 0}, {"a", 0}, {"fzz", 0}, {"g", 1}, {"g0", 1}, {"o", 1}, {"p", 2}, {"zzz", 2}}
+	for _, test := range tests {
+		shard := m.Lookup(test.key)
+		if shard != test.shard {
+			t.Errorf("%q in shard %d, not %d", test.key, shard, test.shard)
+		}
+		start, end := m.Range(shard)
+		if test.key < start || (end != "" && test.key >= end) {
+			t.Errorf("%q outside the range [%q, %q) of its shard %d", test.key, start, end, shard)
+		}
+	}
+	if start, end := m.Range(0); start != "" || end != "g" {
+		t.Errorf("first shard holds [%q, %q)", start, end)
+	}
+	if start, end := m.Range(2); start != "p" || end != "" {
+		t.Errorf("last shard holds [%q, %q)", start, end)
+	}
+}
+
+// The splits are the keys of evenly spaced ranks in byte-wise order, so each shard holds as many keys, within one
+func TestEven(t *testing.T) {
+	for _, keys := range []int64{1, 2, 9, 10, 11, 99, 100, 101, 1000, 4321, 100000} {
+		sorted := sortedIntKeys(keys)
+		for _, shards := range []int{1, 2, 3, 7, 10, 16} {
+			m, err := Even(shards, keys)
+			if keys < int64(shards) {
+				if err == nil {
+					t.Errorf("split %d keys into %d shards: %v", keys, shards, m.Splits)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := New(m.Splits); err != nil || m.Shards() != shards {
+				t.Fatalf("%d keys, %d shards: splits %v, %v", keys, shards, m.Splits, err)
+			}
+			for i, split := range m.Splits {
+				if want := sorted[int64(i+1)*keys/int64(shards)]; split != want {
+					t.Fatalf("%d keys, %d shards: split %d is %q, not %q", keys, shards, i, split, want)
+				}
+			}
+			held := make([]int64, shards)
+			for _, key := range sorted {
+				held[m.Lookup(key)]++
+			}
+			for shard, n := range held {
+				if n < keys/int64(shards) || n > keys/int64(shards)+1 {
+					t.Errorf("%d keys, %d shards: shard %d holds %d", keys, shards, shard, n)
+				}
+			}
+		}
+	}
+}
+
+// Large key spaces, as the 1e9 keys of the zipfian clients, are split without overflowing
+func TestEvenLargeKeySpace(t *testing.T) {
+	for _, keys := range []int64{1e9, 1e18, math.MaxInt64 / 16} {
+		m, err := Even(16, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(m.Splits); err != nil {
+			t.Fatalf("%d keys: splits %v, %v", keys, m.Splits, err)
+		}
+		for _, split := range m.Splits {
+			if k, err := strconv.ParseInt(string(split), 10, 64); err != nil || k < 0 || k >= keys {
+				t.Fatalf("%d keys: split %q out of the key space", keys, split)
+			}
+		}
+	}
+}
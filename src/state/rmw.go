@@ -0,0 +1,113 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Identifies the modify function applied by an RMW command
+type ModifyId uint8
+
+// Built-in modify functions. Registered functions get ids after these.
+// The numeric ones read values as 8-byte little-endian numbers (see Value.Int)
+const (
+	FETCH_AND_ADD    ModifyId = iota // old + V
+	COMPARE_AND_SWAP                 // V if old == Arg, otherwise old
+	MAXIMUM                          // max(old, V)
+	MINIMUM                          // min(old, V)
+)
+
+// A modify function computes the new value of a key from its current value and the RMW command.
+// It must be deterministic: the leader runs it and replicates the result, and a new leader
+// may run it again for an RMW that was not chosen before the leader change.
+type Modify func(old Value, cmd *Command) Value
+
+type modifyRegistry struct {
+	mutex *sync.RWMutex
+	fns   []Modify
+	ids   map[string]ModifyId
+}
+
+var modifies = &modifyRegistry{
+	new(sync.RWMutex),
+	[]Modify{fetchAndAdd, compareAndSwap, maximum, minimum},
+	map[string]ModifyId{
+		"add": FETCH_AND_ADD,
+		"cas": COMPARE_AND_SWAP,
+		"max": MAXIMUM,
+		"min": MINIMUM,
+	},
+}
+
+// Registers a named modify function and returns the id RMW commands use to select it.
+// Every replica must register the same functions in the same order, so that ids agree.
+// Registering a name again replaces its function and keeps its id.
+func RegisterModify(name string, fn Modify) ModifyId {
+	modifies.mutex.Lock()
+	defer modifies.mutex.Unlock()
+
+	if id, present := modifies.ids[name]; present {
+		modifies.fns[id] = fn
+		return id
+	}
+	id := ModifyId(len(modifies.fns))
+	modifies.fns = append(modifies.fns, fn)
+	modifies.ids[name] = id
+	return id
+}
+
+// Returns the id of a named modify function
+func LookupModify(name string) (ModifyId, bool) {
+	modifies.mutex.RLock()
+	defer modifies.mutex.RUnlock()
+
+	id, present := modifies.ids[name]
+	return id, present
+}
+
+// Is a modify function registered under the id
+func KnownModify(id ModifyId) bool {
+	modifies.mutex.RLock()
+	defer modifies.mutex.RUnlock()
+
+	return int(id) < len(modifies.fns)
+}
+
+// Applies the command's modify function to the current value of its key.
+// Commands with unknown functions are refused before this (see KnownModify), so a replica finding one
+// lacks a function the others registered. It panics rather than report a change it did not make
+func (c *Command) Modify(old Value) Value {
+	modifies.mutex.RLock()
+	defer modifies.mutex.RUnlock()
+
+	if int(c.Fn) >= len(modifies.fns) {
+		panic(fmt.Sprintf("unknown modify function %d, the replicas registered different functions", c.Fn))
+	}
+	return modifies.fns[c.Fn](old, c)
+}
+
+func fetchAndAdd(old Value, cmd *Command) Value {
+	return IntValue(old.Int() + cmd.V.Int())
+}
+
+func compareAndSwap(old Value, cmd *Command) Value {
+	if bytes.Equal(old, cmd.Arg) {
+		return cmd.V
+	}
+	return old
+}
+
+func maximum(old Value, cmd *Command) Value {
+	if cmd.V.Int() > old.Int() {
+		return cmd.V
+	}
+	return old
+}
+
+func minimum(old Value, cmd *Command) Value {
+	if cmd.V.Int() < old.Int() {
+		return cmd.V
+	}
+	return old
+}
@@ -1,6 +1,8 @@
 package state
 
 import (
+	"encoding/binary"
+	"strconv"
 	"sync"
 	//"fmt"
 	//"code.google.com/p/leveldb-go/leveldb"
@@ -20,16 +22,41 @@ const (
 	WLOCK
 )
 
-type Value int64
+type Value []byte
 
-const NIL Value = 0
+var NIL Value = nil
 
-type Key int64
+type Key string
+
+// Largest keys and values accepted from the wire
+const MAX_KEY_SIZE = 1 << 10
+const MAX_VALUE_SIZE = 1 << 20
+
+// Key naming a number, used by the benchmark clients
+func IntKey(k int64) Key {
+	return Key(strconv.FormatInt(k, 10))
+}
+
+// 8-byte little-endian value holding a number, as used by the numeric modify functions
+func IntValue(v int64) Value {
+	b := make(Value, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// Number held by a value, shorter values are padded with zeros and longer ones truncated
+func (v Value) Int() int64 {
+	var b [8]byte
+	copy(b[:], v)
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
 
 type Command struct {
-	Op Operation
-	K  Key
-	V  Value
+	Op  Operation
+	K   Key
+	V   Value
+	Fn  ModifyId // modify function of an RMW
+	Arg Value    // extra argument of the modify function (expected value of a compare-and-swap)
 }
 
 type State struct {
@@ -54,7 +81,7 @@ func InitState() *State {
 
 func Conflict(gamma *Command, delta *Command) bool {
 	if gamma.K == delta.K {
-		if gamma.Op == PUT || delta.Op == PUT {
+		if gamma.Op == PUT || delta.Op == PUT || gamma.Op == DELETE || delta.Op == DELETE {
 			return true
 		}
 	}
@@ -99,6 +126,14 @@ func (c *Command) Execute(st *State) Value {
 		if val, present := st.Store[c.K]; present {
 			return val
 		}
+
+	case RMW:
+		val := c.Modify(st.Store[c.K])
+		st.Store[c.K] = val
+		return val
+
+	case DELETE:
+		delete(st.Store, c.K)
 	}
 
 	return NIL
@@ -2,72 +2,104 @@ package state
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
+var ErrKeyTooLarge = errors.New("state: key too large")
+var ErrValueTooLarge = errors.New("state: value too large")
+
 func (t *Command) Marshal(w io.Writer) {
-	var b [8]byte
-	bs := b[:8]
-	bs = b[:1]
+	var b [1]byte
+	bs := b[:1]
 	b[0] = byte(t.Op)
 	w.Write(bs)
-	bs = b[:8]
-	binary.LittleEndian.PutUint64(bs, uint64(t.K))
-	w.Write(bs)
-	binary.LittleEndian.PutUint64(bs, uint64(t.V))
+	t.K.Marshal(w)
+	t.V.Marshal(w)
+	b[0] = byte(t.Fn)
 	w.Write(bs)
+	t.Arg.Marshal(w)
 }
 
 func (t *Command) Unmarshal(r io.Reader) error {
-	var b [8]byte
-	bs := b[:8]
-	bs = b[:1]
+	var b [1]byte
+	bs := b[:1]
 	if _, err := io.ReadFull(r, bs); err != nil {
 		return err
 	}
 	t.Op = Operation(b[0])
-	bs = b[:8]
-	if _, err := io.ReadFull(r, bs); err != nil {
+	if err := t.K.Unmarshal(r); err != nil {
+		return err
+	}
+	if err := t.V.Unmarshal(r); err != nil {
 		return err
 	}
-	t.K = Key(binary.LittleEndian.Uint64(bs))
 	if _, err := io.ReadFull(r, bs); err != nil {
 		return err
 	}
-	t.V = Value(binary.LittleEndian.Uint64(bs))
-	return nil
+	t.Fn = ModifyId(b[0])
+	return t.Arg.Unmarshal(r)
+}
+
+// Keys and values are sent as their length, a uvarint, followed by their bytes
+
+func marshalBytes(w io.Writer, data []byte) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(data)))
+	w.Write(b[:n])
+	w.Write(data)
+}
+
+func unmarshalBytes(r io.Reader, max int, tooLarge error) ([]byte, error) {
+	var b [binary.MaxVarintLen64]byte
+	var size uint64
+	for i, shift := 0, uint(0); ; i, shift = i+1, shift+7 {
+		if i == len(b) {
+			return nil, tooLarge
+		}
+		if _, err := io.ReadFull(r, b[i:i+1]); err != nil {
+			return nil, err
+		}
+		size |= uint64(b[i]&0x7f) << shift
+		if b[i] < 0x80 {
+			break
+		}
+	}
+	if size > uint64(max) {
+		return nil, tooLarge
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (t *Key) Marshal(w io.Writer) {
-	var b [8]byte
-	bs := b[:8]
-	binary.LittleEndian.PutUint64(bs, uint64(*t))
-	w.Write(bs)
+	marshalBytes(w, []byte(*t))
 }
 
 func (t *Value) Marshal(w io.Writer) {
-	var b [8]byte
-	bs := b[:8]
-	binary.LittleEndian.PutUint64(bs, uint64(*t))
-	w.Write(bs)
+	marshalBytes(w, *t)
 }
 
 func (t *Key) Unmarshal(r io.Reader) error {
-	var b [8]byte
-	bs := b[:8]
-	if _, err := io.ReadFull(r, bs); err != nil {
+	data, err := unmarshalBytes(r, MAX_KEY_SIZE, ErrKeyTooLarge)
+	if err != nil {
 		return err
 	}
-	*t = Key(binary.LittleEndian.Uint64(bs))
+	*t = Key(data)
 	return nil
 }
 
 func (t *Value) Unmarshal(r io.Reader) error {
-	var b [8]byte
-	bs := b[:8]
-	if _, err := io.ReadFull(r, bs); err != nil {
+	data, err := unmarshalBytes(r, MAX_VALUE_SIZE, ErrValueTooLarge)
+	if err != nil {
 		return err
 	}
-	*t = Value(binary.LittleEndian.Uint64(bs))
+	*t = data
 	return nil
 }